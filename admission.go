@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// admitFunc computes the patches for a single admission request.
+type admitFunc func(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error)
+
+// badRequestError is returned by an admitFunc when the request itself can't
+// be processed, e.g. because the object doesn't decode.
+type badRequestError string
+
+func (e badRequestError) Error() string {
+	return string(e)
+}
+
+// deniedError is returned by an admitFunc to reject the object, with the
+// reason shown to the user.
+type deniedError string
+
+func (e deniedError) Error() string {
+	return string(e)
+}
+
+// Internal error policies, deciding the answer to requests that fail on our
+// side, e.g. when patches don't marshal.
+const (
+	// internalErrorPolicyFail answers with an error, leaving it to the
+	// failurePolicy of the webhook.
+	internalErrorPolicyFail = "fail"
+	// internalErrorPolicyOpen allows the object unmodified.
+	internalErrorPolicyOpen = "open"
+)
+
+// panicError is returned by admitRecovered when admit panicked.
+type panicError struct {
+	value any
+}
+
+func (e panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+// admitRecovered runs admit, turning a panic into a panicError. net/http
+// would recover it too, but only by dropping the connection, leaving the API
+// server without an answer.
+func admitRecovered(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest, admit admitFunc) (patches []patchOperation, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("Panic while processing object", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "panic", p, "stack", string(debug.Stack()))
+			patches, err = nil, panicError{value: p}
+		}
+	}()
+	return admit(ctx, cfg, req)
+}
+
+// dryRun reports whether req is a dry run, e.g. from kubectl apply
+// --dry-run=server. The patch is still returned as a preview, but side
+// effects are left out.
+func dryRun(req *admissionv1.AdmissionRequest) bool {
+	return req.DryRun != nil && *req.DryRun
+}
+
+// namespaceDisabled reports whether the kill switch annotation is set on the
+// namespace. Failed lookups, including those timing out, are logged and
+// treated as not disabled.
+func namespaceDisabled(ctx context.Context, namespace string) (bool, error) {
+	if namespaces == nil || namespace == "" {
+		return false, nil
+	}
+	disabled, err := namespaces.disabled(ctx, namespace)
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		slog.Warn("Failed to look up namespace", "namespace", namespace, "error", err)
+		return false, nil
+	}
+	return disabled, nil
+}
+
+// responseTypeMeta returns the TypeMeta of the response to a review with
+// request. The API server expects the response in the version it sent, and
+// v1beta1 reviews have the same fields as v1, so the version is mirrored.
+func responseTypeMeta(request metav1.TypeMeta) metav1.TypeMeta {
+	typeMeta := metav1.TypeMeta{
+		APIVersion: admissionv1.SchemeGroupVersion.String(),
+		Kind:       "AdmissionReview",
+	}
+	if request.APIVersion == "admission.k8s.io/v1beta1" {
+		typeMeta.APIVersion = request.APIVersion
+	}
+	return typeMeta
+}
+
+// withTests returns patches with a test operation asserting the current
+// value in the object raw before every replace and remove, so the API server
+// rejects the patch as a whole if another webhook changed the value in the
+// meantime. Operations on paths an earlier operation touched aren't tested,
+// since the value in raw is no longer the current one by then.
+func withTests(raw []byte, patches []patchOperation) ([]patchOperation, error) {
+	// Numbers are kept as written, so they test equal
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	tested := make([]patchOperation, 0, 2*len(patches))
+	for i, p := range patches {
+		touched := slices.ContainsFunc(patches[:i], func(earlier patchOperation) bool {
+			return pathsOverlap(earlier.Path, p.Path)
+		})
+		if (p.Op == "replace" || p.Op == "remove") && !touched {
+			if value, ok := lookupJSONPointer(doc, p.Path); ok {
+				tested = append(tested, patchOperation{
+					Op:    "test",
+					Path:  p.Path,
+					Value: value,
+				})
+			}
+		}
+		tested = append(tested, p)
+	}
+	return tested, nil
+}
+
+// changes returns the number of operations in patches changing the object,
+// leaving out the test operations added by withTests.
+func changes(patches []patchOperation) int {
+	n := 0
+	for _, p := range patches {
+		if p.Op != "test" {
+			n++
+		}
+	}
+	return n
+}
+
+// pathsOverlap reports whether the JSON Pointers a and b are the same or
+// one is within the other.
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// sortPatches sorts patches by path, for easier diffing of logged patches.
+// Operations on the same path, such as appends to an array, keep their
+// order, as swapping them could change the result. Paths sort after their
+// parents, so an object is still added before its fields.
+func sortPatches(patches []patchOperation) {
+	slices.SortStableFunc(patches, func(a, b patchOperation) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+}
+
+// debugDumpLimit is the most bytes of a review logged with DebugDump.
+const debugDumpLimit = 16 * 1024
+
+// truncateDump returns b as a string of at most debugDumpLimit bytes.
+func truncateDump(b []byte) string {
+	if len(b) <= debugDumpLimit {
+		return string(b)
+	}
+	return fmt.Sprintf("%s... (%d bytes truncated)", b[:debugDumpLimit], len(b)-debugDumpLimit)
+}
+
+// inflight holds a token for every admission request being processed when
+// the number of concurrent requests is limited. It stays nil otherwise.
+var inflight chan struct{}
+
+// acquireSlot waits up to the configured queue timeout for room to process
+// another admission request, reporting whether it got it.
+func acquireSlot(ctx context.Context, cfg *Config) bool {
+	if inflight == nil {
+		return true
+	}
+	select {
+	case inflight <- struct{}{}:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case inflight <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseSlot frees the slot taken by acquireSlot.
+func releaseSlot() {
+	if inflight != nil {
+		<-inflight
+	}
+}
+
+// serveAdmission decodes the AdmissionReview in r, runs admit on it within
+// the configured admission timeout and writes the resulting review to w.
+// The handler name is reported in the X-Resource-Remover-Handler header.
+func serveAdmission(w http.ResponseWriter, r *http.Request, handler string, admit admitFunc) {
+	// A reload while the request waits for a slot or runs takes effect from
+	// the next request on
+	cfg := activeConfig.Load()
+
+	var kind, namespace, name string
+	isDryRun := false
+	// patches are computed for the object, sent are those in the response
+	var patches, sent []patchOperation
+	result := ""
+	start := time.Now()
+	ctx, summary := withSummary(r.Context())
+	defer func() {
+		elapsed := time.Since(start)
+		// Dry runs change nothing, so they're left out of the metrics
+		if !isDryRun {
+			observeRequest(handler, namespace, result, sent)
+			observeDuration(handler, namespace, elapsed, sampledTraceID(r.Header.Get("traceparent")))
+		}
+		if cfg.SlowRequestThreshold > 0 && elapsed > cfg.SlowRequestThreshold {
+			slog.Warn("Slow admission request", "handler", handler, "kind", kind, "namespace", namespace, "name", name, "result", result, "duration", elapsed)
+		}
+		attrs := []any{"handler", handler, "kind", kind, "namespace", namespace, "name", name, "result", result, "dryRun", isDryRun}
+		slog.Info("Admission request", append(attrs, summary.attrs(sent)...)...)
+	}()
+
+	// Requests beyond the concurrency limit are still answered when failing
+	// open, since allowing them requires the UID from the review.
+	acquired := acquireSlot(ctx, cfg)
+	if acquired {
+		defer releaseSlot()
+	} else if !cfg.FailOpen {
+		result = resultShed
+		http.Error(w, "too many concurrent admission requests", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		result = resultInvalid
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	if cfg.DebugDump {
+		slog.Debug("Received admission review", "handler", handler, "body", truncateDump(body))
+	}
+
+	var admissionReview admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &admissionReview); err != nil {
+		result = resultInvalid
+		http.Error(w, "failed to unmarshal admission review", http.StatusBadRequest)
+		return
+	}
+	if admissionReview.Request == nil {
+		result = resultInvalid
+		http.Error(w, "admission review has no request", http.StatusBadRequest)
+		return
+	}
+	req := admissionReview.Request
+	kind, namespace, name = req.Kind.Kind, req.Namespace, req.Name
+	isDryRun = dryRun(req)
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.AdmissionTimeout)
+	defer cancel()
+
+	var excluded, disabled bool
+	if !acquired {
+		result = resultShed
+		slog.Warn("Allowing object unmodified, too many concurrent admission requests", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name)
+	} else if excluded = namespaceExcluded(cfg, req.Namespace); !excluded {
+		disabled, err = namespaceDisabled(ctx, req.Namespace)
+	}
+	if excluded {
+		skipped(ctx, skipReasonExcluded)
+		slog.Debug("Skipping object in excluded namespace", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name)
+	} else if disabled {
+		skipped(ctx, skipReasonNamespace)
+		slog.Debug("Skipping object, mutation is disabled in namespace", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name)
+	} else if acquired && err == nil {
+		patches, err = admitRecovered(ctx, cfg, req, admit)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		result = resultTimeout
+		if !cfg.FailOpen {
+			slog.Error("Gave up on object", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "error", err)
+			http.Error(w, "admission processing did not finish in time", http.StatusGatewayTimeout)
+			return
+		}
+		slog.Warn("Allowing object unmodified", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "error", err)
+		patches, err = nil, nil
+	}
+	var badRequest badRequestError
+	if errors.As(err, &badRequest) {
+		result = resultInvalid
+		if !cfg.FailOpen {
+			http.Error(w, badRequest.Error(), http.StatusBadRequest)
+			return
+		}
+		slog.Warn("Allowing object unmodified", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "error", err)
+		patches, err = nil, nil
+	}
+	var panicked panicError
+	if errors.As(err, &panicked) {
+		result = resultPanic
+		if !cfg.FailOpen {
+			http.Error(w, "failed to process admission request", http.StatusInternalServerError)
+			return
+		}
+		slog.Warn("Allowing object unmodified", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "error", err)
+		patches, err = nil, nil
+	}
+	var denied deniedError
+	if errors.As(err, &denied) {
+		result = resultDenied
+		slog.Info("Denying object", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "reason", denied.Error())
+		patches, err = nil, nil
+	}
+	if err != nil {
+		result = resultError
+		slog.Error("Failed to process object", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "error", err)
+		if cfg.InternalErrorPolicy == internalErrorPolicyFail {
+			http.Error(w, "failed to process admission request", http.StatusInternalServerError)
+			return
+		}
+		slog.Warn("Allowing object unmodified", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name)
+		patches, err = nil, nil
+	}
+
+	response := &admissionv1.AdmissionResponse{
+		UID:     req.UID,
+		Allowed: denied == "",
+	}
+	if denied != "" {
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: denied.Error(),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		}
+	}
+	// An empty patch with a PatchType is a no-op some API servers still log
+	// about, so leave both out when there's nothing to patch.
+	if len(patches) > 0 && cfg.SafePatch {
+		if tested, err := withTests(req.Object.Raw, patches); err != nil {
+			slog.Warn("Failed to add test operations, sending the patch without them", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "error", err)
+		} else {
+			patches = tested
+		}
+	}
+	if len(patches) > 0 {
+		if cfg.StablePatchOrder {
+			sortPatches(patches)
+		}
+		patchBytes, err := json.Marshal(patches)
+		if err != nil {
+			result = resultError
+			slog.Error("Failed to marshal patches", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name, "error", err)
+			if cfg.InternalErrorPolicy == internalErrorPolicyFail {
+				http.Error(w, "failed to marshal patches", http.StatusInternalServerError)
+				return
+			}
+			slog.Warn("Allowing object unmodified", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name)
+			patches = nil
+		} else {
+			patchType := admissionv1.PatchTypeJSONPatch
+			response.PatchType = &patchType
+			response.Patch = patchBytes
+		}
+	}
+
+	respBytes, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: responseTypeMeta(admissionReview.TypeMeta),
+		Response: response,
+	})
+	if err != nil {
+		result = resultError
+		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
+		return
+	}
+	if cfg.DebugDump {
+		slog.Debug("Sending admission review", "handler", handler, "kind", kind, "namespace", namespace, "name", name, "body", truncateDump(respBytes))
+	}
+	// Requests that were let through unprocessed keep their result
+	if result == "" {
+		result = resultUnchanged
+		if len(patches) > 0 {
+			result = resultPatched
+		}
+	}
+	sent = patches
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Resource-Remover-Handler", handler)
+	w.Header().Set("X-Resource-Remover-Patches", strconv.Itoa(changes(patches)))
+	w.Write(respBytes)
+}
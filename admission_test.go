@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServeAdmissionTimeout(t *testing.T) {
+	// admit blocks until the request is given up on
+	admit := func(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+		<-ctx.Done()
+		return []patchOperation{{Op: "add", Path: "/metadata/labels", Value: map[string]string{"late": "true"}}}, nil
+	}
+	tests := []struct {
+		name     string
+		failOpen bool
+		cancel   bool
+		want     int
+	}{
+		{name: "deadline, fail open", failOpen: true, want: http.StatusOK},
+		{name: "deadline, fail closed", failOpen: false, want: http.StatusGatewayTimeout},
+		{name: "canceled, fail open", failOpen: true, cancel: true, want: http.StatusOK},
+		{name: "canceled, fail closed", failOpen: false, cancel: true, want: http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.FailOpen = tt.failOpen
+				c.AdmissionTimeout = 10 * time.Millisecond
+				if tt.cancel {
+					c.AdmissionTimeout = time.Minute
+				}
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			body := reviewBody(t, createRequest(t, "Pod", &corev1.Pod{}))
+			r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/mutate", bytes.NewReader(body))
+			w := httptest.NewRecorder()
+			serveAdmission(w, r, "test", admit)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			response := decodeResponse(t, w)
+			if !response.Allowed || response.Patch != nil {
+				t.Errorf("response = %+v, want allowed without patch", response)
+			}
+		})
+	}
+}
+
+func TestServeAdmissionHeaders(t *testing.T) {
+	one := int32(1)
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		kind        string
+		object      any
+		safePatch   bool
+		wantHandler string
+		wantPatches string
+	}{
+		{
+			name:        "pod",
+			handler:     handleMutate,
+			kind:        "Pod",
+			object:      testPod(2),
+			wantHandler: "pod",
+			// safe-to-evict, plus the requests and limits of three containers
+			wantPatches: "13",
+		},
+		{
+			name:        "pod with test operations",
+			handler:     handleMutate,
+			kind:        "Pod",
+			object:      testPod(2),
+			safePatch:   true,
+			wantHandler: "pod",
+			// The test operations don't change the object
+			wantPatches: "13",
+		},
+		{
+			name:        "hpa",
+			handler:     handleMutateHPA,
+			kind:        "HorizontalPodAutoscaler",
+			object:      &autoscalingv2.HorizontalPodAutoscaler{Spec: autoscalingv2.HorizontalPodAutoscalerSpec{MaxReplicas: 5}},
+			wantHandler: "hpa",
+			wantPatches: "2",
+		},
+		{
+			name:        "replicas unchanged",
+			handler:     handleMutateReplicas,
+			kind:        "Deployment",
+			object:      &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &one}},
+			wantHandler: "replicas",
+			wantPatches: "0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.SafePatch = tt.safePatch })
+
+			w := postReview(tt.handler, reviewBody(t, createRequest(t, tt.kind, tt.object)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, body: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("X-Resource-Remover-Handler"); got != tt.wantHandler {
+				t.Errorf("X-Resource-Remover-Handler = %q, want %q", got, tt.wantHandler)
+			}
+			if got := w.Header().Get("X-Resource-Remover-Patches"); got != tt.wantPatches {
+				t.Errorf("X-Resource-Remover-Patches = %q, want %q", got, tt.wantPatches)
+			}
+		})
+	}
+}
+
+func TestServeAdmissionPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		patches []patchOperation
+		want    string
+	}{
+		{name: "nil"},
+		{name: "empty", patches: []patchOperation{}},
+		{
+			name:    "patches",
+			patches: []patchOperation{{Op: "remove", Path: "/metadata/labels"}},
+			want:    `[{"op":"remove","path":"/metadata/labels"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admit := func(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+				return tt.patches, nil
+			}
+			w := postReview(func(w http.ResponseWriter, r *http.Request) {
+				serveAdmission(w, r, "test", admit)
+			}, reviewBody(t, createRequest(t, "Pod", &corev1.Pod{})))
+
+			response := decodeResponse(t, w)
+			if string(response.Patch) != tt.want {
+				t.Errorf("patch = %s, want %s", response.Patch, tt.want)
+			}
+			if hasType := response.PatchType != nil; hasType != (tt.want != "") {
+				t.Errorf("patchType = %v, want one only with a patch", response.PatchType)
+			}
+		})
+	}
+}
+
+func TestServeAdmissionPatchType(t *testing.T) {
+	// JSONPatch is the only patch type the API server accepts
+	tests := []struct {
+		handler http.HandlerFunc
+		kind    string
+		object  any
+	}{
+		{handleMutate, "Pod", testPod(1)},
+		{handleMutateHPA, "HorizontalPodAutoscaler", &autoscalingv2.HorizontalPodAutoscaler{Spec: autoscalingv2.HorizontalPodAutoscalerSpec{MaxReplicas: 5}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			response := decodeResponse(t, postReview(tt.handler, reviewBody(t, createRequest(t, tt.kind, tt.object))))
+			if response.PatchType == nil || *response.PatchType != admissionv1.PatchTypeJSONPatch {
+				t.Errorf("patchType = %v, want %s", response.PatchType, admissionv1.PatchTypeJSONPatch)
+			}
+		})
+	}
+}
+
+func TestServeAdmissionShedding(t *testing.T) {
+	tests := []struct {
+		name      string
+		full      bool
+		failOpen  bool
+		want      int
+		wantPatch bool
+	}{
+		{name: "free slot", want: http.StatusOK, wantPatch: true},
+		{name: "full, fail open", full: true, failOpen: true, want: http.StatusOK},
+		{name: "full, fail closed", full: true, want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {
+				c.FailOpen = tt.failOpen
+				c.MaxConcurrent = 1
+				c.QueueTimeout = 10 * time.Millisecond
+			})
+			previous := inflight
+			inflight = make(chan struct{}, cfg.MaxConcurrent)
+			t.Cleanup(func() { inflight = previous })
+			if tt.full {
+				inflight <- struct{}{}
+			}
+
+			w := postReview(handleMutate, reviewBody(t, createRequest(t, "Pod", testPod(1))))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if response := decodeResponse(t, w); (response.Patch != nil) != tt.wantPatch {
+				t.Errorf("patch = %s, want one: %t", response.Patch, tt.wantPatch)
+			}
+			if !tt.full && len(inflight) != 0 {
+				t.Errorf("%d slots still taken after the request", len(inflight))
+			}
+		})
+	}
+}
+
+func TestServeAdmissionUndecodableObject(t *testing.T) {
+	tests := []struct {
+		name     string
+		failOpen bool
+		want     int
+	}{
+		{name: "fail open", failOpen: true, want: http.StatusOK},
+		{name: "fail closed", failOpen: false, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.FailOpen = tt.failOpen })
+
+			req := createRequest(t, "Pod", &corev1.Pod{})
+			req.Object.Raw = []byte(`{"spec":[]}`)
+			w := postReview(handleMutate, reviewBody(t, req))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if response := decodeResponse(t, w); !response.Allowed || response.Patch != nil {
+				t.Errorf("response = %+v, want allowed without patch", response)
+			}
+		})
+	}
+}
+
+func TestTruncateDump(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{"empty", 0, 0},
+		{"at the limit", debugDumpLimit, debugDumpLimit},
+		{"over the limit", debugDumpLimit + 10, debugDumpLimit + len("... (10 bytes truncated)")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := truncateDump(bytes.Repeat([]byte("x"), tt.size)); len(got) != tt.want {
+				t.Errorf("len(truncateDump) = %d, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestServeAdmissionDebugDump(t *testing.T) {
+	tests := []struct {
+		name      string
+		debugDump bool
+		want      []string
+	}{
+		{name: "off"},
+		{name: "on", debugDump: true, want: []string{"Received admission review", "Sending admission review"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.DebugDump = tt.debugDump })
+			var buf bytes.Buffer
+			previous := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+			t.Cleanup(func() { slog.SetDefault(previous) })
+
+			postReview(handleMutate, reviewBody(t, createRequest(t, "Pod", testPod(1))))
+			var got []string
+			for _, msg := range []string{"Received admission review", "Sending admission review"} {
+				if strings.Contains(buf.String(), "msg=\""+msg+"\"") {
+					got = append(got, msg)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("logged %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeAdmissionVersion(t *testing.T) {
+	one := int32(1)
+	handlers := []struct {
+		name    string
+		handler http.HandlerFunc
+		kind    string
+		object  any
+	}{
+		{"pod", handleMutate, "Pod", testPod(1)},
+		{"hpa", handleMutateHPA, "HorizontalPodAutoscaler", &autoscalingv2.HorizontalPodAutoscaler{Spec: autoscalingv2.HorizontalPodAutoscalerSpec{MaxReplicas: 5}}},
+		{"replicas", handleMutateReplicas, "Deployment", &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: &one}}},
+	}
+	versions := []struct {
+		apiVersion string
+		want       string
+	}{
+		{"admission.k8s.io/v1", "admission.k8s.io/v1"},
+		{"admission.k8s.io/v1beta1", "admission.k8s.io/v1beta1"},
+		// Anything else is answered in v1
+		{"", "admission.k8s.io/v1"},
+	}
+	for _, h := range handlers {
+		for _, v := range versions {
+			t.Run(h.name+" "+v.apiVersion, func(t *testing.T) {
+				req := createRequest(t, h.kind, h.object)
+				body, err := json.Marshal(admissionv1.AdmissionReview{
+					TypeMeta: metav1.TypeMeta{APIVersion: v.apiVersion, Kind: "AdmissionReview"},
+					Request:  req,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				w := postReview(h.handler, body)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d, body: %s", w.Code, w.Body)
+				}
+				var review admissionv1.AdmissionReview
+				if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+					t.Fatal(err)
+				}
+				if review.APIVersion != v.want || review.Kind != "AdmissionReview" {
+					t.Errorf("response is a %s %s, want %s AdmissionReview", review.APIVersion, review.Kind, v.want)
+				}
+				if review.Response == nil || review.Response.UID != req.UID {
+					t.Errorf("response = %+v, want one for UID %s", review.Response, req.UID)
+				}
+			})
+		}
+	}
+}
+
+func TestServeAdmissionPanic(t *testing.T) {
+	admit := func(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+		var pod *corev1.Pod
+		return nil, errors.New(pod.Name)
+	}
+	tests := []struct {
+		name     string
+		failOpen bool
+		want     int
+	}{
+		{name: "fail open", failOpen: true, want: http.StatusOK},
+		{name: "fail closed", failOpen: false, want: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.FailOpen = tt.failOpen })
+
+			w := postReview(func(w http.ResponseWriter, r *http.Request) {
+				serveAdmission(w, r, "test", admit)
+			}, reviewBody(t, createRequest(t, "Pod", testPod(1))))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if response := decodeResponse(t, w); !response.Allowed || response.Patch != nil {
+				t.Errorf("response = %+v, want allowed without patch", response)
+			}
+		})
+	}
+}
+
+func TestServeAdmissionDryRun(t *testing.T) {
+	tests := []struct {
+		name         string
+		dryRun       bool
+		wantRequests int
+	}{
+		{name: "request", wantRequests: 1},
+		{name: "dry run", dryRun: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				requestsTotal, patchesTotal, cpuReclaimedTotal, memoryReclaimedTotal, requestDuration = nil, nil, nil, nil, nil
+			})
+			reg := prometheus.NewRegistry()
+			registerMetrics(reg, false, 0)
+
+			req := createRequest(t, "Pod", testPod(1))
+			req.DryRun = &tt.dryRun
+			// The patch is still returned as a preview
+			if response := decodeResponse(t, postReview(handleMutate, reviewBody(t, req))); response.Patch == nil {
+				t.Error("response has no patch")
+			}
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			requests := 0
+			for _, family := range families {
+				if family.GetName() == "resource_remover_admission_requests_total" {
+					for _, m := range family.GetMetric() {
+						requests += int(m.GetCounter().GetValue())
+					}
+				}
+			}
+			if requests != tt.wantRequests {
+				t.Errorf("requests counted = %d, want %d", requests, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestServeAdmissionInternalErrorPolicy(t *testing.T) {
+	failing := func(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+		return nil, errors.New("no capacity data")
+	}
+	unmarshalable := func(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+		// JSON can't encode a channel
+		return []patchOperation{{Op: "add", Path: "/metadata/labels", Value: make(chan int)}}, nil
+	}
+	tests := []struct {
+		name   string
+		policy string
+		admit  admitFunc
+		want   int
+	}{
+		{name: "error, fail", policy: internalErrorPolicyFail, admit: failing, want: http.StatusInternalServerError},
+		{name: "error, open", policy: internalErrorPolicyOpen, admit: failing, want: http.StatusOK},
+		{name: "marshal error, fail", policy: internalErrorPolicyFail, admit: unmarshalable, want: http.StatusInternalServerError},
+		{name: "marshal error, open", policy: internalErrorPolicyOpen, admit: unmarshalable, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.InternalErrorPolicy = tt.policy })
+
+			h := func(w http.ResponseWriter, r *http.Request) { serveAdmission(w, r, "test", tt.admit) }
+			w := postReview(h, reviewBody(t, createRequest(t, "Pod", testPod(1))))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if response := decodeResponse(t, w); !response.Allowed || response.Patch != nil {
+				t.Errorf("response = %+v, want allowed without patch", response)
+			}
+		})
+	}
+}
+
+func TestSortPatches(t *testing.T) {
+	patches := []patchOperation{
+		{Op: "replace", Path: "/spec/containers/1/resources/requests/cpu", Value: "50m"},
+		{Op: "remove", Path: "/spec/containers/0/resources/limits"},
+		{Op: "add", Path: "/spec/tolerations/-", Value: "first"},
+		{Op: "replace", Path: "/spec/containers/0/resources/requests/cpu", Value: "50m"},
+		{Op: "add", Path: "/metadata/annotations/resource-remover.nais.io~1reduced", Value: "true"},
+		{Op: "add", Path: "/spec/tolerations/-", Value: "second"},
+		{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}},
+	}
+	want := []string{
+		"add /metadata/annotations",
+		"add /metadata/annotations/resource-remover.nais.io~1reduced",
+		"remove /spec/containers/0/resources/limits",
+		"replace /spec/containers/0/resources/requests/cpu",
+		"replace /spec/containers/1/resources/requests/cpu",
+		"add /spec/tolerations/- first",
+		"add /spec/tolerations/- second",
+	}
+	sortPatches(patches)
+	var got []string
+	for _, p := range patches {
+		op := p.Op + " " + p.Path
+		if value, ok := p.Value.(string); ok && strings.HasSuffix(p.Path, "/-") {
+			op += " " + value
+		}
+		got = append(got, op)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("sorted patches =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestServeAdmissionStablePatchOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		stable     bool
+		wantSorted bool
+	}{
+		{name: "loop order", stable: false},
+		{name: "stable order", stable: true, wantSorted: true},
+	}
+	var results []string
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.StablePatchOrder = tt.stable })
+
+			req := createRequest(t, "Pod", testPod(2))
+			response := decodeResponse(t, postReview(handleMutate, reviewBody(t, req)))
+			var patches []patchOperation
+			if err := json.Unmarshal(response.Patch, &patches); err != nil {
+				t.Fatal(err)
+			}
+			sorted := slices.IsSortedFunc(patches, func(a, b patchOperation) int { return strings.Compare(a.Path, b.Path) })
+			if sorted != tt.wantSorted {
+				t.Errorf("patches sorted = %t, want %t", sorted, tt.wantSorted)
+			}
+			patched, err := applyPatches(req.Object.Raw, patches)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, string(patched))
+		})
+	}
+	if len(results) == 2 && results[0] != results[1] {
+		t.Errorf("sorting changed the patched pod:\n%s\n%s", results[0], results[1])
+	}
+}
+
+func TestPathsOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"/spec/replicas", "/spec/replicas", true},
+		{"/spec/containers/0/resources", "/spec/containers/0/resources/limits", true},
+		{"/spec/containers/0/resources/limits", "/spec/containers/0/resources", true},
+		{"/spec/containers/1", "/spec/containers/10", false},
+		{"/metadata/annotations", "/metadata/labels", false},
+	}
+	for _, tt := range tests {
+		if got := pathsOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("pathsOverlap(%s, %s) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestWithTests(t *testing.T) {
+	raw := []byte(`{"spec":{"replicas":3,"containers":[{"resources":{"requests":{"cpu":"500m"},"limits":{"cpu":"1"}}}]}}`)
+	tests := []struct {
+		name    string
+		patches []patchOperation
+		want    []patchOperation
+	}{
+		{
+			name: "replace and remove",
+			patches: []patchOperation{
+				{Op: "replace", Path: "/spec/containers/0/resources/requests/cpu", Value: "100m"},
+				{Op: "remove", Path: "/spec/containers/0/resources/limits"},
+			},
+			want: []patchOperation{
+				{Op: "test", Path: "/spec/containers/0/resources/requests/cpu", Value: "500m"},
+				{Op: "replace", Path: "/spec/containers/0/resources/requests/cpu", Value: "100m"},
+				{Op: "test", Path: "/spec/containers/0/resources/limits", Value: map[string]any{"cpu": "1"}},
+				{Op: "remove", Path: "/spec/containers/0/resources/limits"},
+			},
+		},
+		{
+			name:    "number kept as written",
+			patches: []patchOperation{{Op: "replace", Path: "/spec/replicas", Value: 1}},
+			want: []patchOperation{
+				{Op: "test", Path: "/spec/replicas", Value: json.Number("3")},
+				{Op: "replace", Path: "/spec/replicas", Value: 1},
+			},
+		},
+		{
+			name:    "add untested",
+			patches: []patchOperation{{Op: "add", Path: "/spec/containers/0/resources/requests/memory", Value: "16Mi"}},
+			want:    []patchOperation{{Op: "add", Path: "/spec/containers/0/resources/requests/memory", Value: "16Mi"}},
+		},
+		{
+			name: "touched by an earlier operation",
+			patches: []patchOperation{
+				{Op: "add", Path: "/spec/containers/0/resources", Value: map[string]any{}},
+				{Op: "remove", Path: "/spec/containers/0/resources/limits"},
+			},
+			want: []patchOperation{
+				{Op: "add", Path: "/spec/containers/0/resources", Value: map[string]any{}},
+				{Op: "remove", Path: "/spec/containers/0/resources/limits"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withTests(raw, tt.patches)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withTests() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeAdmissionSafePatch(t *testing.T) {
+	withConfig(t, func(c *Config) { c.SafePatch = true })
+
+	req := createRequest(t, "Pod", testPod(1))
+	response := decodeResponse(t, postReview(handleMutate, reviewBody(t, req)))
+	var patches []patchOperation
+	if err := json.Unmarshal(response.Patch, &patches); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(patches, func(p patchOperation) bool { return p.Op == "test" }) {
+		t.Fatalf("patches = %v, want test operations", patches)
+	}
+	if _, err := applyPatches(req.Object.Raw, patches); err != nil {
+		t.Errorf("applying to the admitted pod: %v", err)
+	}
+
+	// Another webhook changing a request in the meantime fails the patch as
+	// a whole
+	modified := testPod(1)
+	modified.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("300m")
+	raw, err := json.Marshal(modified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyPatches(raw, patches); err == nil {
+		t.Error("applying to a modified pod succeeded, want the test to fail")
+	}
+}
+
+func TestServeAdmissionSlowRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		want      bool
+	}{
+		{name: "off"},
+		{name: "slower", threshold: time.Millisecond, want: true},
+		{name: "faster", threshold: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.SlowRequestThreshold = tt.threshold })
+			var buf bytes.Buffer
+			previous := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+			t.Cleanup(func() { slog.SetDefault(previous) })
+
+			slow := func(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+				time.Sleep(10 * time.Millisecond)
+				return nil, nil
+			}
+			postReview(func(w http.ResponseWriter, r *http.Request) {
+				serveAdmission(w, r, "test", slow)
+			}, reviewBody(t, createRequest(t, "Pod", testPod(1))))
+
+			var line string
+			for l := range strings.Lines(buf.String()) {
+				if strings.Contains(l, `msg="Slow admission request"`) {
+					line = l
+				}
+			}
+			if got := line != ""; got != tt.want {
+				t.Fatalf("slow request logged = %t, want %t, log:\n%s", got, tt.want, buf.String())
+			}
+			for _, attr := range []string{"level=WARN", "kind=Pod", "namespace=team", "duration="} {
+				if line != "" && !strings.Contains(line, attr) {
+					t.Errorf("slow request log %q is missing %s", line, attr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,854 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Config holds the tunable behaviour of the webhook.
+type Config struct {
+	// Handlers are the names of the admission handlers served, such as pod
+	// or hpa. Nil serves them all.
+	Handlers map[string]bool
+
+	// AdmissionTimeout bounds the time spent on a single admission request.
+	// It should stay below the timeoutSeconds of the webhook configuration
+	// (10s by default) so we get to answer before the API server gives up.
+	AdmissionTimeout time.Duration
+
+	// SlowRequestThreshold, when set, logs a warning for admission requests
+	// taking longer.
+	SlowRequestThreshold time.Duration
+
+	// FailOpen lets requests through unmodified when their object doesn't
+	// decode or they can't be processed in time, instead of returning an
+	// error to the API server.
+	FailOpen bool
+	// SafePatch precedes replace and remove operations with test operations
+	// asserting the value they change.
+	SafePatch bool
+	// StablePatchOrder sorts the patch operations of responses by path.
+	StablePatchOrder bool
+	// InternalErrorPolicy decides whether internal errors are answered with
+	// an error ("fail") or by allowing the object unmodified ("open").
+	InternalErrorPolicy string
+
+	// MaxConcurrent limits the number of admission requests processed at
+	// once. Zero means no limit.
+	MaxConcurrent int
+	// QueueTimeout is how long a request waits for a free slot when
+	// MaxConcurrent is reached, before it's shed.
+	QueueTimeout time.Duration
+
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout are the
+	// timeouts of the HTTP server, so slow clients can't tie up connections.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	// BindRetries is how many more times binding the listening port is
+	// tried, with backoff, before giving up.
+	BindRetries int
+
+	// LogLevel is the lowest level logged. Per-container details are logged
+	// at debug, a summary of every admission request at info.
+	LogLevel slog.Level
+	// LogFormat is either "json" or "text".
+	LogFormat string
+	// LogSamplePerSecond limits the records below warn logged per second.
+	// Zero means no limit.
+	LogSamplePerSecond int
+
+	// DebugDump logs the complete AdmissionReviews received and sent at
+	// debug level.
+	DebugDump bool
+
+	// ConfigReload reloads the configuration when the file in CONFIG_FILE
+	// changes.
+	ConfigReload bool
+
+	// Simulate serves /simulate over plain HTTP instead of the webhook, for
+	// trying out a configuration locally.
+	Simulate bool
+
+	// SelfTest applies the patches produced for synthetic objects at
+	// startup and refuses to start if they don't apply cleanly.
+	SelfTest bool
+
+	// HealthCheckCerts makes /healthz fail when the TLS certificate and key
+	// can't be loaded.
+	HealthCheckCerts bool
+
+	// DebugStats serves memory statistics and the goroutine count on
+	// /debug/stats.
+	DebugStats bool
+	// ExportPolicy serves a MutatingAdmissionPolicy following the
+	// configuration on /export-policy.
+	ExportPolicy bool
+
+	// MetricsNamespaceLabel adds a namespace label to the metrics.
+	MetricsNamespaceLabel bool
+	// MetricsNamespaceLimit is the number of distinct namespaces reported in
+	// the namespace label, the rest are reported as "other".
+	MetricsNamespaceLimit int
+
+	// ReductionMode is either "proportional", reducing requests to 20%, or
+	// "cap", lowering requests above CPUCap and MemoryCap to the cap.
+	ReductionMode string
+	// CPUCap is the highest CPU request left in cap mode.
+	CPUCap resource.Quantity
+	// MemoryCap is the highest memory request left in cap mode.
+	MemoryCap resource.Quantity
+
+	// ResourcePolicy decides per resource whether requests are reduced or
+	// removed and whether limits are removed.
+	ResourcePolicy resourcePolicy
+
+	// AggressiveKeepPercent is the percentage of requests kept for pods with
+	// the aggressive annotation, in proportional mode.
+	AggressiveKeepPercent int
+
+	// ReductionRamp are the percentages of requests kept at each stage of a
+	// gradual reduction of pod templates, in proportional mode. Workloads
+	// track their stage in the reduction-stage annotation. Empty means pod
+	// templates are reduced to 20% at once.
+	ReductionRamp []int64
+	// ReductionRampAdvance moves workloads on to the next stage of the ramp
+	// whenever an update of their pod template is reduced.
+	ReductionRampAdvance bool
+
+	// DefaultRequests are assigned to containers without a request for them,
+	// so the scheduler accounts for BestEffort pods.
+	DefaultRequests corev1.ResourceList
+
+	// ReduceOwnerKinds limits the pods mutated by /mutate to those whose
+	// controller is of one of these kinds, with "Pod" for pods without one.
+	// It's nil unless configured.
+	ReduceOwnerKinds map[string]bool
+
+	// Selector limits the pods reduced to those with matching labels. It's
+	// nil unless configured.
+	Selector labels.Selector
+
+	// SkipWindows leaves pods running on Windows nodes alone.
+	SkipWindows bool
+	// WindowsMinCPU is the lowest CPU request of Windows pods.
+	WindowsMinCPU resource.Quantity
+	// WindowsMinMemory is the lowest memory request of Windows pods.
+	WindowsMinMemory resource.Quantity
+
+	// LimitRangeMinCPU is the lowest CPU request left on any pod, matching the
+	// min of the LimitRanges in the cluster. Zero means no such floor.
+	LimitRangeMinCPU resource.Quantity
+	// LimitRangeMinMemory is the lowest memory request left on any pod,
+	// matching the min of the LimitRanges in the cluster. Zero means no such
+	// floor.
+	LimitRangeMinMemory resource.Quantity
+
+	// NodeCapacityPercent caps reduced CPU and memory requests at this
+	// percentage of the allocatable resources of the smallest node. Zero
+	// means no cap. NodeCacheTTL is how long the node lookup is cached.
+	NodeCapacityPercent int
+	NodeCacheTTL        time.Duration
+
+	// MinReduceCPU and MinReduceMemory are the requests below which CPU and
+	// memory requests aren't reduced at all. Zero means all are reduced.
+	MinReduceCPU    resource.Quantity
+	MinReduceMemory resource.Quantity
+
+	// FloorGuardCount is the most containers of a pod that may have requests
+	// reduced to the floors before the pod is left unreduced instead. Zero
+	// means no limit.
+	FloorGuardCount int
+
+	// MemoryRequestFloorRatio scales the memory in the min-memory annotation
+	// of pods before it's used as the floor of their memory requests.
+	MemoryRequestFloorRatio float64
+
+	// AnnotateReductionRatio records the factor CPU and memory requests were
+	// reduced by in annotations, for cost analysis.
+	AnnotateReductionRatio bool
+
+	// KeepLimits leaves limits alone instead of removing them.
+	KeepLimits bool
+	// ReduceLimits reduces the limits of reduced resources like their
+	// requests instead of removing them.
+	ReduceLimits bool
+
+	// RemoveRequests removes requests instead of reducing them, turning the
+	// reduce action of ResourcePolicy into remove. With the default policy
+	// this makes pods BestEffort.
+	RemoveRequests bool
+
+	// ValidatePodShape denies pods without containers with a clear message.
+	ValidatePodShape bool
+
+	// SafeToEvict is either "remove", removing the cluster autoscaler's
+	// safe-to-evict=false annotation from pods, or "true", setting it to true.
+	SafeToEvict string
+
+	// EvictionPolicy decides how pods blocking eviction with Karpenter's
+	// do-not-disrupt or do-not-evict annotations are treated: "ignore" leaves
+	// the annotations alone, "evictable" removes them and "respect" leaves
+	// safe-to-evict alone on such pods.
+	EvictionPolicy string
+
+	// SetResizePolicy sets the CPU resize policy of containers to
+	// NotRequired, so in-place CPU resizes don't restart them.
+	SetResizePolicy bool
+
+	// RemoveResourceClaims removes Dynamic Resource Allocation claims from
+	// pods and their containers.
+	RemoveResourceClaims bool
+
+	// MemoryRounding rounds reduced memory requests to a multiple of
+	// MemoryAlignment, 1Mi by default: "none", "down", "nearest" or "up".
+	MemoryRounding  string
+	MemoryAlignment resource.Quantity
+
+	// RemoveHugepages removes hugepages requests and limits not listed in
+	// ResourcePolicy, so pods don't need nodes with hugepages.
+	RemoveHugepages bool
+
+	// PreserveCPUMemoryRatio reduces CPU and memory requests of a container
+	// by the same factor when either would reach its floor.
+	PreserveCPUMemoryRatio bool
+
+	// HPAMode is either "disable", setting maxReplicas of HPAs to 1, or
+	// "proportional", scaling maxReplicas down to HPAMaxPercent.
+	HPAMode string
+	// HPAMaxPercent is the percentage of maxReplicas left in proportional
+	// mode.
+	HPAMaxPercent int
+	// HPAMinReplicas is the highest minReplicas left on HPAs. Lower values
+	// are kept. It must be 0 or 1, since maxReplicas can be set to 1.
+	HPAMinReplicas int32
+
+	// ShortenHPAScaleDown lowers the scale down stabilization window of HPAs
+	// in proportional mode to HPAScaleDownWindow, so they scale down sooner.
+	ShortenHPAScaleDown bool
+	// HPAScaleDownWindow is the longest scale down stabilization window left
+	// on HPAs with ShortenHPAScaleDown, in whole seconds.
+	HPAScaleDownWindow time.Duration
+
+	// StripHPAMetrics removes the metrics of HPAs being disabled.
+	StripHPAMetrics bool
+
+	// PauseScaledObjects pauses KEDA ScaledObjects being pinned to a single
+	// replica, so their triggers aren't polled.
+	PauseScaledObjects bool
+
+	// ScaleToZero lowers the minReplicaCount of KEDA ScaledObjects to 0
+	// instead of HPAMinReplicas, so idle workloads are scaled to zero.
+	ScaleToZero bool
+
+	// RolloutSkipSteps removes canary steps and enables auto promotion of
+	// Argo Rollouts so they don't stop mid-progression.
+	RolloutSkipSteps bool
+
+	// RelaxTopologySpread turns DoNotSchedule topology spread constraints
+	// into ScheduleAnyway.
+	RelaxTopologySpread bool
+
+	// RelaxAntiAffinity turns required pod anti-affinity into preferred.
+	RelaxAntiAffinity bool
+
+	// ForcePriorityClass, when set, replaces the priorityClassName of new
+	// pods so reduced pods don't preempt other workloads.
+	ForcePriorityClass string
+
+	// ForceSchedulerName, when set, replaces the schedulerName of new pods,
+	// e.g. with a bin-packing scheduler.
+	ForceSchedulerName string
+
+	// RemoveTolerations are the tolerations removed from new pods, so they
+	// stay off tainted nodes.
+	RemoveTolerations []tolerationMatch
+
+	// MaxTerminationGracePeriod, when set, caps the termination grace period
+	// of new pods so they don't hold up node drains.
+	MaxTerminationGracePeriod time.Duration
+
+	// GenericContainerPaths are the JSON pointers to container arrays reduced
+	// by /mutate-generic in objects of any kind.
+	GenericContainerPaths []string
+
+	// CreateEvents emits a Kubernetes Event for every mutated pod.
+	CreateEvents bool
+
+	// IncludeNamespaces, when set, limits mutation to the namespaces it
+	// names or matches. ExcludeNamespaces leaves the namespaces it names or
+	// matches alone. Both hold names and path.Match patterns.
+	IncludeNamespaces []string
+	ExcludeNamespaces []string
+	// AllowSystemNamespaces lets objects in the systemNamespaces be mutated,
+	// which are otherwise always left alone.
+	AllowSystemNamespaces bool
+
+	// NamespaceKillSwitch looks up the namespace of every request and leaves
+	// objects alone when it's annotated resource-remover.nais.io/disabled.
+	NamespaceKillSwitch bool
+	// NamespaceCacheTTL is how long namespace lookups are cached.
+	NamespaceCacheTTL time.Duration
+}
+
+// activeConfig is the active configuration, replaced by loadConfig at
+// startup and on reloads. Requests load it once and pass it on, so each sees
+// a single configuration throughout without holding up reloads.
+var activeConfig atomic.Pointer[Config]
+
+func init() {
+	activeConfig.Store(defaultConfig())
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		AdmissionTimeout:    9 * time.Second,
+		FailOpen:            true,
+		InternalErrorPolicy: internalErrorPolicyFail,
+		QueueTimeout:        time.Second,
+		LogFormat:           logFormatJSON,
+
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+
+		MetricsNamespaceLimit: 100,
+
+		ReductionMode:   reductionModeProportional,
+		CPUCap:          resource.MustParse("100m"),
+		MemoryCap:       resource.MustParse("128Mi"),
+		MemoryRounding:  memoryRoundingNone,
+		MemoryAlignment: resource.MustParse("1Mi"),
+		ResourcePolicy:  defaultResourcePolicy(),
+
+		AggressiveKeepPercent: 5,
+
+		WindowsMinCPU:    resource.MustParse("100m"),
+		WindowsMinMemory: resource.MustParse("256Mi"),
+
+		MemoryRequestFloorRatio: 1,
+
+		SafeToEvict:    safeToEvictRemove,
+		EvictionPolicy: evictionPolicyIgnore,
+		HPAMode:        hpaModeDisable,
+		HPAMaxPercent:  20,
+		HPAMinReplicas: 1,
+
+		HPAScaleDownWindow: 30 * time.Second,
+
+		NamespaceCacheTTL: 30 * time.Second,
+		NodeCacheTTL:      5 * time.Minute,
+	}
+}
+
+// loadConfig builds a Config from the defaults overridden by the file in
+// CONFIG_FILE, if any, and then by environment variables.
+func loadConfig() (*Config, error) {
+	c := defaultConfig()
+
+	s := &settings{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s.file = file
+	}
+
+	err := errors.Join(
+		s.nameSetVar("HANDLERS", &c.Handlers),
+		s.durationVar("ADMISSION_TIMEOUT", &c.AdmissionTimeout),
+		s.durationVar("SLOW_REQUEST_THRESHOLD", &c.SlowRequestThreshold),
+		s.boolVar("FAIL_OPEN", &c.FailOpen),
+		s.stringVar("INTERNAL_ERROR_POLICY", &c.InternalErrorPolicy),
+		s.boolVar("SAFE_PATCH", &c.SafePatch),
+		s.boolVar("STABLE_PATCH_ORDER", &c.StablePatchOrder),
+		s.intVar("MAX_CONCURRENT", &c.MaxConcurrent),
+		s.durationVar("QUEUE_TIMEOUT", &c.QueueTimeout),
+		s.durationVar("READ_HEADER_TIMEOUT", &c.ReadHeaderTimeout),
+		s.durationVar("READ_TIMEOUT", &c.ReadTimeout),
+		s.durationVar("WRITE_TIMEOUT", &c.WriteTimeout),
+		s.durationVar("IDLE_TIMEOUT", &c.IdleTimeout),
+		s.intVar("BIND_RETRIES", &c.BindRetries),
+		s.levelVar("LOG_LEVEL", &c.LogLevel),
+		s.stringVar("LOG_FORMAT", &c.LogFormat),
+		s.intVar("LOG_SAMPLE_PER_SECOND", &c.LogSamplePerSecond),
+		s.boolVar("DEBUG_DUMP", &c.DebugDump),
+		s.boolVar("CONFIG_RELOAD", &c.ConfigReload),
+		s.boolVar("SELF_TEST", &c.SelfTest),
+		s.boolVar("SIMULATE", &c.Simulate),
+		s.boolVar("HEALTH_CHECK_CERTS", &c.HealthCheckCerts),
+		s.boolVar("DEBUG_STATS", &c.DebugStats),
+		s.boolVar("EXPORT_POLICY", &c.ExportPolicy),
+		s.boolVar("METRICS_NAMESPACE_LABEL", &c.MetricsNamespaceLabel),
+		s.intVar("METRICS_NAMESPACE_LIMIT", &c.MetricsNamespaceLimit),
+		s.stringVar("REDUCTION_MODE", &c.ReductionMode),
+		s.quantityVar("CPU_CAP", &c.CPUCap),
+		s.quantityVar("MEMORY_CAP", &c.MemoryCap),
+		s.stringVar("MEMORY_ROUNDING", &c.MemoryRounding),
+		s.quantityVar("MEMORY_ALIGNMENT", &c.MemoryAlignment),
+		s.boolVar("PRESERVE_CPU_MEMORY_RATIO", &c.PreserveCPUMemoryRatio),
+		s.resourcePolicyVar("RESOURCE_POLICY", &c.ResourcePolicy),
+		s.boolVar("REMOVE_HUGEPAGES", &c.RemoveHugepages),
+		s.intVar("AGGRESSIVE_KEEP_PERCENT", &c.AggressiveKeepPercent),
+		s.rampVar("REDUCTION_RAMP", &c.ReductionRamp),
+		s.boolVar("REDUCTION_RAMP_ADVANCE", &c.ReductionRampAdvance),
+		s.resourceListVar("ASSIGN_DEFAULT_REQUESTS", &c.DefaultRequests),
+		s.selectorVar("SELECTOR", &c.Selector),
+		s.nameSetVar("REDUCE_OWNER_KINDS", &c.ReduceOwnerKinds),
+		s.boolVar("SKIP_WINDOWS", &c.SkipWindows),
+		s.quantityVar("WINDOWS_MIN_CPU", &c.WindowsMinCPU),
+		s.quantityVar("WINDOWS_MIN_MEMORY", &c.WindowsMinMemory),
+		s.quantityVar("LIMITRANGE_MIN_CPU", &c.LimitRangeMinCPU),
+		s.quantityVar("LIMITRANGE_MIN_MEMORY", &c.LimitRangeMinMemory),
+		s.intVar("NODE_CAPACITY_PERCENT", &c.NodeCapacityPercent),
+		s.durationVar("NODE_CACHE_TTL", &c.NodeCacheTTL),
+		s.quantityVar("MIN_REDUCE_CPU", &c.MinReduceCPU),
+		s.quantityVar("MIN_REDUCE_MEMORY", &c.MinReduceMemory),
+		s.intVar("FLOOR_GUARD_COUNT", &c.FloorGuardCount),
+		s.floatVar("MEMORY_REQUEST_FLOOR_RATIO", &c.MemoryRequestFloorRatio),
+		s.boolVar("ANNOTATE_REDUCTION_RATIO", &c.AnnotateReductionRatio),
+		s.boolVar("KEEP_LIMITS", &c.KeepLimits),
+		s.boolVar("REDUCE_LIMITS", &c.ReduceLimits),
+		s.boolVar("REMOVE_REQUESTS", &c.RemoveRequests),
+		s.boolVar("VALIDATE_POD_SHAPE", &c.ValidatePodShape),
+		s.stringVar("SAFE_TO_EVICT", &c.SafeToEvict),
+		s.stringVar("EVICTION_POLICY", &c.EvictionPolicy),
+		s.boolVar("SET_RESIZE_POLICY", &c.SetResizePolicy),
+		s.boolVar("REMOVE_RESOURCE_CLAIMS", &c.RemoveResourceClaims),
+		s.stringVar("HPA_MODE", &c.HPAMode),
+		s.intVar("HPA_MAX_PERCENT", &c.HPAMaxPercent),
+		s.int32Var("HPA_MIN_REPLICAS", &c.HPAMinReplicas),
+		s.boolVar("SHORTEN_HPA_SCALE_DOWN", &c.ShortenHPAScaleDown),
+		s.durationVar("HPA_SCALE_DOWN_WINDOW", &c.HPAScaleDownWindow),
+		s.boolVar("STRIP_HPA_METRICS", &c.StripHPAMetrics),
+		s.boolVar("PAUSE_SCALED_OBJECTS", &c.PauseScaledObjects),
+		s.boolVar("SCALE_TO_ZERO", &c.ScaleToZero),
+		s.boolVar("ROLLOUT_SKIP_STEPS", &c.RolloutSkipSteps),
+		s.boolVar("RELAX_TOPOLOGY_SPREAD", &c.RelaxTopologySpread),
+		s.boolVar("RELAX_ANTI_AFFINITY", &c.RelaxAntiAffinity),
+		s.stringVar("FORCE_PRIORITY_CLASS", &c.ForcePriorityClass),
+		s.stringVar("FORCE_SCHEDULER_NAME", &c.ForceSchedulerName),
+		s.tolerationsVar("REMOVE_TOLERATIONS", &c.RemoveTolerations),
+		s.durationVar("MAX_TERMINATION_GRACE_PERIOD", &c.MaxTerminationGracePeriod),
+		s.containerPathsVar("GENERIC_CONTAINER_PATH", &c.GenericContainerPaths),
+		s.boolVar("CREATE_EVENTS", &c.CreateEvents),
+		s.patternsVar("INCLUDE_NAMESPACES", &c.IncludeNamespaces),
+		s.patternsVar("EXCLUDE_NAMESPACES", &c.ExcludeNamespaces),
+		s.boolVar("ALLOW_SYSTEM_NAMESPACES", &c.AllowSystemNamespaces),
+		s.boolVar("NAMESPACE_KILL_SWITCH", &c.NamespaceKillSwitch),
+		s.durationVar("NAMESPACE_CACHE_TTL", &c.NamespaceCacheTTL),
+	)
+	if err == nil {
+		err = s.checkUnused()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range c.Handlers {
+		if !slices.ContainsFunc(admissionRoutes, func(route admissionRoute) bool { return route.handler == name }) {
+			return nil, fmt.Errorf("HANDLERS must only list pod, hpa, replicas, deployment, resourcequota, generic or scaledobject, got %q", name)
+		}
+	}
+	if c.AdmissionTimeout <= 0 {
+		return nil, fmt.Errorf("ADMISSION_TIMEOUT must be positive, got %s", c.AdmissionTimeout)
+	}
+	if c.SlowRequestThreshold < 0 {
+		return nil, fmt.Errorf("SLOW_REQUEST_THRESHOLD must not be negative, got %s", c.SlowRequestThreshold)
+	}
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"READ_HEADER_TIMEOUT", c.ReadHeaderTimeout},
+		{"READ_TIMEOUT", c.ReadTimeout},
+		{"WRITE_TIMEOUT", c.WriteTimeout},
+		{"IDLE_TIMEOUT", c.IdleTimeout},
+	} {
+		if timeout.value <= 0 {
+			return nil, fmt.Errorf("%s must be positive, got %s", timeout.name, timeout.value)
+		}
+	}
+	if c.WriteTimeout <= c.AdmissionTimeout {
+		return nil, fmt.Errorf("WRITE_TIMEOUT must be longer than ADMISSION_TIMEOUT (%s), got %s", c.AdmissionTimeout, c.WriteTimeout)
+	}
+
+	switch c.LogFormat {
+	case logFormatJSON, logFormatText:
+	default:
+		return nil, fmt.Errorf("LOG_FORMAT must be json or text, got %q", c.LogFormat)
+	}
+	if c.LogSamplePerSecond < 0 {
+		return nil, fmt.Errorf("LOG_SAMPLE_PER_SECOND must not be negative, got %d", c.LogSamplePerSecond)
+	}
+
+	if c.BindRetries < 0 {
+		return nil, fmt.Errorf("BIND_RETRIES must not be negative, got %d", c.BindRetries)
+	}
+	if c.MaxConcurrent < 0 {
+		return nil, fmt.Errorf("MAX_CONCURRENT must not be negative, got %d", c.MaxConcurrent)
+	}
+	if c.MaxTerminationGracePeriod < 0 || c.MaxTerminationGracePeriod%time.Second != 0 {
+		return nil, fmt.Errorf("MAX_TERMINATION_GRACE_PERIOD must be a non-negative number of whole seconds, got %s", c.MaxTerminationGracePeriod)
+	}
+	if c.NodeCapacityPercent < 0 || c.NodeCapacityPercent > 100 {
+		return nil, fmt.Errorf("NODE_CAPACITY_PERCENT must be between 0 and 100, got %d", c.NodeCapacityPercent)
+	}
+	if c.FloorGuardCount < 0 {
+		return nil, fmt.Errorf("FLOOR_GUARD_COUNT must not be negative, got %d", c.FloorGuardCount)
+	}
+	if c.MemoryRequestFloorRatio <= 0 {
+		return nil, fmt.Errorf("MEMORY_REQUEST_FLOOR_RATIO must be positive, got %g", c.MemoryRequestFloorRatio)
+	}
+	switch c.InternalErrorPolicy {
+	case internalErrorPolicyFail, internalErrorPolicyOpen:
+	default:
+		return nil, fmt.Errorf("INTERNAL_ERROR_POLICY must be fail or open, got %q", c.InternalErrorPolicy)
+	}
+	switch c.ReductionMode {
+	case reductionModeProportional, reductionModeCap:
+	default:
+		return nil, fmt.Errorf("REDUCTION_MODE must be proportional or cap, got %q", c.ReductionMode)
+	}
+	switch c.SafeToEvict {
+	case safeToEvictRemove, safeToEvictTrue:
+	default:
+		return nil, fmt.Errorf("SAFE_TO_EVICT must be remove or true, got %q", c.SafeToEvict)
+	}
+	switch c.EvictionPolicy {
+	case evictionPolicyIgnore, evictionPolicyEvictable, evictionPolicyRespect:
+	default:
+		return nil, fmt.Errorf("EVICTION_POLICY must be ignore, evictable or respect, got %q", c.EvictionPolicy)
+	}
+	switch c.HPAMode {
+	case hpaModeDisable, hpaModeProportional:
+	default:
+		return nil, fmt.Errorf("HPA_MODE must be disable or proportional, got %q", c.HPAMode)
+	}
+	if c.HPAMaxPercent < 1 || c.HPAMaxPercent > 100 {
+		return nil, fmt.Errorf("HPA_MAX_PERCENT must be between 1 and 100, got %d", c.HPAMaxPercent)
+	}
+	if c.HPAMinReplicas < 0 || c.HPAMinReplicas > 1 {
+		return nil, fmt.Errorf("HPA_MIN_REPLICAS must be 0 or 1, got %d", c.HPAMinReplicas)
+	}
+	// The API server accepts windows up to an hour
+	if c.HPAScaleDownWindow < 0 || c.HPAScaleDownWindow > time.Hour {
+		return nil, fmt.Errorf("HPA_SCALE_DOWN_WINDOW must be between 0s and 1h, got %s", c.HPAScaleDownWindow)
+	}
+	switch c.MemoryRounding {
+	case memoryRoundingNone, memoryRoundingDown, memoryRoundingNearest, memoryRoundingUp:
+	default:
+		return nil, fmt.Errorf("MEMORY_ROUNDING must be one of none, down, nearest or up, got %q", c.MemoryRounding)
+	}
+	if c.AggressiveKeepPercent < 1 || c.AggressiveKeepPercent > 100 {
+		return nil, fmt.Errorf("AGGRESSIVE_KEEP_PERCENT must be between 1 and 100, got %d", c.AggressiveKeepPercent)
+	}
+	if c.MemoryAlignment.Value() < 1 {
+		return nil, fmt.Errorf("MEMORY_ALIGNMENT must be at least 1 byte, got %s", c.MemoryAlignment.String())
+	}
+
+	return c, nil
+}
+
+// settings looks up configuration values by their environment variable
+// name. Values from the environment take precedence over those in the config
+// file, where settings are named in camelCase, e.g. admissionTimeout for
+// ADMISSION_TIMEOUT.
+type settings struct {
+	file map[string]string
+	used map[string]bool
+}
+
+// readConfigFile reads a YAML or JSON object of settings from path. Values
+// must be scalars, which are parsed like the environment variables.
+func readConfigFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	var raw map[string]json.RawMessage
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	file := make(map[string]string, len(raw))
+	for key, val := range raw {
+		var str string
+		switch {
+		case json.Unmarshal(val, &str) == nil:
+		case len(val) > 0 && (val[0] == '{' || val[0] == '['):
+			return nil, fmt.Errorf("config file %s: %s must be a single value", path, key)
+		default:
+			// Numbers and booleans are kept as written
+			str = string(val)
+		}
+		file[key] = str
+	}
+	return file, nil
+}
+
+// lookup returns the value of the setting name, and whether it's set.
+func (s *settings) lookup(name string) (string, bool) {
+	key := fileKey(name)
+	fileVal, inFile := s.file[key]
+	if inFile {
+		if s.used == nil {
+			s.used = map[string]bool{}
+		}
+		s.used[key] = true
+	}
+	if val := os.Getenv(name); val != "" {
+		return val, true
+	}
+	return fileVal, inFile && fileVal != ""
+}
+
+// checkUnused returns an error for settings in the config file that aren't
+// known, such as misspelled ones.
+func (s *settings) checkUnused() error {
+	var unknown []string
+	for key := range s.file {
+		if !s.used[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return fmt.Errorf("unknown settings in config file: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// fileKey returns the config file key of the environment variable name,
+// e.g. admissionTimeout for ADMISSION_TIMEOUT.
+func fileKey(name string) string {
+	var b strings.Builder
+	for i, word := range strings.Split(strings.ToLower(name), "_") {
+		if i > 0 && word != "" {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		b.WriteString(word)
+	}
+	return b.String()
+}
+
+// stringVar sets dst to the setting name. Unlike the other settings, a
+// string can be set to empty in the environment, e.g. to unset
+// FORCE_PRIORITY_CLASS from the config file.
+func (s *settings) stringVar(name string, dst *string) error {
+	val, ok := s.lookup(name)
+	if envVal, set := os.LookupEnv(name); set {
+		val, ok = envVal, true
+	}
+	if ok {
+		*dst = val
+	}
+	return nil
+}
+
+func (s *settings) resourcePolicyVar(name string, dst *resourcePolicy) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	p, err := parseResourcePolicy(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = p
+	return nil
+}
+
+func (s *settings) containerPathsVar(name string, dst *[]string) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	paths, err := parseContainerPaths(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = paths
+	return nil
+}
+
+func (s *settings) rampVar(name string, dst *[]int64) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	ramp, err := parseRamp(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = ramp
+	return nil
+}
+
+func (s *settings) resourceListVar(name string, dst *corev1.ResourceList) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	list, err := parseResourceList(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = list
+	return nil
+}
+
+func (s *settings) patternsVar(name string, dst *[]string) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	patterns, err := parsePatterns(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = patterns
+	return nil
+}
+
+func (s *settings) tolerationsVar(name string, dst *[]tolerationMatch) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	matches, err := parseTolerationMatches(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = matches
+	return nil
+}
+
+func (s *settings) nameSetVar(name string, dst *map[string]bool) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	*dst = parseNameSet(val)
+	return nil
+}
+
+func (s *settings) selectorVar(name string, dst *labels.Selector) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	selector, err := labels.Parse(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = selector
+	return nil
+}
+
+func (s *settings) quantityVar(name string, dst *resource.Quantity) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	q, err := resource.ParseQuantity(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = q
+	return nil
+}
+
+// levelVar parses a log level: debug, info, warn or error.
+func (s *settings) levelVar(name string, dst *slog.Level) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(val)); err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = l
+	return nil
+}
+
+func (s *settings) durationVar(name string, dst *time.Duration) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = d
+	return nil
+}
+
+func (s *settings) intVar(name string, dst *int) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	i, err := strconv.Atoi(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = i
+	return nil
+}
+
+func (s *settings) int32Var(name string, dst *int32) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	i, err := strconv.ParseInt(val, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = int32(i)
+	return nil
+}
+
+func (s *settings) floatVar(name string, dst *float64) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = f
+	return nil
+}
+
+func (s *settings) boolVar(name string, dst *bool) error {
+	val, ok := s.lookup(name)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q: %w", name, val, err)
+	}
+	*dst = b
+	return nil
+}
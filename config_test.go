@@ -0,0 +1,209 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileKey(t *testing.T) {
+	tests := map[string]string{
+		"ADMISSION_TIMEOUT":     "admissionTimeout",
+		"FAIL_OPEN":             "failOpen",
+		"HANDLERS":              "handlers",
+		"HPA_MIN_REPLICAS":      "hpaMinReplicas",
+		"NAMESPACE_KILL_SWITCH": "namespaceKillSwitch",
+	}
+	for name, want := range tests {
+		if got := fileKey(name); got != want {
+			t.Errorf("fileKey(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		check   func(c *Config) bool
+		wantErr bool
+	}{
+		{
+			name: "yaml",
+			file: "admissionTimeout: 5s\nfailOpen: true\nhpaMinReplicas: 0\n",
+			check: func(c *Config) bool {
+				return c.AdmissionTimeout == 5*time.Second && c.FailOpen && c.HPAMinReplicas == 0
+			},
+		},
+		{
+			name:  "json",
+			file:  `{"admissionTimeout": "5s", "failOpen": true}`,
+			check: func(c *Config) bool { return c.AdmissionTimeout == 5*time.Second && c.FailOpen },
+		},
+		{
+			name:  "environment takes precedence",
+			file:  "admissionTimeout: 5s\n",
+			env:   map[string]string{"ADMISSION_TIMEOUT": "3s"},
+			check: func(c *Config) bool { return c.AdmissionTimeout == 3*time.Second },
+		},
+		{
+			name:  "empty string in the environment unsets",
+			file:  "forcePriorityClass: low\n",
+			env:   map[string]string{"FORCE_PRIORITY_CLASS": ""},
+			check: func(c *Config) bool { return c.ForcePriorityClass == "" },
+		},
+		{name: "unknown setting", file: "admisionTimeout: 5s\n", wantErr: true},
+		{name: "nested value", file: "admissionTimeout:\n  seconds: 5\n", wantErr: true},
+		{name: "invalid value", file: "admissionTimeout: soon\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("CONFIG_FILE", path)
+			for name, val := range tt.env {
+				t.Setenv(name, val)
+			}
+
+			c, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error: %t", err, tt.wantErr)
+			}
+			if err == nil && !tt.check(c) {
+				t.Errorf("loadConfig() = %+v", c)
+			}
+		})
+	}
+}
+
+func TestLoadConfigServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "set", env: map[string]string{"READ_HEADER_TIMEOUT": "1s", "IDLE_TIMEOUT": "30s"}},
+		{name: "zero", env: map[string]string{"READ_TIMEOUT": "0s"}, wantErr: true},
+		{name: "negative", env: map[string]string{"IDLE_TIMEOUT": "-1s"}, wantErr: true},
+		{name: "write not above admission timeout", env: map[string]string{"WRITE_TIMEOUT": "5s", "ADMISSION_TIMEOUT": "5s"}, wantErr: true},
+		{name: "slow request threshold", env: map[string]string{"SLOW_REQUEST_THRESHOLD": "500ms"}},
+		{name: "negative slow request threshold", env: map[string]string{"SLOW_REQUEST_THRESHOLD": "-1s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, val := range tt.env {
+				t.Setenv(name, val)
+			}
+			_, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfig() error = %v, want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSelector(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    string
+		wantErr bool
+	}{
+		{val: "tier=batch", want: "tier=batch"},
+		{val: "tier in (batch,job),!critical", want: "!critical,tier in (batch,job)"},
+		{val: "=batch", wantErr: true},
+		{val: "tier in batch", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("SELECTOR", tt.val)
+		c, err := loadConfig()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("loadConfig() with SELECTOR=%q error = %v, want error: %t", tt.val, err, tt.wantErr)
+			continue
+		}
+		if err == nil && c.Selector.String() != tt.want {
+			t.Errorf("loadConfig() with SELECTOR=%q selector = %s, want %s", tt.val, c.Selector, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigMemoryAlignment(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    int64
+		wantErr bool
+	}{
+		{val: "4Ki", want: 4096},
+		{val: "2Mi", want: 2 * 1024 * 1024},
+		{val: "1", want: 1},
+		{val: "0", wantErr: true},
+		{val: "-1Mi", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("MEMORY_ALIGNMENT", tt.val)
+		c, err := loadConfig()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("loadConfig() with MEMORY_ALIGNMENT=%q error = %v, want error: %t", tt.val, err, tt.wantErr)
+			continue
+		}
+		if err == nil && c.MemoryAlignment.Value() != tt.want {
+			t.Errorf("loadConfig() with MEMORY_ALIGNMENT=%q alignment = %d, want %d", tt.val, c.MemoryAlignment.Value(), tt.want)
+		}
+	}
+}
+
+func TestLoadConfigHandlers(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    map[string]bool
+		wantErr bool
+	}{
+		{val: "pod, hpa", want: map[string]bool{"pod": true, "hpa": true}},
+		{val: "generic", want: map[string]bool{"generic": true}},
+		{val: "pod,pdb", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Setenv("HANDLERS", tt.val)
+		c, err := loadConfig()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("loadConfig() with HANDLERS=%q error = %v, want error: %t", tt.val, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !maps.Equal(c.Handlers, tt.want) {
+			t.Errorf("loadConfig() with HANDLERS=%q handlers = %v, want %v", tt.val, c.Handlers, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigHPAReplicas(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{name: "min replicas 0", env: map[string]string{"HPA_MIN_REPLICAS": "0"}},
+		// maxReplicas can be set to 1, so a higher minimum could end up above it
+		{name: "min replicas 2", env: map[string]string{"HPA_MIN_REPLICAS": "2"}, wantErr: true},
+		{name: "negative min replicas", env: map[string]string{"HPA_MIN_REPLICAS": "-1"}, wantErr: true},
+		{name: "max percent 1", env: map[string]string{"HPA_MAX_PERCENT": "1"}},
+		{name: "max percent 0", env: map[string]string{"HPA_MAX_PERCENT": "0"}, wantErr: true},
+		{name: "max percent 101", env: map[string]string{"HPA_MAX_PERCENT": "101"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, val := range tt.env {
+				t.Setenv(name, val)
+			}
+			_, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadConfig() error = %v, want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
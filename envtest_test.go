@@ -0,0 +1,235 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+// startEnvironment starts a kube-apiserver with the given webhooks registered
+// and serves them with mux, returning a client for the API server. The
+// webhooks fail closed, so a patch the API server can't apply fails the
+// request instead of being ignored.
+func startEnvironment(t *testing.T, mux *http.ServeMux, webhooks ...admissionregistrationv1.MutatingWebhook) kubernetes.Interface {
+	t.Helper()
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS is not set, run make test-integration")
+	}
+
+	failurePolicy := admissionregistrationv1.Fail
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	for i := range webhooks {
+		webhooks[i].AdmissionReviewVersions = []string{"v1"}
+		webhooks[i].FailurePolicy = &failurePolicy
+		webhooks[i].SideEffects = &sideEffects
+	}
+	env := &envtest.Environment{
+		WebhookInstallOptions: envtest.WebhookInstallOptions{
+			MutatingWebhooks: []*admissionregistrationv1.MutatingWebhookConfiguration{{
+				ObjectMeta: metav1.ObjectMeta{Name: "resource-remover"},
+				Webhooks:   webhooks,
+			}},
+		},
+	}
+	restConfig, err := env.Start()
+	if err != nil {
+		t.Fatalf("starting test environment: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := env.Stop(); err != nil {
+			t.Errorf("stopping test environment: %v", err)
+		}
+	})
+
+	options := env.WebhookInstallOptions
+	server := &http.Server{
+		Addr:    net.JoinHostPort(options.LocalServingHost, strconv.Itoa(options.LocalServingPort)),
+		Handler: mux,
+	}
+	go func() {
+		err := server.ListenAndServeTLS(filepath.Join(options.LocalServingCertDir, "tls.crt"), filepath.Join(options.LocalServingCertDir, "tls.key"))
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("serving webhooks: %v", err)
+		}
+	}()
+	t.Cleanup(func() { server.Close() })
+
+	return kubernetes.NewForConfigOrDie(restConfig)
+}
+
+// webhook returns a webhook for resources in group/version, served at path.
+func webhook(name, path, group, version, resource string) admissionregistrationv1.MutatingWebhook {
+	// envtest replaces the service with a URL to the local server, joining
+	// the path with a slash of its own
+	path = path[1:]
+	return admissionregistrationv1.MutatingWebhook{
+		Name: name + ".resource-remover.nais.io",
+		ClientConfig: admissionregistrationv1.WebhookClientConfig{
+			Service: &admissionregistrationv1.ServiceReference{Name: "resource-remover", Namespace: "default", Path: &path},
+		},
+		Rules: []admissionregistrationv1.RuleWithOperations{{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{group},
+				APIVersions: []string{version},
+				Resources:   []string{resource},
+			},
+		}},
+	}
+}
+
+func testContainer(name string) corev1.Container {
+	return corev1.Container{
+		Name:  name,
+		Image: "example.com/" + name,
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("500m"),
+				corev1.ResourceMemory: resource.MustParse("512Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("1"),
+				corev1.ResourceMemory: resource.MustParse("1Gi"),
+			},
+		},
+	}
+}
+
+// assertReduced fails unless every container had its requests reduced to
+// 20% and its limits removed.
+func assertReduced(t *testing.T, containers []corev1.Container) {
+	t.Helper()
+	for _, c := range containers {
+		if cpu := c.Resources.Requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse("100m")) != 0 {
+			t.Errorf("container %s: cpu request = %s, want 100m", c.Name, cpu.String())
+		}
+		if memory := c.Resources.Requests[corev1.ResourceMemory]; memory.Value() > 512*1024*1024/5 {
+			t.Errorf("container %s: memory request = %s, want at most 20%% of 512Mi", c.Name, memory.String())
+		}
+		if len(c.Resources.Limits) > 0 {
+			t.Errorf("container %s: limits = %v, want none", c.Name, c.Resources.Limits)
+		}
+	}
+}
+
+func TestIntegrationMutatePod(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /mutate", requireJSON(handleMutate))
+	client := startEnvironment(t, mux, webhook("pods", "/mutate", "", "v1", "pods"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "app",
+			Annotations: map[string]string{
+				"cluster-autoscaler.kubernetes.io/safe-to-evict": "false",
+			},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{testContainer("init")},
+			Containers:     []corev1.Container{testContainer("app"), testContainer("sidecar")},
+		},
+	}
+	created, err := client.CoreV1().Pods("default").Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("creating pod: %v", err)
+	}
+
+	assertReduced(t, created.Spec.InitContainers)
+	assertReduced(t, created.Spec.Containers)
+	if _, ok := created.Annotations["cluster-autoscaler.kubernetes.io/safe-to-evict"]; ok {
+		t.Errorf("safe-to-evict annotation was not removed: %v", created.Annotations)
+	}
+}
+
+func TestIntegrationMutateDeployment(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /mutate-deployment", requireJSON(handleMutateDeployment))
+	client := startEnvironment(t, mux, webhook("deployments", "/mutate-deployment", "apps", "v1", "deployments"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	labels := map[string]string{"app": "app"}
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{testContainer("init")},
+					Containers:     []corev1.Container{testContainer("app")},
+				},
+			},
+		},
+	}
+	created, err := client.AppsV1().Deployments("default").Create(ctx, deployment, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("creating deployment: %v", err)
+	}
+
+	template := created.Spec.Template
+	assertReduced(t, template.Spec.InitContainers)
+	assertReduced(t, template.Spec.Containers)
+	if _, ok := template.Annotations[reducedAnnotation]; !ok {
+		t.Errorf("template annotations = %v, want %s", template.Annotations, reducedAnnotation)
+	}
+}
+
+func TestIntegrationMutateCronJob(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.GenericContainerPaths = []string{"/spec/jobTemplate/spec/template/spec/containers", "/spec/jobTemplate/spec/template/spec/initContainers"}
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /mutate-generic", requireJSON(handleMutateGeneric))
+	client := startEnvironment(t, mux, webhook("cronjobs", "/mutate-generic", "batch", "v1", "cronjobs"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "report"},
+		Spec: batchv1.CronJobSpec{
+			Schedule: "0 6 * * *",
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							RestartPolicy:  corev1.RestartPolicyOnFailure,
+							InitContainers: []corev1.Container{testContainer("init")},
+							Containers:     []corev1.Container{testContainer("report")},
+						},
+					},
+				},
+			},
+		},
+	}
+	created, err := client.BatchV1().CronJobs("default").Create(ctx, cronJob, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("creating cronjob: %v", err)
+	}
+
+	template := created.Spec.JobTemplate.Spec.Template
+	assertReduced(t, template.Spec.InitContainers)
+	assertReduced(t, template.Spec.Containers)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventRecorder emits Kubernetes Events for mutated objects. It stays nil
+// unless CREATE_EVENTS is enabled.
+var eventRecorder record.EventRecorder
+
+// newEventRecorder returns a recorder that writes Events through client.
+// Events are sent asynchronously; if the API server rejects them (e.g. due to
+// missing RBAC) the failure is logged and the webhook carries on.
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "resource-remover"})
+}
+
+// recordPodEvent emits a Normal event for pod if events are enabled. Pods
+// admitted on CREATE may only have a generateName, which is used instead.
+func recordPodEvent(pod *corev1.Pod, reason, messageFmt string, args ...any) {
+	if eventRecorder == nil {
+		return
+	}
+	name := pod.Name
+	if name == "" {
+		name = pod.GenerateName
+	}
+	ref := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Namespace:  pod.Namespace,
+		Name:       name,
+		UID:        pod.UID,
+	}
+	eventRecorder.Eventf(ref, corev1.EventTypeNormal, reason, messageFmt, args...)
+}
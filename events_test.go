@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestMutatePodEvents(t *testing.T) {
+	unchanged := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}}
+	tests := []struct {
+		name   string
+		pod    *corev1.Pod
+		dryRun bool
+		want   int
+	}{
+		{name: "mutated", pod: testPod(1), want: 1},
+		{name: "dry run", pod: testPod(1), dryRun: true, want: 0},
+		{name: "unchanged", pod: unchanged, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			eventRecorder = recorder
+			t.Cleanup(func() { eventRecorder = nil })
+
+			req := createRequest(t, "Pod", tt.pod)
+			req.DryRun = &tt.dryRun
+			var result corev1.Pod
+			admitInto(t, mutatePod, req, &result)
+
+			if len(recorder.Events) != tt.want {
+				t.Fatalf("got %d events, want %d", len(recorder.Events), tt.want)
+			}
+			if tt.want > 0 {
+				if event := <-recorder.Events; event != "Normal ResourcesReduced resource-remover applied 9 patch operations to reduce resources" {
+					t.Errorf("event = %q", event)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// exportPolicyName names the exported MutatingAdmissionPolicy and its binding.
+const exportPolicyName = "resource-remover"
+
+// handleExportPolicy serves a MutatingAdmissionPolicy and binding reducing
+// pod requests like the active configuration does, to ease migrating off the
+// webhook.
+func handleExportPolicy(w http.ResponseWriter, r *http.Request) {
+	out, err := exportPolicy(activeConfig.Load())
+	if err != nil {
+		slog.Error("Failed to export policy", "error", err)
+		http.Error(w, "failed to export policy", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	if _, err := w.Write(out); err != nil {
+		slog.Error("Failed to write exported policy", "error", err)
+	}
+}
+
+// exportPolicy returns the YAML of a MutatingAdmissionPolicy and binding
+// reducing CPU and memory requests of pods with CEL. Only the request
+// reductions are covered: CEL apply configurations can't remove fields, so
+// limits are kept, and other resources, Windows floors, replicas and HPAs are
+// left to the webhook.
+func exportPolicy(cfg *Config) ([]byte, error) {
+	floors := podFloors(cfg, &corev1.PodSpec{})
+	var mutations []admissionregistrationv1beta1.Mutation
+	for _, field := range []string{"containers", "initContainers"} {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			if cfg.RemoveRequests || requestAction(cfg, cfg.resourceAction(name)) != policyReduce {
+				continue
+			}
+			mutations = append(mutations, admissionregistrationv1beta1.Mutation{
+				PatchType: admissionregistrationv1beta1.PatchTypeApplyConfiguration,
+				ApplyConfiguration: &admissionregistrationv1beta1.ApplyConfiguration{
+					Expression: requestMutation(cfg, field, name, floors),
+				},
+			})
+		}
+	}
+
+	matchConditions := []admissionregistrationv1beta1.MatchCondition{{
+		Name:       "skip-annotation",
+		Expression: fmt.Sprintf(`!has(object.metadata.annotations) || !(%q in object.metadata.annotations) || !object.metadata.annotations[%q].split(",").exists(v, v.trim() in ["true", %q, %q])`, skipAnnotation, skipAnnotation, skipAll, skipResources),
+	}}
+	if cfg.NamespaceKillSwitch {
+		matchConditions = append(matchConditions, admissionregistrationv1beta1.MatchCondition{
+			Name:       "namespace-disabled",
+			Expression: fmt.Sprintf(`!has(namespaceObject.metadata.annotations) || !(%q in namespaceObject.metadata.annotations) || namespaceObject.metadata.annotations[%q] != "true"`, disabledAnnotation, disabledAnnotation),
+		})
+	}
+
+	namespaceSelector := &metav1.LabelSelector{}
+	if !cfg.AllowSystemNamespaces {
+		namespaceSelector.MatchExpressions = []metav1.LabelSelectorRequirement{{
+			Key:      "kubernetes.io/metadata.name",
+			Operator: metav1.LabelSelectorOpNotIn,
+			Values:   systemNamespaces,
+		}}
+	}
+
+	// The selector matches pod labels like an object selector would
+	var objectSelector *metav1.LabelSelector
+	if cfg.Selector != nil {
+		selector, err := metav1.ParseToLabelSelector(cfg.Selector.String())
+		if err != nil {
+			return nil, err
+		}
+		objectSelector = selector
+	}
+
+	failurePolicy := admissionregistrationv1beta1.Ignore
+	policy := admissionregistrationv1beta1.MutatingAdmissionPolicy{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1beta1.SchemeGroupVersion.String(),
+			Kind:       "MutatingAdmissionPolicy",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: exportPolicyName},
+		Spec: admissionregistrationv1beta1.MutatingAdmissionPolicySpec{
+			MatchConstraints: &admissionregistrationv1beta1.MatchResources{
+				NamespaceSelector: namespaceSelector,
+				ObjectSelector:    objectSelector,
+				ResourceRules: []admissionregistrationv1beta1.NamedRuleWithOperations{{
+					RuleWithOperations: admissionregistrationv1beta1.RuleWithOperations{
+						Operations: []admissionregistrationv1beta1.OperationType{admissionregistrationv1beta1.Create},
+						Rule: admissionregistrationv1beta1.Rule{
+							APIGroups:   []string{""},
+							APIVersions: []string{"v1"},
+							Resources:   []string{"pods"},
+						},
+					},
+				}},
+			},
+			MatchConditions: matchConditions,
+			Variables: []admissionregistrationv1beta1.Variable{
+				{
+					Name:       "skipContainers",
+					Expression: fmt.Sprintf(`has(object.metadata.annotations) && %q in object.metadata.annotations ? object.metadata.annotations[%q].split(",").map(n, n.trim()) : []`, skipContainersAnnotation, skipContainersAnnotation),
+				},
+				{
+					Name:       "onlyContainers",
+					Expression: fmt.Sprintf(`has(object.metadata.annotations) && %q in object.metadata.annotations ? object.metadata.annotations[%q].split(",").map(n, n.trim()).filter(n, n != "") : []`, onlyContainersAnnotation, onlyContainersAnnotation),
+				},
+				{
+					Name:       "skipImagePattern",
+					Expression: fmt.Sprintf(`has(object.metadata.annotations) && %q in object.metadata.annotations ? object.metadata.annotations[%q] : ""`, skipImagePatternAnnotation, skipImagePatternAnnotation),
+				},
+			},
+			Mutations:          mutations,
+			FailurePolicy:      &failurePolicy,
+			ReinvocationPolicy: admissionregistrationv1beta1.IfNeededReinvocationPolicy,
+		},
+	}
+	binding := admissionregistrationv1beta1.MutatingAdmissionPolicyBinding{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1beta1.SchemeGroupVersion.String(),
+			Kind:       "MutatingAdmissionPolicyBinding",
+		},
+		ObjectMeta: metav1.ObjectMeta{Name: exportPolicyName},
+		Spec: admissionregistrationv1beta1.MutatingAdmissionPolicyBindingSpec{
+			PolicyName: exportPolicyName,
+		},
+	}
+
+	var out []byte
+	for i, obj := range []any{policy, binding} {
+		doc, err := yaml.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			out = append(out, "---\n"...)
+		}
+		out = append(out, doc...)
+	}
+	return out, nil
+}
+
+// requestMutation returns the CEL apply configuration reducing the request of
+// resource name in the containers at field of the pod spec. Like
+// reduceQuantity, requests at or below the reduced value are left alone.
+func requestMutation(cfg *Config, field string, name corev1.ResourceName, floors resourceFloors) string {
+	request := fmt.Sprintf("c.resources.requests[%q]", name)
+	quantity := "quantity(" + request + ")"
+
+	// threshold is the request at or below which nothing changes, value the
+	// CEL expression of the new request.
+	var threshold, value string
+	switch name {
+	case corev1.ResourceCPU:
+		if cfg.ReductionMode == reductionModeCap {
+			capMillis := max(cfg.CPUCap.MilliValue(), floors.cpuMillis)
+			threshold = resource.NewMilliQuantity(capMillis, resource.DecimalSI).String()
+			value = fmt.Sprintf("%q", threshold)
+		} else {
+			threshold = resource.NewMilliQuantity(floors.cpuMillis, resource.DecimalSI).String()
+			millis := fmt.Sprintf("int(%s.asApproximateFloat() * 1000.0) / %d", quantity, reductionFactor)
+			value = fmt.Sprintf(`string(%[1]s > %[2]d ? %[1]s : %[2]d) + "m"`, millis, floors.cpuMillis)
+		}
+	case corev1.ResourceMemory:
+		if cfg.ReductionMode == reductionModeCap {
+			capBytes := max(cfg.MemoryCap.Value(), floors.memoryBytes)
+			threshold = resource.NewQuantity(capBytes, resource.BinarySI).String()
+			value = fmt.Sprintf("%q", threshold)
+		} else {
+			threshold = resource.NewQuantity(floors.memoryBytes, resource.BinarySI).String()
+			bytes := roundMemoryExpression(fmt.Sprintf("%s.asInteger() / %d", quantity, reductionFactor), cfg.MemoryRounding, cfg.MemoryAlignment.Value())
+			value = fmt.Sprintf(`string(%[1]s > %[2]d ? %[1]s : %[2]d)`, bytes, floors.memoryBytes)
+		}
+	}
+
+	conditions := []string{
+		"has(c.resources)",
+		"has(c.resources.requests)",
+		fmt.Sprintf("%q in c.resources.requests", name),
+		"(size(variables.onlyContainers) > 0 ? c.name in variables.onlyContainers : !(c.name in variables.skipContainers))",
+		`(variables.skipImagePattern == "" || !c.image.matches(variables.skipImagePattern))`,
+		fmt.Sprintf("%s.isGreaterThan(quantity(%q))", quantity, threshold),
+	}
+	if minReduce, ok := minReduceRequest(cfg, name); ok {
+		conditions = append(conditions, fmt.Sprintf("!%s.isLessThan(quantity(%q))", quantity, minReduce.String()))
+	}
+
+	return fmt.Sprintf(`has(object.spec.%[1]s) ? Object{
+  spec: Object.spec{
+    %[1]s: object.spec.%[1]s.filter(c, %[2]s).map(c, Object.spec.%[1]s{
+      name: c.name,
+      resources: Object.spec.%[1]s.resources{
+        requests: {%[3]q: %[4]s}
+      }
+    })
+  }
+} : Object{}`, field, strings.Join(conditions, " && "), name, value)
+}
+
+// roundMemoryExpression returns the CEL expression rounding the bytes of expr
+// to a multiple of alignment, like roundMemory.
+func roundMemoryExpression(expr, mode string, alignment int64) string {
+	switch mode {
+	case memoryRoundingDown:
+		return fmt.Sprintf("(%s) / %d * %d", expr, alignment, alignment)
+	case memoryRoundingNearest:
+		return fmt.Sprintf("(%s + %d) / %d * %d", expr, alignment/2, alignment, alignment)
+	case memoryRoundingUp:
+		return fmt.Sprintf("(%s + %d) / %d * %d", expr, alignment-1, alignment, alignment)
+	default:
+		return expr
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionregistrationv1beta1 "k8s.io/api/admissionregistration/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func TestExportPolicy(t *testing.T) {
+	tests := []struct {
+		name               string
+		set                func(c *Config)
+		wantMutations      int
+		wantConditions     int
+		wantNamespaceRules int
+	}{
+		{
+			name:               "defaults",
+			set:                func(c *Config) {},
+			wantMutations:      4,
+			wantConditions:     1,
+			wantNamespaceRules: 1,
+		},
+		{
+			name:               "cpu only",
+			set:                func(c *Config) { c.ResourcePolicy = resourcePolicy{{name: corev1.ResourceCPU, action: policyReduce}} },
+			wantMutations:      2,
+			wantConditions:     1,
+			wantNamespaceRules: 1,
+		},
+		{
+			name:               "removing requests",
+			set:                func(c *Config) { c.RemoveRequests = true },
+			wantConditions:     1,
+			wantNamespaceRules: 1,
+		},
+		{
+			name: "kill switch and system namespaces",
+			set: func(c *Config) {
+				c.NamespaceKillSwitch = true
+				c.AllowSystemNamespaces = true
+			},
+			wantMutations:  4,
+			wantConditions: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, tt.set)
+
+			out, err := exportPolicy(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs := bytes.Split(out, []byte("---\n"))
+			if len(docs) != 2 {
+				t.Fatalf("%d documents, want a policy and a binding", len(docs))
+			}
+			var policy admissionregistrationv1beta1.MutatingAdmissionPolicy
+			if err := yaml.UnmarshalStrict(docs[0], &policy); err != nil {
+				t.Fatal(err)
+			}
+			var binding admissionregistrationv1beta1.MutatingAdmissionPolicyBinding
+			if err := yaml.UnmarshalStrict(docs[1], &binding); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := len(policy.Spec.Mutations); got != tt.wantMutations {
+				t.Errorf("mutations = %d, want %d", got, tt.wantMutations)
+			}
+			if got := len(policy.Spec.MatchConditions); got != tt.wantConditions {
+				t.Errorf("match conditions = %d, want %d", got, tt.wantConditions)
+			}
+			if got := len(policy.Spec.MatchConstraints.NamespaceSelector.MatchExpressions); got != tt.wantNamespaceRules {
+				t.Errorf("namespace selector rules = %d, want %d", got, tt.wantNamespaceRules)
+			}
+			if binding.Spec.PolicyName != policy.Name {
+				t.Errorf("binding refers to policy %q, want %q", binding.Spec.PolicyName, policy.Name)
+			}
+		})
+	}
+}
+
+func TestHandleExportPolicy(t *testing.T) {
+	withConfig(t, func(c *Config) {})
+
+	w := httptest.NewRecorder()
+	handleExportPolicy(w, httptest.NewRequest(http.MethodGet, "/export-policy", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/yaml" {
+		t.Errorf("Content-Type = %q, want application/yaml", got)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func handleMutateGeneric(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, "generic", mutateGeneric)
+}
+
+// mutateGeneric reduces the resources of containers embedded in objects of
+// any kind, such as Knative Services or KEDA ScaledJobs, found at the
+// configured GenericContainerPaths. Paths not present in an object are
+// ignored, so one webhook can cover several kinds.
+func mutateGeneric(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+	var object struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(req.Object.Raw, &object); err != nil {
+		return nil, badRequestError("failed to unmarshal object")
+	}
+	var doc any
+	if err := json.Unmarshal(req.Object.Raw, &doc); err != nil {
+		return nil, badRequestError("failed to unmarshal object")
+	}
+
+	kind := req.Kind.Kind
+	meta := &object.Metadata
+
+	if skips(meta.Annotations, skipResources) {
+		skipped(ctx, skipReasonAnnotation)
+		slog.Debug("Skipping object due to skip annotation", "kind", kind, "namespace", meta.Namespace, "name", meta.Name)
+		return nil, nil
+	}
+
+	filter := newContainerFilter(meta, meta.Annotations)
+	floors := withNodeCapacity(ctx, cfg, withMinMemory(cfg, podFloors(cfg, &corev1.PodSpec{}), meta, meta.Annotations))
+	floors = withAggressive(cfg, floors, meta.Annotations)
+	var patches []patchOperation
+	for _, path := range cfg.GenericContainerPaths {
+		value, ok := lookupJSONPointer(doc, path)
+		if !ok {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("encoding containers at %s: %w", path, err)
+		}
+		var containers []containerFields
+		if err := json.Unmarshal(raw, &containers); err != nil {
+			return nil, badRequestError(fmt.Sprintf("failed to unmarshal containers at %s", path))
+		}
+		patches = append(patches, reduceContainers(cfg, meta, path, "container", toContainers(containers), filter, floors)...)
+	}
+
+	if len(patches) > 0 {
+		slog.Debug("Reduced containers of object", "kind", kind, "namespace", meta.Namespace, "name", meta.Name)
+	}
+	return patches, nil
+}
+
+// parseContainerPaths parses a comma separated list of dotted paths to
+// container arrays, e.g. "spec.template.spec.containers", into JSON pointers.
+func parseContainerPaths(val string) ([]string, error) {
+	var paths []string
+	for _, path := range strings.Split(val, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		var pointer strings.Builder
+		for _, field := range strings.Split(path, ".") {
+			if field == "" {
+				return nil, fmt.Errorf("empty field in %q", path)
+			}
+			pointer.WriteString("/" + escapeJSONPointer(field))
+		}
+		paths = append(paths, pointer.String())
+	}
+	return paths, nil
+}
+
+// lookupJSONPointer returns the value at pointer in doc, decoded from JSON,
+// and whether it's there. Object fields and array indexes are followed.
+func lookupJSONPointer(doc any, pointer string) (any, bool) {
+	for _, token := range strings.Split(pointer, "/")[1:] {
+		switch node := doc.(type) {
+		case map[string]any:
+			field := strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+			var ok bool
+			if doc, ok = node[field]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			doc = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, doc != nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseContainerPaths(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    []string
+		wantErr bool
+	}{
+		{val: "spec.template.spec.containers", want: []string{"/spec/template/spec/containers"}},
+		{
+			val:  "spec.containers, spec.jobTargetRef.template.spec.containers,",
+			want: []string{"/spec/containers", "/spec/jobTargetRef/template/spec/containers"},
+		},
+		{val: ""},
+		{val: "spec..containers", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseContainerPaths(tt.val)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseContainerPaths(%q) error = %v, want error: %t", tt.val, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseContainerPaths(%q) = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestLookupJSONPointer(t *testing.T) {
+	doc := map[string]any{
+		"spec": map[string]any{
+			"containers": []any{map[string]any{"name": "app"}},
+			"a/b":        "slash",
+			"empty":      nil,
+		},
+	}
+	tests := []struct {
+		pointer string
+		want    any
+		wantOK  bool
+	}{
+		{"/spec/containers/0/name", "app", true},
+		{"/spec/a~1b", "slash", true},
+		{"/spec/containers/1", nil, false},
+		{"/spec/containers/name", nil, false},
+		{"/spec/missing", nil, false},
+		{"/spec/empty", nil, false},
+		{"/spec/a~1b/deeper", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := lookupJSONPointer(doc, tt.pointer)
+		if ok != tt.wantOK || ok && got != tt.want {
+			t.Errorf("lookupJSONPointer(%s) = %v, %t, want %v, %t", tt.pointer, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestMutateGeneric(t *testing.T) {
+	container := map[string]any{
+		"name":  "app",
+		"image": "europe-north1-docker.pkg.dev/nais-io/nais/app:latest",
+		"resources": map[string]any{
+			"requests": map[string]any{"cpu": "500m", "memory": "512Mi"},
+			"limits":   map[string]any{"cpu": "1"},
+		},
+	}
+	service := func(annotations map[string]any) map[string]any {
+		return map[string]any{
+			"apiVersion": "serving.knative.dev/v1",
+			"kind":       "Service",
+			"metadata":   map[string]any{"name": "app", "annotations": annotations},
+			"spec": map[string]any{"template": map[string]any{"spec": map[string]any{
+				"containers": []any{container},
+			}}},
+		}
+	}
+	tests := []struct {
+		name   string
+		object map[string]any
+		// nodeCapacityPercent caps requests at a percentage of a node with
+		// a single CPU
+		nodeCapacityPercent int
+		wantCPU             string
+		wantLimited         bool
+	}{
+		{name: "reduced", object: service(nil), wantCPU: "100m"},
+		{name: "skipped", object: service(map[string]any{skipAnnotation: "true"}), wantCPU: "500m", wantLimited: true},
+		{name: "aggressive", object: service(map[string]any{aggressiveAnnotation: "true"}), wantCPU: "25m"},
+		{name: "node capacity", object: service(nil), nodeCapacityPercent: 5, wantCPU: "50m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				// The second path isn't in the object
+				c.GenericContainerPaths = []string{"/spec/template/spec/containers", "/spec/jobTemplate/spec/template/spec/containers"}
+				c.NodeCapacityPercent = tt.nodeCapacityPercent
+			})
+			nodes = newNodeCache(fake.NewClientset(testNode("small", "1", "2Gi")), time.Minute)
+			t.Cleanup(func() { nodes = nil })
+
+			var result struct {
+				Spec struct {
+					Template struct {
+						Spec corev1.PodSpec `json:"spec"`
+					} `json:"template"`
+				} `json:"spec"`
+			}
+			admitInto(t, mutateGeneric, createRequest(t, "Service", tt.object), &result)
+			got := result.Spec.Template.Spec.Containers[0].Resources
+			if cpu := got.Requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+				t.Errorf("cpu request = %s, want %s", cpu.String(), tt.wantCPU)
+			}
+			if limited := len(got.Limits) > 0; limited != tt.wantLimited {
+				t.Errorf("limits = %v, want limited: %t", got.Limits, tt.wantLimited)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// kedaPausedReplicasAnnotation pauses autoscaling of a KEDA ScaledObject,
+// scaling its target to the given replicas.
+const kedaPausedReplicasAnnotation = "autoscaling.keda.sh/paused-replicas"
+
+// kedaDefaultMaxReplicaCount is the maxReplicaCount KEDA uses when it's not
+// set.
+const kedaDefaultMaxReplicaCount = 100
+
+func handleMutateScaledObject(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, "scaledobject", mutateScaledObject)
+}
+
+// mutateScaledObject limits the replicas of a KEDA ScaledObject like
+// mutateHPA does for HPAs. KEDA manages an HPA for every ScaledObject, but
+// patching that HPA only lasts until KEDA reconciles it.
+func mutateScaledObject(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+	var scaledObject struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Spec struct {
+			MinReplicaCount  *int32 `json:"minReplicaCount"`
+			MaxReplicaCount  *int32 `json:"maxReplicaCount"`
+			IdleReplicaCount *int32 `json:"idleReplicaCount"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(req.Object.Raw, &scaledObject); err != nil {
+		return nil, badRequestError("failed to unmarshal scaledobject")
+	}
+	meta := &scaledObject.Metadata
+	spec := &scaledObject.Spec
+
+	if skips(meta.Annotations, skipHPA) {
+		skipped(ctx, skipReasonAnnotation)
+		slog.Debug("Skipping ScaledObject due to skip annotation", "namespace", meta.Namespace, "name", meta.Name)
+		return nil, nil
+	}
+
+	var patches []patchOperation
+
+	currentMax := int32(kedaDefaultMaxReplicaCount)
+	if spec.MaxReplicaCount != nil {
+		currentMax = *spec.MaxReplicaCount
+	}
+	maxReplicas := int32(1)
+	if cfg.HPAMode == hpaModeProportional {
+		var annotationPatch *patchOperation
+		maxReplicas, annotationPatch = scaleMaxReplicas(cfg, meta.Annotations, currentMax)
+		if annotationPatch != nil {
+			patches = append(patches, *annotationPatch)
+		}
+	}
+
+	// A missing minReplicaCount means 0 to KEDA, which is kept like any
+	// lower minimum
+	minReplicas := cfg.HPAMinReplicas
+	if cfg.ScaleToZero {
+		minReplicas = 0
+	}
+	if spec.MinReplicaCount != nil && *spec.MinReplicaCount > minReplicas {
+		patches = append(patches, patchOperation{
+			Op:    "replace",
+			Path:  "/spec/minReplicaCount",
+			Value: minReplicas,
+		})
+	}
+	// KEDA requires idleReplicaCount to be below minReplicaCount, and
+	// scales idle targets to zero anyway
+	if cfg.ScaleToZero && spec.IdleReplicaCount != nil {
+		patches = append(patches, patchOperation{
+			Op:   "remove",
+			Path: "/spec/idleReplicaCount",
+		})
+	}
+
+	if spec.MaxReplicaCount == nil {
+		patches = append(patches, patchOperation{
+			Op:    "add",
+			Path:  "/spec/maxReplicaCount",
+			Value: maxReplicas,
+		})
+	} else if *spec.MaxReplicaCount != maxReplicas {
+		patches = append(patches, patchOperation{
+			Op:    "replace",
+			Path:  "/spec/maxReplicaCount",
+			Value: maxReplicas,
+		})
+	}
+
+	if len(patches) > 0 {
+		slog.Debug("Limiting ScaledObject replicas", "namespace", meta.Namespace, "name", meta.Name, "minReplicaCount", minReplicas, "maxReplicaCount", maxReplicas)
+	}
+
+	// A pinned ScaledObject still polls its triggers, pause it to save the
+	// work. A pause set by the owner is left alone. Pausing would keep a
+	// replica running, so ScaledObjects scaling to zero aren't paused.
+	if cfg.PauseScaledObjects && cfg.HPAMode == hpaModeDisable && !cfg.ScaleToZero {
+		if _, ok := meta.Annotations[kedaPausedReplicasAnnotation]; !ok {
+			replicas := strconv.Itoa(int(maxReplicas))
+			patches = append(patches, addAnnotations("/metadata", meta.Annotations, patches, map[string]string{kedaPausedReplicasAnnotation: replicas})...)
+			slog.Debug("Pausing ScaledObject", "namespace", meta.Namespace, "name", meta.Name)
+		}
+	}
+
+	return patches, nil
+}
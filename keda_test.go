@@ -0,0 +1,207 @@
+package main
+
+import "testing"
+
+// scaledObject is the part of a KEDA ScaledObject mutateScaledObject
+// patches.
+type scaledObject struct {
+	Metadata struct {
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		MinReplicaCount  *int32 `json:"minReplicaCount,omitempty"`
+		MaxReplicaCount  *int32 `json:"maxReplicaCount,omitempty"`
+		IdleReplicaCount *int32 `json:"idleReplicaCount,omitempty"`
+	} `json:"spec"`
+}
+
+func TestMutateScaledObject(t *testing.T) {
+	replicas := func(n int32) *int32 { return &n }
+	tests := []struct {
+		name        string
+		set         func(c *Config)
+		annotations map[string]string
+		min, max    *int32
+		idle        *int32
+		wantMin     *int32
+		wantMax     int32
+		wantIdle    bool
+		// wantPaused is the paused-replicas annotation, if any
+		wantPaused string
+	}{
+		{name: "pinned", min: replicas(3), max: replicas(10), wantMin: replicas(1), wantMax: 1},
+		{name: "without minReplicaCount", max: replicas(10), wantMax: 1},
+		{name: "without maxReplicaCount", min: replicas(2), wantMin: replicas(1), wantMax: 1},
+		{name: "lower minimum kept", min: replicas(0), max: replicas(10), wantMin: replicas(0), wantMax: 1},
+		{
+			name:    "proportional",
+			set:     func(c *Config) { c.HPAMode = hpaModeProportional },
+			min:     replicas(3),
+			max:     replicas(10),
+			wantMin: replicas(1),
+			wantMax: 2,
+		},
+		{
+			name:    "proportional without maxReplicaCount",
+			set:     func(c *Config) { c.HPAMode = hpaModeProportional },
+			wantMax: kedaDefaultMaxReplicaCount * 20 / 100,
+		},
+		{
+			name:       "paused",
+			set:        func(c *Config) { c.PauseScaledObjects = true },
+			max:        replicas(10),
+			wantMax:    1,
+			wantPaused: "1",
+		},
+		{
+			name:        "pause left alone",
+			set:         func(c *Config) { c.PauseScaledObjects = true },
+			annotations: map[string]string{kedaPausedReplicasAnnotation: "0"},
+			max:         replicas(10),
+			wantMax:     1,
+			wantPaused:  "0",
+		},
+		{
+			name: "scale to zero",
+			set: func(c *Config) {
+				c.ScaleToZero = true
+				c.PauseScaledObjects = true
+			},
+			min:     replicas(2),
+			max:     replicas(10),
+			idle:    replicas(0),
+			wantMin: replicas(0),
+			wantMax: 1,
+		},
+		{
+			name:        "skipped",
+			annotations: map[string]string{skipAnnotation: "hpa"},
+			min:         replicas(3),
+			max:         replicas(10),
+			idle:        replicas(0),
+			wantMin:     replicas(3),
+			wantMax:     10,
+			wantIdle:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := tt.set
+			if set == nil {
+				set = func(c *Config) {}
+			}
+			withConfig(t, set)
+
+			object := scaledObject{}
+			object.Metadata.Annotations = tt.annotations
+			object.Spec.MinReplicaCount = tt.min
+			object.Spec.MaxReplicaCount = tt.max
+			object.Spec.IdleReplicaCount = tt.idle
+			var result scaledObject
+			admitInto(t, mutateScaledObject, createRequest(t, "ScaledObject", object), &result)
+
+			if got := result.Spec.MinReplicaCount; (got == nil) != (tt.wantMin == nil) || got != nil && *got != *tt.wantMin {
+				t.Errorf("minReplicaCount = %v, want %v", got, tt.wantMin)
+			}
+			if got := result.Spec.MaxReplicaCount; got == nil || *got != tt.wantMax {
+				t.Errorf("maxReplicaCount = %v, want %d", got, tt.wantMax)
+			}
+			if got := result.Spec.IdleReplicaCount != nil; got != tt.wantIdle {
+				t.Errorf("idleReplicaCount kept = %t, want %t", got, tt.wantIdle)
+			}
+			if got := result.Metadata.Annotations[kedaPausedReplicasAnnotation]; got != tt.wantPaused {
+				t.Errorf("paused replicas = %q, want %q", got, tt.wantPaused)
+			}
+		})
+	}
+}
+
+func TestMutateScaledObjectScaleToZero(t *testing.T) {
+	replicas := func(n int32) *int32 { return &n }
+	tests := []struct {
+		name     string
+		mode     string
+		min      *int32
+		idle     *int32
+		wantMin  *int32
+		wantMax  int32
+		wantIdle bool
+	}{
+		{name: "pinned minimum", mode: hpaModeDisable, min: replicas(1), wantMin: replicas(0), wantMax: 1},
+		{name: "high minimum", mode: hpaModeDisable, min: replicas(5), wantMin: replicas(0), wantMax: 1},
+		{name: "already zero", mode: hpaModeDisable, min: replicas(0), wantMin: replicas(0), wantMax: 1},
+		{name: "without minReplicaCount", mode: hpaModeDisable, wantMax: 1},
+		{name: "idle without minReplicaCount", mode: hpaModeDisable, idle: replicas(0), wantMax: 1},
+		{name: "proportional", mode: hpaModeProportional, min: replicas(3), idle: replicas(0), wantMin: replicas(0), wantMax: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ScaleToZero = true
+				c.HPAMode = tt.mode
+			})
+
+			object := scaledObject{}
+			object.Spec.MinReplicaCount = tt.min
+			object.Spec.MaxReplicaCount = replicas(10)
+			object.Spec.IdleReplicaCount = tt.idle
+			var result scaledObject
+			admitInto(t, mutateScaledObject, createRequest(t, "ScaledObject", object), &result)
+
+			if got := result.Spec.MinReplicaCount; (got == nil) != (tt.wantMin == nil) || got != nil && *got != *tt.wantMin {
+				t.Errorf("minReplicaCount = %v, want %v", got, tt.wantMin)
+			}
+			if got := result.Spec.MaxReplicaCount; got == nil || *got != tt.wantMax {
+				t.Errorf("maxReplicaCount = %v, want %d", got, tt.wantMax)
+			}
+			if got := result.Spec.IdleReplicaCount != nil; got != tt.wantIdle {
+				t.Errorf("idleReplicaCount kept = %t, want %t", got, tt.wantIdle)
+			}
+		})
+	}
+}
+
+func TestMutateScaledObjectMinNotAboveMax(t *testing.T) {
+	replicas := func(n int32) *int32 { return &n }
+	tests := []struct {
+		name string
+		set  func(c *Config)
+	}{
+		{name: "disable", set: func(c *Config) {}},
+		{name: "disable to zero", set: func(c *Config) { c.HPAMinReplicas = 0 }},
+		{name: "scale to zero", set: func(c *Config) { c.ScaleToZero = true }},
+		{name: "proportional at 1%", set: func(c *Config) {
+			c.HPAMode = hpaModeProportional
+			c.HPAMaxPercent = 1
+		}},
+		{name: "proportional at 100%", set: func(c *Config) {
+			c.HPAMode = hpaModeProportional
+			c.HPAMaxPercent = 100
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.set)
+
+			for _, minReplicas := range []*int32{nil, replicas(0), replicas(1), replicas(3), replicas(50)} {
+				// KEDA rejects a maxReplicaCount of 0, but it's still never
+				// left below the minimum
+				for _, maxReplicas := range []*int32{nil, replicas(0), replicas(1), replicas(3), replicas(50)} {
+					object := scaledObject{}
+					object.Spec.MinReplicaCount = minReplicas
+					object.Spec.MaxReplicaCount = maxReplicas
+					var result scaledObject
+					admitInto(t, mutateScaledObject, createRequest(t, "ScaledObject", object), &result)
+
+					gotMin := int32(0)
+					if result.Spec.MinReplicaCount != nil {
+						gotMin = *result.Spec.MinReplicaCount
+					}
+					if gotMax := result.Spec.MaxReplicaCount; gotMax == nil || gotMin > *gotMax || *gotMax < 1 {
+						t.Errorf("min %s, max %s: got minReplicaCount = %s, maxReplicaCount = %s", replicasString(minReplicas), replicasString(maxReplicas), replicasString(result.Spec.MinReplicaCount), replicasString(gotMax))
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log formats.
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// newLogger returns a logger writing records at level and above to stderr in
+// format. With samplePerSecond above zero, at most that many records below
+// warn are written per second, so high-volume periods don't flood the log
+// backend.
+func newLogger(format string, level slog.Level, samplePerSecond int) *slog.Logger {
+	options := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewJSONHandler(os.Stderr, options)
+	if format == logFormatText {
+		h = slog.NewTextHandler(os.Stderr, options)
+	}
+	if samplePerSecond > 0 {
+		h = &samplingHandler{Handler: h, state: &samplingState{limit: samplePerSecond}}
+	}
+	return slog.New(h)
+}
+
+// samplingHandler drops records below warn beyond a per-second limit.
+type samplingHandler struct {
+	slog.Handler
+	state *samplingState
+}
+
+type samplingState struct {
+	limit int
+
+	mu     sync.Mutex
+	window time.Time
+	count  int
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn && !h.state.allow(r.Time) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), state: h.state}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), state: h.state}
+}
+
+// allow reports whether another record fits in the second of t.
+func (s *samplingState) allow(t time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	window := t.Truncate(time.Second)
+	if !window.Equal(s.window) {
+		s.window, s.count = window, 0
+	}
+	s.count++
+	return s.count <= s.limit
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSamplingHandler(t *testing.T) {
+	second := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		level slog.Level
+		time  time.Time
+		want  bool
+	}{
+		{"first", slog.LevelInfo, second, true},
+		{"second", slog.LevelDebug, second.Add(100 * time.Millisecond), true},
+		{"over the limit", slog.LevelInfo, second.Add(200 * time.Millisecond), false},
+		{"warnings pass", slog.LevelWarn, second.Add(300 * time.Millisecond), true},
+		{"errors pass", slog.LevelError, second.Add(400 * time.Millisecond), true},
+		{"next second", slog.LevelInfo, second.Add(time.Second), true},
+	}
+
+	var buf bytes.Buffer
+	h := &samplingHandler{
+		Handler: slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		state:   &samplingState{limit: 2},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		if err := h.Handle(context.Background(), slog.NewRecord(tt.time, tt.level, tt.name, 0)); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(buf.String(), tt.name); got != tt.want {
+			t.Errorf("%s: written = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSamplingHandlerSharesLimit(t *testing.T) {
+	// Loggers derived with attributes count against the same limit
+	var buf bytes.Buffer
+	h := &samplingHandler{
+		Handler: slog.NewTextHandler(&buf, nil),
+		state:   &samplingState{limit: 1},
+	}
+	now := time.Now()
+	for _, h := range []slog.Handler{h, h.WithAttrs([]slog.Attr{slog.String("handler", "pod")})} {
+		if err := h.Handle(context.Background(), slog.NewRecord(now, slog.LevelInfo, "sampled", 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := strings.Count(buf.String(), "sampled"); n != 1 {
+		t.Errorf("%d records written, want 1: %s", n, buf.String())
+	}
+}
@@ -1,196 +1,310 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 type patchOperation struct {
 	Op    string `json:"op"`
 	Path  string `json:"path"`
 	Value any    `json:"value,omitempty"`
+
+	// reclaimed is the CPU millicores or memory bytes of requests freed by
+	// the operation, for the reclaimed metrics. It's not part of the patch.
+	reclaimed int64
+}
+
+// requireJSON rejects requests whose Content-Type is not application/json
+// (optionally with parameters such as charset) with 415 Unsupported Media Type.
+func requireJSON(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			http.Error(w, fmt.Sprintf("unsupported content type %q, expected application/json", r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// admissionRoute is an admission endpoint. handler is its name, as reported
+// in the X-Resource-Remover-Handler header.
+type admissionRoute struct {
+	handler string
+	pattern string
+	serve   http.HandlerFunc
+}
+
+// admissionRoutes are the admission endpoints served, unless disabled with
+// Handlers.
+var admissionRoutes = []admissionRoute{
+	{"pod", "POST /mutate", handleMutate},
+	{"hpa", "POST /mutate-hpa", handleMutateHPA},
+	{"replicas", "POST /mutate-replicas", handleMutateReplicas},
+	{"deployment", "POST /mutate-deployment", handleMutateDeployment},
+	{"resourcequota", "POST /mutate-resourcequota", handleMutateResourceQuota},
+	{"generic", "POST /mutate-generic", handleMutateGeneric},
+	{"scaledobject", "POST /mutate-scaledobject", handleMutateScaledObject},
+}
+
+// registerAdmissionRoutes registers the admission routes enabled by
+// Handlers on mux, each wrapped by wrap. Method-qualified patterns make the
+// mux answer anything but POST with 405 Method Not Allowed and an "Allow:
+// POST" header. Disabled routes aren't registered, so the mux answers 404
+// Not Found.
+func registerAdmissionRoutes(cfg *Config, mux *http.ServeMux, wrap func(http.HandlerFunc) http.HandlerFunc) {
+	for _, route := range admissionRoutes {
+		if cfg.Handlers != nil && !cfg.Handlers[route.handler] {
+			slog.Info("Admission route disabled", "handler", route.handler, "pattern", route.pattern)
+			continue
+		}
+		mux.HandleFunc(route.pattern, wrap(route.serve))
+	}
+}
+
+// registerUnauthenticatedRoutes registers the endpoints besides /healthz that
+// are served without client certificates and regardless of HANDLERS.
+// Prometheus and the kubelet don't present the API server's certificate, and
+// /metrics and /version reveal nothing about the admitted objects. The
+// configuration and runtime details of /export-policy and /debug/stats are
+// only served when enabled.
+func registerUnauthenticatedRoutes(cfg *Config, mux *http.ServeMux) {
+	// OpenMetrics is needed for the exemplars of the duration histogram
+	mux.Handle("GET /metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})))
+	mux.HandleFunc("GET /version", handleVersion)
+	if cfg.ExportPolicy {
+		mux.HandleFunc("GET /export-policy", handleExportPolicy)
+	}
+	if cfg.DebugStats {
+		mux.HandleFunc("GET /debug/stats", handleDebugStats)
+	}
 }
 
 func handleMutate(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
+	serveAdmission(w, r, "pod", mutatePod)
+}
+
+func mutatePod(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+	pod, err := decodePod(req.Object.Raw)
 	if err != nil {
-		http.Error(w, "failed to read body", http.StatusBadRequest)
-		return
+		return nil, badRequestError("failed to unmarshal pod")
 	}
+	return mutateDecodedPod(ctx, cfg, req, pod)
+}
 
-	var admissionReview admissionv1.AdmissionReview
-	if err := json.Unmarshal(body, &admissionReview); err != nil {
-		http.Error(w, "failed to unmarshal admission review", http.StatusBadRequest)
-		return
+// mutateDecodedPod returns the patches for pod, the decoded object of req.
+func mutateDecodedPod(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest, pod *corev1.Pod) ([]patchOperation, error) {
+	// Skip workloads with the skip annotation
+	if skips(pod.Annotations, skipResources) {
+		skipped(ctx, skipReasonAnnotation)
+		slog.Debug("Skipping pod due to skip annotation", "namespace", pod.Namespace, "name", pod.Name)
+		return nil, nil
 	}
 
-	var pod corev1.Pod
-	if err := json.Unmarshal(admissionReview.Request.Object.Raw, &pod); err != nil {
-		http.Error(w, "failed to unmarshal pod", http.StatusBadRequest)
-		return
+	if cfg.SkipWindows && isWindows(&pod.Spec) {
+		skipped(ctx, skipReasonWindows)
+		slog.Debug("Skipping Windows pod", "namespace", pod.Namespace, "name", pod.Name)
+		return nil, nil
 	}
 
-	// Skip workloads with the skip annotation
-	if pod.Annotations != nil {
-		if val, ok := pod.Annotations["resource-remover.nais.io/skip"]; ok && val == "true" {
-			log.Printf("Skipping %s/%s due to skip annotation", pod.Namespace, pod.Name)
-			response := admissionv1.AdmissionReview{
-				TypeMeta: metav1.TypeMeta{
-					APIVersion: "admission.k8s.io/v1",
-					Kind:       "AdmissionReview",
-				},
-				Response: &admissionv1.AdmissionResponse{
-					UID:     admissionReview.Request.UID,
-					Allowed: true,
-				},
-			}
-			respBytes, _ := json.Marshal(response)
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(respBytes)
-			return
-		}
+	if cfg.ReduceOwnerKinds != nil && !cfg.ReduceOwnerKinds[ownerKind(pod.OwnerReferences)] {
+		skipped(ctx, skipReasonOwnerKind)
+		slog.Debug("Skipping pod due to its owner kind", "namespace", pod.Namespace, "name", pod.Name, "ownerKind", ownerKind(pod.OwnerReferences))
+		return nil, nil
+	}
+
+	if !selected(cfg, pod.Labels) {
+		skipped(ctx, skipReasonNotSelected)
+		slog.Debug("Skipping pod not matching the selector", "namespace", pod.Namespace, "name", pod.Name)
+		return nil, nil
+	}
+
+	// A pod without containers is rejected by the API server anyway, but
+	// only after the other admission plugins, with a less obvious error
+	if cfg.ValidatePodShape && len(pod.Spec.Containers) == 0 {
+		return nil, deniedError("pod has no containers, spec.containers must list at least one")
 	}
 
 	var patches []patchOperation
 
-	// Remove safe-to-evict=false annotation if present
-	if pod.Annotations != nil {
-		if val, ok := pod.Annotations["cluster-autoscaler.kubernetes.io/safe-to-evict"]; ok && val == "false" {
-			patches = append(patches, patchOperation{
-				Op:   "remove",
-				Path: "/metadata/annotations/cluster-autoscaler.kubernetes.io~1safe-to-evict",
-			})
-			log.Printf("Removing safe-to-evict=false from %s/%s", pod.Namespace, pod.Name)
-		}
+	// Remove safe-to-evict=false annotation if present, or set it to true
+	patches = append(patches, safeToEvict(cfg, pod)...)
+	if cfg.EvictionPolicy == evictionPolicyEvictable {
+		patches = append(patches, removeDoNotEvict(pod)...)
 	}
 
+	filter := newContainerFilter(&pod.ObjectMeta, pod.Annotations)
+
 	// Reduce resource requests to 1/5 (20%) and remove limits from all containers
-	for i, container := range pod.Spec.Containers {
-		if container.Resources.Requests != nil {
-			if cpu, hasCPU := container.Resources.Requests[corev1.ResourceCPU]; hasCPU {
-				reducedCPU := cpu.MilliValue() / 5
-				if reducedCPU < 1 {
-					reducedCPU = 1
-				}
-				patches = append(patches, patchOperation{
-					Op:    "replace",
-					Path:  fmt.Sprintf("/spec/containers/%d/resources/requests/cpu", i),
-					Value: fmt.Sprintf("%dm", reducedCPU),
-				})
-			}
-			if mem, hasMem := container.Resources.Requests[corev1.ResourceMemory]; hasMem {
-				reducedMem := mem.Value() / 5
-				if reducedMem < 1024*1024 {
-					reducedMem = 1024 * 1024 // minimum 1Mi
-				}
-				patches = append(patches, patchOperation{
-					Op:    "replace",
-					Path:  fmt.Sprintf("/spec/containers/%d/resources/requests/memory", i),
-					Value: fmt.Sprintf("%d", reducedMem),
-				})
-			}
-			log.Printf("Reducing requests to 20%% for %s/%s container %s", pod.Namespace, pod.Name, container.Name)
-		}
-		// Remove limits so pods aren't throttled
-		if container.Resources.Limits != nil {
-			if _, hasCPU := container.Resources.Limits[corev1.ResourceCPU]; hasCPU {
-				patches = append(patches, patchOperation{
-					Op:   "remove",
-					Path: fmt.Sprintf("/spec/containers/%d/resources/limits/cpu", i),
-				})
-			}
-			if _, hasMem := container.Resources.Limits[corev1.ResourceMemory]; hasMem {
-				patches = append(patches, patchOperation{
-					Op:   "remove",
-					Path: fmt.Sprintf("/spec/containers/%d/resources/limits/memory", i),
-				})
-			}
-			log.Printf("Removing limits from %s/%s container %s", pod.Namespace, pod.Name, container.Name)
-		}
+	// Pods from a template reduced by /mutate-deployment are already reduced
+	floors := withNodeCapacity(ctx, cfg, withMinMemory(cfg, podFloors(cfg, &pod.Spec), &pod.ObjectMeta, pod.Annotations))
+	floors = withAggressive(cfg, floors, pod.Annotations)
+	if _, ok := pod.Annotations[reducedAnnotation]; ok {
+		slog.Debug("Not reducing pod again, its template was reduced", "namespace", pod.Namespace, "name", pod.Name)
+	} else if floorGuardTripped(cfg, slices.Concat(pod.Spec.Containers, pod.Spec.InitContainers), filter, floors) {
+		slog.Info("Not reducing pod, too many of its containers would be reduced to the floor", "namespace", pod.Namespace, "name", pod.Name)
+	} else {
+		patches = append(patches, reduceContainers(cfg, &pod.ObjectMeta, "/spec/containers", "container", pod.Spec.Containers, filter, floors)...)
+		patches = append(patches, reduceContainers(cfg, &pod.ObjectMeta, "/spec/initContainers", "init container", pod.Spec.InitContainers, filter, floors)...)
+		patches = append(patches, addAnnotations("/metadata", pod.Annotations, patches, ratioAnnotations(cfg, patches, floors))...)
 	}
 
-	// Reduce resource requests to 20% and remove limits from all init containers
-	for i, container := range pod.Spec.InitContainers {
-		if container.Resources.Requests != nil {
-			if cpu, hasCPU := container.Resources.Requests[corev1.ResourceCPU]; hasCPU {
-				reducedCPU := cpu.MilliValue() / 5
-				if reducedCPU < 1 {
-					reducedCPU = 1
-				}
-				patches = append(patches, patchOperation{
-					Op:    "replace",
-					Path:  fmt.Sprintf("/spec/initContainers/%d/resources/requests/cpu", i),
-					Value: fmt.Sprintf("%dm", reducedCPU),
-				})
-			}
-			if mem, hasMem := container.Resources.Requests[corev1.ResourceMemory]; hasMem {
-				reducedMem := mem.Value() / 5
-				if reducedMem < 1024*1024 {
-					reducedMem = 1024 * 1024 // minimum 1Mi
-				}
-				patches = append(patches, patchOperation{
-					Op:    "replace",
-					Path:  fmt.Sprintf("/spec/initContainers/%d/resources/requests/memory", i),
-					Value: fmt.Sprintf("%d", reducedMem),
-				})
-			}
-			log.Printf("Reducing requests to 20%% for %s/%s init container %s", pod.Namespace, pod.Name, container.Name)
-		}
-		if container.Resources.Limits != nil {
-			if _, hasCPU := container.Resources.Limits[corev1.ResourceCPU]; hasCPU {
-				patches = append(patches, patchOperation{
-					Op:   "remove",
-					Path: fmt.Sprintf("/spec/initContainers/%d/resources/limits/cpu", i),
-				})
-			}
-			if _, hasMem := container.Resources.Limits[corev1.ResourceMemory]; hasMem {
-				patches = append(patches, patchOperation{
-					Op:   "remove",
-					Path: fmt.Sprintf("/spec/initContainers/%d/resources/limits/memory", i),
-				})
-			}
-			log.Printf("Removing limits from %s/%s init container %s", pod.Namespace, pod.Name, container.Name)
-		}
+	// Init containers can't have a resize policy, except sidecars, which are
+	// left alone for simplicity
+	if cfg.SetResizePolicy {
+		patches = append(patches, cpuResizeWithoutRestart("/spec/containers", pod.Spec.Containers, filter)...)
+	}
+
+	if cfg.RemoveResourceClaims {
+		patches = append(patches, removeResourceClaims(pod)...)
+	}
+
+	if cfg.RelaxTopologySpread {
+		patches = append(patches, relaxTopologySpread(pod)...)
+	}
+	if cfg.RelaxAntiAffinity {
+		patches = append(patches, relaxAntiAffinity(pod)...)
+	}
+	// The priority of a running pod can't be changed, so only touch new pods
+	if cfg.ForcePriorityClass != "" && req.Operation == admissionv1.Create {
+		patches = append(patches, forcePriorityClass(pod, cfg.ForcePriorityClass)...)
+	}
+	// Nor can the scheduler
+	if cfg.ForceSchedulerName != "" && req.Operation == admissionv1.Create {
+		patches = append(patches, forceSchedulerName(pod, cfg.ForceSchedulerName)...)
+	}
+	// Nor can the grace period, except by the API server on deletion
+	if cfg.MaxTerminationGracePeriod > 0 && req.Operation == admissionv1.Create {
+		patches = append(patches, capTerminationGracePeriod(pod, int64(cfg.MaxTerminationGracePeriod/time.Second))...)
+	}
+	// Tolerations can only be added to running pods
+	if len(cfg.RemoveTolerations) > 0 && req.Operation == admissionv1.Create {
+		patches = append(patches, removeTolerations(pod, cfg.RemoveTolerations)...)
 	}
 
 	patchBytes, err := json.Marshal(patches)
 	if err != nil {
-		http.Error(w, "failed to marshal patches", http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
-	log.Printf("Patch for %s/%s: %s", pod.Namespace, pod.Name, string(patchBytes))
+	slog.Debug("Patch for pod", "namespace", pod.Namespace, "name", pod.Name, "patch", string(patchBytes))
 
-	patchType := admissionv1.PatchTypeJSONPatch
-	response := admissionv1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "admission.k8s.io/v1",
-			Kind:       "AdmissionReview",
-		},
-		Response: &admissionv1.AdmissionResponse{
-			UID:       admissionReview.Request.UID,
-			Allowed:   true,
-			PatchType: &patchType,
-			Patch:     patchBytes,
-		},
+	// Dry runs only preview the patch, no pod is created
+	if len(patches) > 0 && !dryRun(req) {
+		recordPodEvent(pod, "ResourcesReduced", "resource-remover applied %d patch operations to reduce resources", len(patches))
 	}
 
-	respBytes, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
-		return
+	return patches, nil
+}
+
+// Safe-to-evict modes.
+const (
+	// safeToEvictRemove removes safe-to-evict=false.
+	safeToEvictRemove = "remove"
+	// safeToEvictTrue sets safe-to-evict=true on every pod.
+	safeToEvictTrue = "true"
+)
+
+const safeToEvictAnnotation = "cluster-autoscaler.kubernetes.io/safe-to-evict"
+
+// Eviction policies, for pods blocking eviction with doNotEvictAnnotations.
+const (
+	// evictionPolicyIgnore leaves the annotations alone.
+	evictionPolicyIgnore = "ignore"
+	// evictionPolicyEvictable removes the annotations.
+	evictionPolicyEvictable = "evictable"
+	// evictionPolicyRespect leaves safe-to-evict alone on pods with the
+	// annotations.
+	evictionPolicyRespect = "respect"
+)
+
+// doNotEvictAnnotations block Karpenter from evicting a pod when set to
+// "true". do-not-evict is the name used before Karpenter v0.32.
+var doNotEvictAnnotations = []string{"karpenter.sh/do-not-disrupt", "karpenter.sh/do-not-evict"}
+
+// doNotEvict reports whether pod blocks eviction with one of the
+// doNotEvictAnnotations.
+func doNotEvict(pod *corev1.Pod) bool {
+	return slices.ContainsFunc(doNotEvictAnnotations, func(name string) bool {
+		return pod.Annotations[name] == "true"
+	})
+}
+
+// removeDoNotEvict returns the patches removing the doNotEvictAnnotations
+// blocking eviction of pod.
+func removeDoNotEvict(pod *corev1.Pod) []patchOperation {
+	var patches []patchOperation
+	for _, name := range doNotEvictAnnotations {
+		if pod.Annotations[name] != "true" {
+			continue
+		}
+		slog.Debug("Removing "+name, "namespace", pod.Namespace, "name", pod.Name)
+		patches = append(patches, patchOperation{
+			Op:   "remove",
+			Path: "/metadata/annotations/" + escapeJSONPointer(name),
+		})
 	}
+	return patches
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(respBytes)
+// safeToEvict returns the patches letting the cluster autoscaler evict pod.
+// With the respect eviction policy, pods blocking eviction with
+// doNotEvictAnnotations are left alone.
+func safeToEvict(cfg *Config, pod *corev1.Pod) []patchOperation {
+	if cfg.EvictionPolicy == evictionPolicyRespect && doNotEvict(pod) {
+		slog.Debug("Leaving safe-to-evict alone, the pod blocks eviction", "namespace", pod.Namespace, "name", pod.Name)
+		return nil
+	}
+	val, ok := pod.Annotations[safeToEvictAnnotation]
+	path := "/metadata/annotations/" + escapeJSONPointer(safeToEvictAnnotation)
+	switch {
+	case cfg.SafeToEvict == safeToEvictTrue && val == "true":
+		return nil
+	case cfg.SafeToEvict == safeToEvictTrue && pod.Annotations == nil:
+		slog.Debug("Setting safe-to-evict=true", "namespace", pod.Namespace, "name", pod.Name)
+		return []patchOperation{{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: map[string]string{safeToEvictAnnotation: "true"},
+		}}
+	case cfg.SafeToEvict == safeToEvictTrue:
+		slog.Debug("Setting safe-to-evict=true", "namespace", pod.Namespace, "name", pod.Name)
+		// add replaces an existing value too
+		return []patchOperation{{
+			Op:    "add",
+			Path:  path,
+			Value: "true",
+		}}
+	case ok && val == "false":
+		slog.Debug("Removing safe-to-evict=false", "namespace", pod.Namespace, "name", pod.Name)
+		return []patchOperation{{
+			Op:   "remove",
+			Path: path,
+		}}
+	}
+	return nil
 }
 
 func handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -198,19 +312,25 @@ func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
-func handleMutateHPA(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "failed to read body", http.StatusBadRequest)
-		return
+// certHealth wraps a health handler to answer 503 Service Unavailable when
+// the TLS certificate or key can't be loaded, e.g. because the secret is no
+// longer mounted.
+func certHealth(certFile, keyFile string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			slog.Warn("Health check failed, TLS certificate not loadable", "error", err)
+			http.Error(w, "tls certificate not loadable", http.StatusServiceUnavailable)
+			return
+		}
+		next(w, r)
 	}
+}
 
-	var admissionReview admissionv1.AdmissionReview
-	if err := json.Unmarshal(body, &admissionReview); err != nil {
-		http.Error(w, "failed to unmarshal admission review", http.StatusBadRequest)
-		return
-	}
+func handleMutateHPA(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, "hpa", mutateHPA)
+}
 
+func mutateHPA(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
 	// Parse HPA to check for skip annotation and get minReplicas
 	var hpa struct {
 		Metadata struct {
@@ -219,200 +339,443 @@ func handleMutateHPA(w http.ResponseWriter, r *http.Request) {
 			Annotations map[string]string `json:"annotations"`
 		} `json:"metadata"`
 		Spec struct {
-			MinReplicas *int32 `json:"minReplicas"`
-			MaxReplicas int32  `json:"maxReplicas"`
+			MinReplicas *int32            `json:"minReplicas"`
+			MaxReplicas int32             `json:"maxReplicas"`
+			Metrics     []json.RawMessage `json:"metrics"`
+			Behavior    *struct {
+				ScaleDown *struct {
+					StabilizationWindowSeconds *int32 `json:"stabilizationWindowSeconds"`
+				} `json:"scaleDown"`
+			} `json:"behavior"`
 		} `json:"spec"`
 	}
-	if err := json.Unmarshal(admissionReview.Request.Object.Raw, &hpa); err != nil {
-		http.Error(w, "failed to unmarshal hpa", http.StatusBadRequest)
-		return
+	if err := json.Unmarshal(req.Object.Raw, &hpa); err != nil {
+		return nil, badRequestError("failed to unmarshal hpa")
 	}
 
 	// Check for skip annotation
-	if val, ok := hpa.Metadata.Annotations["resource-remover.nais.io/skip"]; ok && val == "true" {
-		log.Printf("Skipping HPA %s/%s due to skip annotation", hpa.Metadata.Namespace, hpa.Metadata.Name)
-		response := admissionv1.AdmissionReview{
-			TypeMeta: metav1.TypeMeta{
-				APIVersion: "admission.k8s.io/v1",
-				Kind:       "AdmissionReview",
-			},
-			Response: &admissionv1.AdmissionResponse{
-				UID:     admissionReview.Request.UID,
-				Allowed: true,
-			},
-		}
-		respBytes, _ := json.Marshal(response)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(respBytes)
-		return
+	if skips(hpa.Metadata.Annotations, skipHPA) {
+		skipped(ctx, skipReasonAnnotation)
+		slog.Debug("Skipping HPA due to skip annotation", "namespace", hpa.Metadata.Namespace, "name", hpa.Metadata.Name)
+		return nil, nil
 	}
 
-	// Set minReplicas=1 and maxReplicas=1 to disable scaling
+	// Set maxReplicas=1 to disable scaling, or scale it down in proportional
+	// mode, and lower minReplicas to the configured minimum. A lower
+	// minReplicas, e.g. 0 with scale to zero, is kept.
 	var patches []patchOperation
 
+	maxReplicas := int32(1)
+	if cfg.HPAMode == hpaModeProportional {
+		var annotationPatch *patchOperation
+		maxReplicas, annotationPatch = scaleMaxReplicas(cfg, hpa.Metadata.Annotations, hpa.Spec.MaxReplicas)
+		if annotationPatch != nil {
+			patches = append(patches, *annotationPatch)
+		}
+	}
+
+	// HPAMinReplicas is at most 1 and maxReplicas at least 1, so minReplicas
+	// never ends up above maxReplicas, which the API server would reject
+	minReplicas := cfg.HPAMinReplicas
 	if hpa.Spec.MinReplicas == nil {
 		patches = append(patches, patchOperation{
 			Op:    "add",
 			Path:  "/spec/minReplicas",
-			Value: 1,
+			Value: minReplicas,
 		})
-	} else if *hpa.Spec.MinReplicas != 1 {
+	} else if *hpa.Spec.MinReplicas > minReplicas {
 		patches = append(patches, patchOperation{
 			Op:    "replace",
 			Path:  "/spec/minReplicas",
-			Value: 1,
+			Value: minReplicas,
 		})
 	}
 
-	if hpa.Spec.MaxReplicas != 1 {
+	if hpa.Spec.MaxReplicas != maxReplicas {
 		patches = append(patches, patchOperation{
 			Op:    "replace",
 			Path:  "/spec/maxReplicas",
-			Value: 1,
+			Value: maxReplicas,
 		})
 	}
 
 	if len(patches) > 0 {
-		log.Printf("Disabling HPA %s/%s by setting min/maxReplicas=1", hpa.Metadata.Namespace, hpa.Metadata.Name)
+		slog.Debug("Limiting HPA replicas", "namespace", hpa.Metadata.Namespace, "name", hpa.Metadata.Name, "minReplicas", minReplicas, "maxReplicas", maxReplicas)
 	}
 
-	patchBytes, err := json.Marshal(patches)
-	if err != nil {
-		http.Error(w, "failed to marshal patches", http.StatusInternalServerError)
-		return
+	// A pinned HPA still evaluates its metrics, drop them to save the work
+	if cfg.StripHPAMetrics && cfg.HPAMode == hpaModeDisable && len(hpa.Spec.Metrics) > 0 {
+		patches = append(patches, patchOperation{
+			Op:   "remove",
+			Path: "/spec/metrics",
+		})
+		slog.Debug("Removing metrics from HPA", "namespace", hpa.Metadata.Namespace, "name", hpa.Metadata.Name)
+	}
+
+	// A scaled down HPA still scales, but waits out the scale down
+	// stabilization window (5 minutes by default) first. autoscaling/v1 has
+	// no behavior.
+	if cfg.ShortenHPAScaleDown && cfg.HPAMode == hpaModeProportional && req.Kind.Version != "v1" {
+		window := int32(cfg.HPAScaleDownWindow.Seconds())
+		behavior := hpa.Spec.Behavior
+		var patch *patchOperation
+		switch {
+		case behavior == nil:
+			patch = &patchOperation{Op: "add", Path: "/spec/behavior", Value: map[string]any{
+				"scaleDown": map[string]any{"stabilizationWindowSeconds": window},
+			}}
+		case behavior.ScaleDown == nil:
+			patch = &patchOperation{Op: "add", Path: "/spec/behavior/scaleDown", Value: map[string]any{
+				"stabilizationWindowSeconds": window,
+			}}
+		case behavior.ScaleDown.StabilizationWindowSeconds == nil || *behavior.ScaleDown.StabilizationWindowSeconds > window:
+			// add replaces an existing value too
+			patch = &patchOperation{Op: "add", Path: "/spec/behavior/scaleDown/stabilizationWindowSeconds", Value: window}
+		}
+		if patch != nil {
+			patches = append(patches, *patch)
+			slog.Debug("Shortening HPA scale down stabilization window", "namespace", hpa.Metadata.Namespace, "name", hpa.Metadata.Name, "seconds", window)
+		}
 	}
 
-	patchType := admissionv1.PatchTypeJSONPatch
-	response := admissionv1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "admission.k8s.io/v1",
-			Kind:       "AdmissionReview",
-		},
-		Response: &admissionv1.AdmissionResponse{
-			UID:       admissionReview.Request.UID,
-			Allowed:   true,
-			PatchType: &patchType,
-			Patch:     patchBytes,
-		},
+	return patches, nil
+}
+
+// HPA modes.
+const (
+	// hpaModeDisable pins HPAs to a single replica.
+	hpaModeDisable = "disable"
+	// hpaModeProportional scales maxReplicas down to HPAMaxPercent.
+	hpaModeProportional = "proportional"
+)
+
+// originalMaxReplicasAnnotation holds the maxReplicas of an HPA before it was
+// scaled down in proportional mode, so it isn't scaled down again on every
+// update.
+const originalMaxReplicasAnnotation = "resource-remover.nais.io/original-max-replicas"
+
+// ownerKind returns the kind of the controller in refs, or "Pod" for pods
+// without one. Deployments own their pods through ReplicaSets, which are
+// reported as Deployment, since ReplicaSets are rarely created directly and
+// the owner isn't looked up.
+func ownerKind(refs []metav1.OwnerReference) string {
+	for _, ref := range refs {
+		if ref.Controller == nil || !*ref.Controller {
+			continue
+		}
+		if ref.Kind == "ReplicaSet" {
+			return "Deployment"
+		}
+		return ref.Kind
 	}
+	return "Pod"
+}
 
-	respBytes, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
-		return
+// ownedByDeployment reports whether refs has a Deployment as controller.
+func ownedByDeployment(refs []metav1.OwnerReference) bool {
+	for _, ref := range refs {
+		if ref.Kind == "Deployment" && ref.Controller != nil && *ref.Controller {
+			return true
+		}
 	}
+	return false
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(respBytes)
+// replicasAnnotation overrides the replica count of a single workload, for
+// services that need more than one replica even outside production.
+const replicasAnnotation = "resource-remover.nais.io/replicas"
+
+// targetReplicas returns the replicas to set on a workload: 1, unless
+// overridden by the replicas annotation. An invalid override is logged and
+// ignored.
+func targetReplicas(annotations map[string]string, kind, namespace, name string) int32 {
+	val, ok := annotations[replicasAnnotation]
+	if !ok {
+		return 1
+	}
+	replicas, err := strconv.ParseInt(strings.TrimSpace(val), 10, 32)
+	if err != nil || replicas < 0 {
+		slog.Warn("Ignoring invalid replicas annotation", "kind", kind, "namespace", namespace, "name", name, "value", val)
+		return 1
+	}
+	return int32(replicas)
 }
 
-func handleMutateReplicas(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "failed to read body", http.StatusBadRequest)
-		return
+// scaleMaxReplicas returns the maxReplicas of an HPA in proportional mode,
+// HPAMaxPercent of its original maxReplicas and at least 1, along with the
+// patch recording the original, if it changed. The HPA's maxReplicas is taken
+// as the original unless it's already the scaled down value of the recorded
+// one.
+func scaleMaxReplicas(cfg *Config, annotations map[string]string, maxReplicas int32) (int32, *patchOperation) {
+	scale := func(original int32) int32 {
+		return max(int32(int64(original)*int64(cfg.HPAMaxPercent)/100), 1)
 	}
 
-	var admissionReview admissionv1.AdmissionReview
-	if err := json.Unmarshal(body, &admissionReview); err != nil {
-		http.Error(w, "failed to unmarshal admission review", http.StatusBadRequest)
-		return
+	original := maxReplicas
+	if val, ok := annotations[originalMaxReplicasAnnotation]; ok {
+		if recorded, err := strconv.ParseInt(val, 10, 32); err == nil && scale(int32(recorded)) == maxReplicas {
+			original = int32(recorded)
+		}
 	}
 
+	value := strconv.Itoa(int(original))
+	if annotations[originalMaxReplicasAnnotation] == value {
+		return scale(original), nil
+	}
+	if annotations == nil {
+		return scale(original), &patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: map[string]string{originalMaxReplicasAnnotation: value},
+		}
+	}
+	return scale(original), &patchOperation{
+		Op:    "add",
+		Path:  "/metadata/annotations/" + escapeJSONPointer(originalMaxReplicasAnnotation),
+		Value: value,
+	}
+}
+
+func handleMutateReplicas(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, "replicas", mutateReplicas)
+}
+
+func mutateReplicas(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
 	// Parse workload to check for skip annotation and get replicas
 	var workload struct {
 		Metadata struct {
-			Name        string            `json:"name"`
-			Namespace   string            `json:"namespace"`
-			Annotations map[string]string `json:"annotations"`
+			Name            string                  `json:"name"`
+			Namespace       string                  `json:"namespace"`
+			Annotations     map[string]string       `json:"annotations"`
+			OwnerReferences []metav1.OwnerReference `json:"ownerReferences"`
 		} `json:"metadata"`
 		Spec struct {
 			Replicas *int32 `json:"replicas"`
+			// Strategy of Argo Rollouts
+			Strategy struct {
+				Canary *struct {
+					Steps []json.RawMessage `json:"steps"`
+				} `json:"canary"`
+				BlueGreen *struct {
+					AutoPromotionEnabled *bool `json:"autoPromotionEnabled"`
+				} `json:"blueGreen"`
+			} `json:"strategy"`
 		} `json:"spec"`
 	}
-	if err := json.Unmarshal(admissionReview.Request.Object.Raw, &workload); err != nil {
-		http.Error(w, "failed to unmarshal workload", http.StatusBadRequest)
-		return
+	if err := json.Unmarshal(req.Object.Raw, &workload); err != nil {
+		return nil, badRequestError("failed to unmarshal workload")
 	}
 
-	kind := admissionReview.Request.Kind.Kind
+	kind := req.Kind.Kind
+
+	// Scaling through the scale subresource (e.g. kubectl scale, or an HPA
+	// scaling the workload) sends an autoscaling/v1 Scale, which has none of
+	// the annotations of the scaled workload. Patching it would override the
+	// skip and replicas annotations and pin HPAs and ScaledObjects left to
+	// scale, so the workload is only set when it's created or updated.
+	if req.SubResource == "scale" {
+		skipped(ctx, skipReasonScale)
+		slog.Debug("Not setting replicas through the scale subresource", "resource", req.Resource.Resource, "namespace", workload.Metadata.Namespace, "name", workload.Metadata.Name)
+		return nil, nil
+	}
 
 	// Check for skip annotation
-	if val, ok := workload.Metadata.Annotations["resource-remover.nais.io/skip"]; ok && val == "true" {
-		log.Printf("Skipping %s %s/%s due to skip annotation", kind, workload.Metadata.Namespace, workload.Metadata.Name)
-		response := admissionv1.AdmissionReview{
-			TypeMeta: metav1.TypeMeta{
-				APIVersion: "admission.k8s.io/v1",
-				Kind:       "AdmissionReview",
-			},
-			Response: &admissionv1.AdmissionResponse{
-				UID:     admissionReview.Request.UID,
-				Allowed: true,
-			},
-		}
-		respBytes, _ := json.Marshal(response)
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(respBytes)
-		return
+	if skips(workload.Metadata.Annotations, skipReplicas) {
+		skipped(ctx, skipReasonAnnotation)
+		slog.Debug("Skipping workload due to skip annotation", "kind", kind, "namespace", workload.Metadata.Namespace, "name", workload.Metadata.Name)
+		return nil, nil
+	}
+
+	// DaemonSets have no spec.replicas; a replicas patch would be rejected by
+	// the API server and block the DaemonSet entirely.
+	if kind == "DaemonSet" {
+		skipped(ctx, skipReasonDaemonSet)
+		slog.Debug("Not setting replicas on DaemonSet", "namespace", workload.Metadata.Namespace, "name", workload.Metadata.Name)
+		return nil, nil
+	}
+
+	// The replicas of ReplicaSets owned by a Deployment are set by the
+	// Deployment controller, which would fight a patch here. The Deployment
+	// itself is patched instead.
+	if kind == "ReplicaSet" && ownedByDeployment(workload.Metadata.OwnerReferences) {
+		skipped(ctx, skipReasonOwned)
+		slog.Debug("Not setting replicas on ReplicaSet owned by a Deployment", "namespace", workload.Metadata.Namespace, "name", workload.Metadata.Name)
+		return nil, nil
 	}
 
 	var patches []patchOperation
 
-	// Set replicas to 1
+	replicas := targetReplicas(workload.Metadata.Annotations, kind, workload.Metadata.Namespace, workload.Metadata.Name)
 	if workload.Spec.Replicas == nil {
 		patches = append(patches, patchOperation{
 			Op:    "add",
 			Path:  "/spec/replicas",
-			Value: 1,
+			Value: replicas,
 		})
-	} else if *workload.Spec.Replicas != 1 {
+	} else if *workload.Spec.Replicas != replicas {
 		patches = append(patches, patchOperation{
 			Op:    "replace",
 			Path:  "/spec/replicas",
-			Value: 1,
+			Value: replicas,
 		})
 	}
 
 	if len(patches) > 0 {
-		log.Printf("Setting %s %s/%s replicas to 1", kind, workload.Metadata.Namespace, workload.Metadata.Name)
+		slog.Debug("Setting replicas", "kind", kind, "namespace", workload.Metadata.Namespace, "name", workload.Metadata.Name, "replicas", replicas)
 	}
 
-	patchBytes, err := json.Marshal(patches)
+	// Let Argo Rollouts progress straight to the new version instead of
+	// stopping at canary steps or waiting for a blue-green promotion
+	if kind == "Rollout" && cfg.RolloutSkipSteps {
+		strategy := workload.Spec.Strategy
+		if strategy.Canary != nil && len(strategy.Canary.Steps) > 0 {
+			patches = append(patches, patchOperation{
+				Op:   "remove",
+				Path: "/spec/strategy/canary/steps",
+			})
+			slog.Debug("Removing canary steps from Rollout", "namespace", workload.Metadata.Namespace, "name", workload.Metadata.Name)
+		}
+		if strategy.BlueGreen != nil && strategy.BlueGreen.AutoPromotionEnabled != nil && !*strategy.BlueGreen.AutoPromotionEnabled {
+			patches = append(patches, patchOperation{
+				Op:    "replace",
+				Path:  "/spec/strategy/blueGreen/autoPromotionEnabled",
+				Value: true,
+			})
+			slog.Debug("Enabling auto promotion for Rollout", "namespace", workload.Metadata.Namespace, "name", workload.Metadata.Name)
+		}
+	}
+
+	return patches, nil
+}
+
+// newKubeClient returns a clientset for the cluster the webhook runs in.
+func newKubeClient() (kubernetes.Interface, error) {
+	config, err := rest.InClusterConfig()
 	if err != nil {
-		http.Error(w, "failed to marshal patches", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("loading in-cluster config: %w", err)
 	}
+	return kubernetes.NewForConfig(config)
+}
 
-	patchType := admissionv1.PatchTypeJSONPatch
-	response := admissionv1.AdmissionReview{
-		TypeMeta: metav1.TypeMeta{
-			APIVersion: "admission.k8s.io/v1",
-			Kind:       "AdmissionReview",
-		},
-		Response: &admissionv1.AdmissionResponse{
-			UID:       admissionReview.Request.UID,
-			Allowed:   true,
-			PatchType: &patchType,
-			Patch:     patchBytes,
-		},
+// newServer returns a server listening on addr with the configured timeouts.
+func newServer(cfg *Config, addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
 	}
+}
 
-	respBytes, err := json.Marshal(response)
-	if err != nil {
-		http.Error(w, "failed to marshal response", http.StatusInternalServerError)
-		return
+// Backoff between attempts to bind the listening port, doubling from
+// bindBackoff up to maxBindBackoff.
+const (
+	bindBackoff    = 500 * time.Millisecond
+	maxBindBackoff = 10 * time.Second
+)
+
+// listen binds addr, retrying up to the configured BindRetries times with
+// backoff. A port still held by the previous process, or an address not yet
+// assigned, is usually gone within seconds, sooner than the pod would be
+// restarted.
+func listen(cfg *Config, addr string) (net.Listener, error) {
+	backoff := bindBackoff
+	for attempt := 0; ; attempt++ {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil || attempt >= cfg.BindRetries {
+			return ln, err
+		}
+		slog.Warn("Failed to bind, retrying", "addr", addr, "attempt", attempt+1, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxBindBackoff)
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(respBytes)
+// startConfigReload watches the config file for changes if CONFIG_RELOAD is
+// set. Reloads replace the active configuration only, cfg keeps the settings
+// main started with.
+func startConfigReload(cfg *Config) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" || !cfg.ConfigReload {
+		return
+	}
+	if err := watchConfig(path); err != nil {
+		slog.Error("Failed to watch config file", "path", path, "error", err)
+		os.Exit(1)
+	}
 }
 
 func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	activeConfig.Store(cfg)
+
+	slog.SetDefault(newLogger(cfg.LogFormat, cfg.LogLevel, cfg.LogSamplePerSecond))
+
+	if cfg.RemoveRequests {
+		slog.Warn("REMOVE_REQUESTS is enabled, pods lose all CPU and memory requests and limits and become BestEffort, the first to be evicted under node pressure")
+	}
+
+	if cfg.SelfTest {
+		if err := selfTest(cfg); err != nil {
+			slog.Error("Self-test failed", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Self-test passed")
+	}
+
+	registerMetrics(prometheus.DefaultRegisterer, cfg.MetricsNamespaceLabel, cfg.MetricsNamespaceLimit)
+
+	if cfg.MaxConcurrent > 0 {
+		inflight = make(chan struct{}, cfg.MaxConcurrent)
+	}
+
+	if cfg.CreateEvents || cfg.NamespaceKillSwitch || cfg.NodeCapacityPercent > 0 {
+		client, err := newKubeClient()
+		if err != nil {
+			slog.Warn("Running without Kubernetes API access, events, namespace kill switch and node capacity caps disabled", "error", err)
+		} else {
+			if cfg.CreateEvents {
+				eventRecorder = newEventRecorder(client)
+			}
+			if cfg.NamespaceKillSwitch {
+				namespaces = newNamespaceCache(client, cfg.NamespaceCacheTTL)
+			}
+			if cfg.NodeCapacityPercent > 0 {
+				nodes = newNodeCache(client, cfg.NodeCacheTTL)
+			}
+		}
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8443"
 	}
 
+	// Simulation is for trying out a configuration locally, so it's served
+	// without TLS and without the admission endpoints
+	if cfg.Simulate {
+		http.HandleFunc("POST /simulate", handleSimulate)
+		http.HandleFunc("/healthz", handleHealth)
+		slog.Warn("Serving /simulate without TLS, only run this locally", "port", port)
+		server := newServer(cfg, ":"+port)
+		startConfigReload(cfg)
+		ln, err := listen(cfg, server.Addr)
+		if err != nil {
+			slog.Error("Failed to start server", "error", err)
+			os.Exit(1)
+		}
+		if err := server.Serve(ln); err != nil {
+			slog.Error("Server stopped", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	certFile := os.Getenv("TLS_CERT_FILE")
 	keyFile := os.Getenv("TLS_KEY_FILE")
 	if certFile == "" {
@@ -422,13 +785,42 @@ func main() {
 		keyFile = "/certs/tls.key"
 	}
 
-	http.HandleFunc("/mutate", handleMutate)
-	http.HandleFunc("/mutate-hpa", handleMutateHPA)
-	http.HandleFunc("/mutate-replicas", handleMutateReplicas)
-	http.HandleFunc("/healthz", handleHealth)
+	// Only the API server is let through to the admission endpoints when
+	// client certificates are verified
+	clientCAFile := os.Getenv("CLIENT_CA_FILE")
+	tlsConfig, err := newTLSConfig(clientCAFile, os.Getenv("TLS_MIN_VERSION"))
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "error", err)
+		os.Exit(1)
+	}
+	admission := requireJSON
+	if clientCAFile != "" {
+		admission = func(next http.HandlerFunc) http.HandlerFunc {
+			return requireClientCert(requireJSON(next))
+		}
+	}
+
+	registerAdmissionRoutes(cfg, http.DefaultServeMux, admission)
+	health := handleHealth
+	if cfg.HealthCheckCerts {
+		health = certHealth(certFile, keyFile, health)
+	}
+	http.HandleFunc("/healthz", health)
+	registerUnauthenticatedRoutes(cfg, http.DefaultServeMux)
+
+	server := newServer(cfg, ":"+port)
+	server.TLSConfig = tlsConfig
+	startConfigReload(cfg)
 
-	log.Printf("Starting resource-request-remover webhook on port %s", port)
-	if err := http.ListenAndServeTLS(":"+port, certFile, keyFile, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	ln, err := listen(cfg, server.Addr)
+	if err != nil {
+		slog.Error("Failed to start server", "error", err)
+		os.Exit(1)
+	}
+	build := currentBuildInfo()
+	slog.Info("Starting resource-request-remover webhook", "port", port, "version", build.Version, "commit", build.Commit)
+	if err := server.ServeTLS(ln, certFile, keyFile); err != nil {
+		slog.Error("Server stopped", "error", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,1200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv1 "k8s.io/api/autoscaling/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// testPod returns a pod with the given number of containers, each with
+// CPU and memory requests and limits, and an init container.
+func testPod(containers int) *corev1.Pod {
+	container := func(name string) corev1.Container {
+		return corev1.Container{
+			Name:  name,
+			Image: "europe-north1-docker.pkg.dev/nais-io/nais/" + name + ":latest",
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("250m"),
+					corev1.ResourceMemory: resource.MustParse("512Mi"),
+				},
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("1"),
+					corev1.ResourceMemory: resource.MustParse("1Gi"),
+				},
+			},
+		}
+	}
+
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app-7d4b9c8f6-x2k9p",
+			Namespace: "team",
+			Labels:    map[string]string{"app": "app"},
+			Annotations: map[string]string{
+				"cluster-autoscaler.kubernetes.io/safe-to-evict": "false",
+			},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{container("init")},
+		},
+	}
+	for i := range containers {
+		pod.Spec.Containers = append(pod.Spec.Containers, container(fmt.Sprintf("container-%d", i)))
+	}
+	return pod
+}
+
+// createRequest returns the admission request for creating object, of the
+// given kind, in the team namespace.
+func createRequest(tb testing.TB, kind string, object any) *admissionv1.AdmissionRequest {
+	tb.Helper()
+	raw, err := json.Marshal(object)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var meta struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		tb.Fatal(err)
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:       types.UID("705ab4f5-6393-11e8-b7cc-42010a800002"),
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: kind},
+		Name:      meta.Metadata.Name,
+		Operation: admissionv1.Create,
+		Namespace: "team",
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+}
+
+// reviewBody returns the encoded admission.k8s.io/v1 AdmissionReview of req.
+func reviewBody(tb testing.TB, req *admissionv1.AdmissionRequest) []byte {
+	tb.Helper()
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  req,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return body
+}
+
+// postReview posts body to h like the API server does and returns the
+// recorded response.
+func postReview(h http.HandlerFunc, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// decodeResponse returns the AdmissionResponse recorded in w, failing the
+// test unless w holds a review.
+func decodeResponse(tb testing.TB, w *httptest.ResponseRecorder) *admissionv1.AdmissionResponse {
+	tb.Helper()
+	if w.Code != http.StatusOK {
+		tb.Fatalf("status = %d, body: %s", w.Code, w.Body)
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+		tb.Fatalf("decoding response: %v", err)
+	}
+	if review.Response == nil {
+		tb.Fatalf("review has no response: %s", w.Body)
+	}
+	return review.Response
+}
+
+// admitInto runs admit on req and decodes the patched object into result,
+// returning the patches.
+func admitInto(tb testing.TB, admit admitFunc, req *admissionv1.AdmissionRequest, result any) []patchOperation {
+	tb.Helper()
+	patches, err := admit(context.Background(), activeConfig.Load(), req)
+	if err != nil {
+		tb.Fatalf("admit: %v", err)
+	}
+	patched, err := applyPatches(req.Object.Raw, patches)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := json.Unmarshal(patched, result); err != nil {
+		tb.Fatalf("decoding patched object: %v", err)
+	}
+	return patches
+}
+
+// withConfig replaces cfg with the default configuration, changed by set, for
+// the duration of the test.
+func withConfig(t *testing.T, set func(c *Config)) *Config {
+	t.Helper()
+	previous := activeConfig.Load()
+	c := defaultConfig()
+	set(c)
+	activeConfig.Store(c)
+	t.Cleanup(func() { activeConfig.Store(previous) })
+	return c
+}
+
+func TestMain(m *testing.M) {
+	// Every admission request is logged, which would drown the test output
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func TestAdmissionRoutesRejectOtherMethods(t *testing.T) {
+	mux := http.NewServeMux()
+	for _, route := range admissionRoutes {
+		mux.HandleFunc(route.pattern, route.serve)
+	}
+
+	for _, route := range admissionRoutes {
+		path := strings.TrimPrefix(route.pattern, "POST ")
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+			t.Run(method+" "+path, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+				if w.Code != http.StatusMethodNotAllowed {
+					t.Errorf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+				}
+				if allow := w.Header().Get("Allow"); allow != http.MethodPost {
+					t.Errorf("Allow = %q, want %q", allow, http.MethodPost)
+				}
+			})
+		}
+	}
+}
+
+func TestRegisterAdmissionRoutes(t *testing.T) {
+	tests := []struct {
+		handlers string
+		want     []string
+	}{
+		{handlers: "", want: []string{"/mutate", "/mutate-hpa", "/mutate-replicas", "/mutate-deployment", "/mutate-resourcequota", "/mutate-generic", "/mutate-scaledobject"}},
+		{handlers: "pod,hpa", want: []string{"/mutate", "/mutate-hpa"}},
+		{handlers: "scaledobject", want: []string{"/mutate-scaledobject"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.handlers, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {
+				if tt.handlers != "" {
+					c.Handlers = parseNameSet(tt.handlers)
+				}
+			})
+			mux := http.NewServeMux()
+			registerAdmissionRoutes(cfg, mux, func(next http.HandlerFunc) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {}
+			})
+
+			for _, route := range admissionRoutes {
+				path := strings.TrimPrefix(route.pattern, "POST ")
+				want := http.StatusNotFound
+				if slices.Contains(tt.want, path) {
+					want = http.StatusOK
+				}
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, nil))
+				if w.Code != want {
+					t.Errorf("POST %s: status = %d, want %d", path, w.Code, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRegisterUnauthenticatedRoutes(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(c *Config)
+		want map[string]int
+	}{
+		{
+			name: "defaults",
+			set:  func(c *Config) {},
+			want: map[string]int{"/metrics": http.StatusOK, "/version": http.StatusOK, "/export-policy": http.StatusNotFound, "/debug/stats": http.StatusNotFound},
+		},
+		{
+			name: "enabled",
+			set: func(c *Config) {
+				c.ExportPolicy = true
+				c.DebugStats = true
+			},
+			want: map[string]int{"/metrics": http.StatusOK, "/version": http.StatusOK, "/export-policy": http.StatusOK, "/debug/stats": http.StatusOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, tt.set)
+			mux := http.NewServeMux()
+			registerUnauthenticatedRoutes(cfg, mux)
+
+			for path, want := range tt.want {
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != want {
+					t.Errorf("GET %s: status = %d, want %d", path, w.Code, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireJSON(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"Application/JSON", http.StatusOK},
+		{"", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			called := false
+			h := requireJSON(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			r := httptest.NewRequest(http.MethodPost, "/mutate", strings.NewReader("{}"))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if called != (tt.want == http.StatusOK) {
+				t.Errorf("handler called = %t, want %t", called, !called)
+			}
+		})
+	}
+}
+
+func TestMutateReplicas(t *testing.T) {
+	replicas := func(n int32) *int32 { return &n }
+	controller := true
+	tests := []struct {
+		name         string
+		kind         string
+		subResource  string
+		object       any
+		wantReplicas *int32
+	}{
+		{
+			name:         "deployment",
+			kind:         "Deployment",
+			object:       &appsv1.Deployment{Spec: appsv1.DeploymentSpec{Replicas: replicas(3)}},
+			wantReplicas: replicas(1),
+		},
+		{
+			name:         "deployment without replicas",
+			kind:         "Deployment",
+			object:       &appsv1.Deployment{},
+			wantReplicas: replicas(1),
+		},
+		{
+			name:   "daemonset",
+			kind:   "DaemonSet",
+			object: &appsv1.DaemonSet{},
+		},
+		{
+			name: "replicaset owned by a deployment",
+			kind: "ReplicaSet",
+			object: &appsv1.ReplicaSet{
+				ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "apps/v1", Kind: "Deployment", Name: "app", Controller: &controller},
+				}},
+				Spec: appsv1.ReplicaSetSpec{Replicas: replicas(3)},
+			},
+		},
+		{
+			name:         "standalone replicaset",
+			kind:         "ReplicaSet",
+			object:       &appsv1.ReplicaSet{Spec: appsv1.ReplicaSetSpec{Replicas: replicas(3)}},
+			wantReplicas: replicas(1),
+		},
+		{
+			name:        "scale subresource",
+			kind:        "Scale",
+			subResource: "scale",
+			object:      &autoscalingv1.Scale{Spec: autoscalingv1.ScaleSpec{Replicas: 3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := createRequest(t, tt.kind, tt.object)
+			req.SubResource = tt.subResource
+			var result appsv1.Deployment
+			patches := admitInto(t, mutateReplicas, req, &result)
+			if tt.wantReplicas == nil {
+				if len(patches) > 0 {
+					t.Errorf("patches = %v, want none", patches)
+				}
+				return
+			}
+			if got := result.Spec.Replicas; got == nil || *got != *tt.wantReplicas {
+				t.Errorf("replicas = %v, want %d", got, *tt.wantReplicas)
+			}
+		})
+	}
+}
+
+func TestOwnerKind(t *testing.T) {
+	controller, notController := true, false
+	ref := func(kind string, controller *bool) metav1.OwnerReference {
+		return metav1.OwnerReference{Kind: kind, Name: "app", Controller: controller}
+	}
+	tests := []struct {
+		name                  string
+		refs                  []metav1.OwnerReference
+		want                  string
+		wantOwnedByDeployment bool
+	}{
+		{name: "none", want: "Pod"},
+		{name: "replicaset", refs: []metav1.OwnerReference{ref("ReplicaSet", &controller)}, want: "Deployment"},
+		{name: "job", refs: []metav1.OwnerReference{ref("Job", &controller)}, want: "Job"},
+		{name: "deployment", refs: []metav1.OwnerReference{ref("Deployment", &controller)}, want: "Deployment", wantOwnedByDeployment: true},
+		{name: "not controller", refs: []metav1.OwnerReference{ref("Deployment", &notController)}, want: "Pod"},
+		{name: "controller unset", refs: []metav1.OwnerReference{ref("Deployment", nil)}, want: "Pod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ownerKind(tt.refs); got != tt.want {
+				t.Errorf("ownerKind() = %s, want %s", got, tt.want)
+			}
+			if got := ownedByDeployment(tt.refs); got != tt.wantOwnedByDeployment {
+				t.Errorf("ownedByDeployment() = %t, want %t", got, tt.wantOwnedByDeployment)
+			}
+		})
+	}
+}
+
+func TestMutatePod(t *testing.T) {
+	tests := []struct {
+		name         string
+		set          func(c *Config)
+		wantRequests corev1.ResourceList
+		wantLimits   corev1.ResourceList
+	}{
+		{
+			name: "defaults",
+			set:  func(c *Config) {},
+			wantRequests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("50m"),
+				corev1.ResourceMemory: resource.MustParse("107374182"),
+			},
+		},
+		{
+			name: "remove requests",
+			set:  func(c *Config) { c.RemoveRequests = true },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.set)
+
+			var pod corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", testPod(2)), &pod)
+			for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+				if !equality.Semantic.DeepEqual(c.Resources.Requests, tt.wantRequests) {
+					t.Errorf("container %s: requests = %v, want %v", c.Name, c.Resources.Requests, tt.wantRequests)
+				}
+				if !equality.Semantic.DeepEqual(c.Resources.Limits, tt.wantLimits) {
+					t.Errorf("container %s: limits = %v, want %v", c.Name, c.Resources.Limits, tt.wantLimits)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateHPAMetrics(t *testing.T) {
+	minReplicas := int32(2)
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			MinReplicas: &minReplicas,
+			MaxReplicas: 10,
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ContainerResourceMetricSourceType,
+					ContainerResource: &autoscalingv2.ContainerResourceMetricSource{
+						Name:      corev1.ResourceCPU,
+						Container: "app",
+						Target:    autoscalingv2.MetricTarget{Type: autoscalingv2.UtilizationMetricType},
+					},
+				},
+				{
+					Type: autoscalingv2.ExternalMetricSourceType,
+					External: &autoscalingv2.ExternalMetricSource{
+						Metric: autoscalingv2.MetricIdentifier{Name: "queue_depth"},
+						Target: autoscalingv2.MetricTarget{Type: autoscalingv2.AverageValueMetricType},
+					},
+				},
+			},
+		},
+	}
+	tests := []struct {
+		name        string
+		set         func(c *Config)
+		wantMetrics int
+	}{
+		{"kept by default", func(c *Config) {}, 2},
+		{"stripped", func(c *Config) { c.StripHPAMetrics = true }, 0},
+		// A scaling HPA needs its metrics
+		{"kept in proportional mode", func(c *Config) {
+			c.StripHPAMetrics = true
+			c.HPAMode = hpaModeProportional
+		}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.set)
+
+			var result autoscalingv2.HorizontalPodAutoscaler
+			admitInto(t, mutateHPA, createRequest(t, "HorizontalPodAutoscaler", hpa), &result)
+			if got := len(result.Spec.Metrics); got != tt.wantMetrics {
+				t.Errorf("metrics = %d, want %d", got, tt.wantMetrics)
+			}
+		})
+	}
+}
+
+func TestMutateReplicasRollout(t *testing.T) {
+	canary := map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"spec": map[string]any{
+			"replicas": 3,
+			"strategy": map[string]any{"canary": map[string]any{
+				"steps": []any{map[string]any{"setWeight": 20}, map[string]any{"pause": map[string]any{}}},
+			}},
+		},
+	}
+	blueGreen := map[string]any{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"spec": map[string]any{
+			"replicas": 3,
+			"strategy": map[string]any{"blueGreen": map[string]any{
+				"activeService":        "app",
+				"autoPromotionEnabled": false,
+			}},
+		},
+	}
+	tests := []struct {
+		name      string
+		skipSteps bool
+		object    map[string]any
+		want      string
+	}{
+		{"canary", false, canary, `{"canary":{"steps":[{"setWeight":20},{"pause":{}}]}}`},
+		{"canary, skipping steps", true, canary, `{"canary":{}}`},
+		{"blue-green", false, blueGreen, `{"blueGreen":{"activeService":"app","autoPromotionEnabled":false}}`},
+		{"blue-green, skipping steps", true, blueGreen, `{"blueGreen":{"activeService":"app","autoPromotionEnabled":true}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.RolloutSkipSteps = tt.skipSteps })
+
+			var result struct {
+				Spec struct {
+					Replicas int32           `json:"replicas"`
+					Strategy json.RawMessage `json:"strategy"`
+				} `json:"spec"`
+			}
+			admitInto(t, mutateReplicas, createRequest(t, "Rollout", tt.object), &result)
+			if result.Spec.Replicas != 1 {
+				t.Errorf("replicas = %d, want 1", result.Spec.Replicas)
+			}
+			if got := string(result.Spec.Strategy); got != tt.want {
+				t.Errorf("strategy = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeTestCert writes a self-signed certificate and its key for localhost to
+// dir, returning their paths.
+func writeTestCert(tb testing.TB, dir string) (certFile, keyFile string) {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		tb.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestCertHealth(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove string
+		want   int
+	}{
+		{name: "loadable", want: http.StatusOK},
+		{name: "certificate missing", remove: "tls.crt", want: http.StatusServiceUnavailable},
+		{name: "key missing", remove: "tls.key", want: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certFile, keyFile := writeTestCert(t, dir)
+			if tt.remove != "" {
+				if err := os.Remove(filepath.Join(dir, tt.remove)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			certHealth(certFile, keyFile, handleHealth)(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateHPAMinReplicas(t *testing.T) {
+	replicas := func(n int32) *int32 { return &n }
+	tests := []struct {
+		name           string
+		hpaMinReplicas int32
+		minReplicas    *int32
+		want           int32
+	}{
+		{name: "unset", hpaMinReplicas: 1, want: 1},
+		{name: "lowered", hpaMinReplicas: 1, minReplicas: replicas(3), want: 1},
+		{name: "lower kept", hpaMinReplicas: 1, minReplicas: replicas(0), want: 0},
+		{name: "lowered to zero", hpaMinReplicas: 0, minReplicas: replicas(2), want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.HPAMinReplicas = tt.hpaMinReplicas })
+
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				MinReplicas: tt.minReplicas,
+				MaxReplicas: 10,
+			}}
+			var result autoscalingv2.HorizontalPodAutoscaler
+			admitInto(t, mutateHPA, createRequest(t, "HorizontalPodAutoscaler", hpa), &result)
+			if got := result.Spec.MinReplicas; got == nil || *got != tt.want {
+				t.Errorf("minReplicas = %v, want %d", got, tt.want)
+			}
+			if result.Spec.MaxReplicas != 1 {
+				t.Errorf("maxReplicas = %d, want 1", result.Spec.MaxReplicas)
+			}
+		})
+	}
+}
+
+// replicasString formats optional replicas for test failures.
+func replicasString(n *int32) string {
+	if n == nil {
+		return "<nil>"
+	}
+	return strconv.Itoa(int(*n))
+}
+
+func TestMutateHPAMinNotAboveMax(t *testing.T) {
+	replicas := func(n int32) *int32 { return &n }
+	tests := []struct {
+		name string
+		set  func(c *Config)
+	}{
+		{name: "disable", set: func(c *Config) {}},
+		{name: "disable to zero", set: func(c *Config) { c.HPAMinReplicas = 0 }},
+		{name: "proportional", set: func(c *Config) { c.HPAMode = hpaModeProportional }},
+		{name: "proportional at 1%", set: func(c *Config) {
+			c.HPAMode = hpaModeProportional
+			c.HPAMaxPercent = 1
+		}},
+		{name: "proportional at 100%", set: func(c *Config) {
+			c.HPAMode = hpaModeProportional
+			c.HPAMaxPercent = 100
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.set)
+
+			for _, minReplicas := range []*int32{nil, replicas(0), replicas(1), replicas(3), replicas(50)} {
+				for _, maxReplicas := range []int32{1, 2, 3, 10, 50} {
+					if minReplicas != nil && *minReplicas > maxReplicas {
+						continue
+					}
+					hpa := &autoscalingv2.HorizontalPodAutoscaler{Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+						MinReplicas: minReplicas,
+						MaxReplicas: maxReplicas,
+					}}
+					var result autoscalingv2.HorizontalPodAutoscaler
+					admitInto(t, mutateHPA, createRequest(t, "HorizontalPodAutoscaler", hpa), &result)
+					if got := result.Spec.MinReplicas; got == nil || *got > result.Spec.MaxReplicas || result.Spec.MaxReplicas < 1 {
+						t.Errorf("min %s, max %d: got minReplicas = %s, maxReplicas = %d", replicasString(minReplicas), maxReplicas, replicasString(got), result.Spec.MaxReplicas)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMutatePodWindows(t *testing.T) {
+	tests := []struct {
+		name        string
+		skipWindows bool
+		os          *corev1.PodOS
+		selector    map[string]string
+		wantCPU     string
+		wantMemory  string
+	}{
+		{name: "linux", wantCPU: "50m", wantMemory: "107374182"},
+		{name: "windows", os: &corev1.PodOS{Name: corev1.Windows}, wantCPU: "100m", wantMemory: "256Mi"},
+		{name: "windows node selector", selector: map[string]string{corev1.LabelOSStable: "windows"}, wantCPU: "100m", wantMemory: "256Mi"},
+		{name: "windows skipped", skipWindows: true, os: &corev1.PodOS{Name: corev1.Windows}, wantCPU: "250m", wantMemory: "512Mi"},
+		{name: "linux with windows skipped", skipWindows: true, os: &corev1.PodOS{Name: corev1.Linux}, wantCPU: "50m", wantMemory: "107374182"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.SkipWindows = tt.skipWindows })
+
+			pod := testPod(1)
+			pod.Spec.OS = tt.os
+			pod.Spec.NodeSelector = tt.selector
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			for _, c := range append(result.Spec.InitContainers, result.Spec.Containers...) {
+				requests := c.Resources.Requests
+				if cpu := requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+					t.Errorf("container %s: cpu request = %s, want %s", c.Name, cpu.String(), tt.wantCPU)
+				}
+				if memory := requests[corev1.ResourceMemory]; memory.Cmp(resource.MustParse(tt.wantMemory)) != 0 {
+					t.Errorf("container %s: memory request = %s, want %s", c.Name, memory.String(), tt.wantMemory)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateHPAProportional(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxReplicas  int32
+		annotations  map[string]string
+		wantMax      int32
+		wantOriginal string
+	}{
+		{name: "scaled down", maxReplicas: 10, wantMax: 2, wantOriginal: "10"},
+		{name: "at least one", maxReplicas: 3, wantMax: 1, wantOriginal: "3"},
+		{
+			name:         "already scaled down",
+			maxReplicas:  2,
+			annotations:  map[string]string{originalMaxReplicasAnnotation: "10"},
+			wantMax:      2,
+			wantOriginal: "10",
+		},
+		{
+			name:         "changed since",
+			maxReplicas:  20,
+			annotations:  map[string]string{originalMaxReplicasAnnotation: "10"},
+			wantMax:      4,
+			wantOriginal: "20",
+		},
+		{
+			name:         "invalid annotation",
+			maxReplicas:  10,
+			annotations:  map[string]string{originalMaxReplicasAnnotation: "many"},
+			wantMax:      2,
+			wantOriginal: "10",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.HPAMode = hpaModeProportional })
+
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: tt.annotations},
+				Spec:       autoscalingv2.HorizontalPodAutoscalerSpec{MaxReplicas: tt.maxReplicas},
+			}
+			var result autoscalingv2.HorizontalPodAutoscaler
+			admitInto(t, mutateHPA, createRequest(t, "HorizontalPodAutoscaler", hpa), &result)
+			if result.Spec.MaxReplicas != tt.wantMax {
+				t.Errorf("maxReplicas = %d, want %d", result.Spec.MaxReplicas, tt.wantMax)
+			}
+			if got := result.Annotations[originalMaxReplicasAnnotation]; got != tt.wantOriginal {
+				t.Errorf("original max replicas = %q, want %q", got, tt.wantOriginal)
+			}
+		})
+	}
+}
+
+func TestMutatePodSkipImagePattern(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		wantReduced []string
+	}{
+		{name: "no pattern", wantReduced: []string{"init", "container-0", "container-1"}},
+		{name: "matching init container", pattern: "/init:", wantReduced: []string{"container-0", "container-1"}},
+		{name: "matching all", pattern: `^europe-north1-docker\.pkg\.dev/`},
+		{name: "invalid pattern", pattern: "[", wantReduced: []string{"init", "container-0", "container-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {})
+
+			pod := testPod(2)
+			if tt.pattern != "" {
+				pod.Annotations[skipImagePatternAnnotation] = tt.pattern
+			}
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			var reduced []string
+			for _, c := range append(result.Spec.InitContainers, result.Spec.Containers...) {
+				if len(c.Resources.Limits) == 0 {
+					reduced = append(reduced, c.Name)
+				}
+			}
+			if !slices.Equal(reduced, tt.wantReduced) {
+				t.Errorf("reduced containers = %v, want %v", reduced, tt.wantReduced)
+			}
+		})
+	}
+}
+
+func TestSafeToEvict(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		annotations map[string]string
+		want        string
+	}{
+		{name: "false removed", mode: safeToEvictRemove, annotations: map[string]string{safeToEvictAnnotation: "false"}},
+		{name: "true kept", mode: safeToEvictRemove, annotations: map[string]string{safeToEvictAnnotation: "true"}, want: "true"},
+		{name: "unset left alone", mode: safeToEvictRemove},
+		{name: "false set to true", mode: safeToEvictTrue, annotations: map[string]string{safeToEvictAnnotation: "false"}, want: "true"},
+		{name: "set without annotations", mode: safeToEvictTrue, want: "true"},
+		{name: "set with other annotations", mode: safeToEvictTrue, annotations: map[string]string{"team": "a"}, want: "true"},
+		{name: "already true", mode: safeToEvictTrue, annotations: map[string]string{safeToEvictAnnotation: "true"}, want: "true"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.SafeToEvict = tt.mode })
+
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: tt.annotations}}
+			var result corev1.Pod
+			patches := admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			if got := result.Annotations[safeToEvictAnnotation]; got != tt.want {
+				t.Errorf("safe-to-evict = %q, want %q", got, tt.want)
+			}
+			// Admitting the result again changes nothing
+			if len(patches) > 0 {
+				var again corev1.Pod
+				if patches := admitInto(t, mutatePod, createRequest(t, "Pod", &result), &again); len(patches) > 0 {
+					t.Errorf("patches for mutated pod = %v, want none", patches)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkHandleMutate(b *testing.B) {
+	for _, containers := range []int{3, 20} {
+		body := reviewBody(b, createRequest(b, "Pod", testPod(containers)))
+		b.Run(fmt.Sprintf("containers=%d", containers), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				w := postReview(handleMutate, body)
+				if w.Code != http.StatusOK {
+					b.Fatalf("status = %d, body: %s", w.Code, w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateReplicasAnnotation(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int32
+	}{
+		{"2", 2},
+		{" 3 ", 3},
+		{"0", 0},
+		{"-1", 1},
+		{"two", 1},
+		{"", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			replicas := int32(5)
+			deployment := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: map[string]string{replicasAnnotation: tt.value}},
+				Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+			}
+			var result appsv1.Deployment
+			admitInto(t, mutateReplicas, createRequest(t, "Deployment", deployment), &result)
+			if got := result.Spec.Replicas; got == nil || *got != tt.want {
+				t.Errorf("replicas = %v, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewServerSlowClient(t *testing.T) {
+	cfg := withConfig(t, func(c *Config) { c.ReadHeaderTimeout = 50 * time.Millisecond })
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(cfg, ln.Addr().String())
+	server.Handler = http.HandlerFunc(handleHealth)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Send part of the headers and stall, like a slowloris client
+	if _, err := io.WriteString(conn, "GET /healthz HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("connection still open after the read header timeout: %v", err)
+	}
+}
+
+func TestMutatePodWithoutContainers(t *testing.T) {
+	tests := []struct {
+		name        string
+		validate    bool
+		containers  int
+		wantAllowed bool
+	}{
+		{name: "not validated", containers: 0, wantAllowed: true},
+		{name: "validated", validate: true, containers: 0},
+		{name: "validated with containers", validate: true, containers: 1, wantAllowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ValidatePodShape = tt.validate })
+
+			pod := testPod(tt.containers)
+			response := decodeResponse(t, postReview(handleMutate, reviewBody(t, createRequest(t, "Pod", pod))))
+			if response.Allowed != tt.wantAllowed {
+				t.Fatalf("allowed = %t, want %t, result: %+v", response.Allowed, tt.wantAllowed, response.Result)
+			}
+			if tt.wantAllowed {
+				return
+			}
+			if response.Patch != nil {
+				t.Errorf("patch = %s, want none", response.Patch)
+			}
+			if response.Result == nil || response.Result.Code != http.StatusUnprocessableEntity || !strings.Contains(response.Result.Message, "no containers") {
+				t.Errorf("result = %+v, want 422 about the missing containers", response.Result)
+			}
+		})
+	}
+}
+
+func TestMutateHPAScaleDownWindow(t *testing.T) {
+	seconds := func(n int32) *int32 { return &n }
+	tests := []struct {
+		name     string
+		shorten  bool
+		version  string
+		behavior *autoscalingv2.HorizontalPodAutoscalerBehavior
+		want     *int32
+	}{
+		{name: "disabled", version: "v2"},
+		{name: "without behavior", shorten: true, version: "v2", want: seconds(30)},
+		{
+			name:     "without scale down",
+			shorten:  true,
+			version:  "v2",
+			behavior: &autoscalingv2.HorizontalPodAutoscalerBehavior{ScaleUp: &autoscalingv2.HPAScalingRules{}},
+			want:     seconds(30),
+		},
+		{
+			name:     "without window",
+			shorten:  true,
+			version:  "v2",
+			behavior: &autoscalingv2.HorizontalPodAutoscalerBehavior{ScaleDown: &autoscalingv2.HPAScalingRules{}},
+			want:     seconds(30),
+		},
+		{
+			name:     "longer window",
+			shorten:  true,
+			version:  "v2",
+			behavior: &autoscalingv2.HorizontalPodAutoscalerBehavior{ScaleDown: &autoscalingv2.HPAScalingRules{StabilizationWindowSeconds: seconds(600)}},
+			want:     seconds(30),
+		},
+		{
+			name:     "shorter window kept",
+			shorten:  true,
+			version:  "v2",
+			behavior: &autoscalingv2.HorizontalPodAutoscalerBehavior{ScaleDown: &autoscalingv2.HPAScalingRules{StabilizationWindowSeconds: seconds(10)}},
+			want:     seconds(10),
+		},
+		{name: "autoscaling/v1", shorten: true, version: "v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.HPAMode = hpaModeProportional
+				c.ShortenHPAScaleDown = tt.shorten
+			})
+
+			hpa := &autoscalingv2.HorizontalPodAutoscaler{Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+				MaxReplicas: 10,
+				Behavior:    tt.behavior,
+			}}
+			req := createRequest(t, "HorizontalPodAutoscaler", hpa)
+			req.Kind.Version = tt.version
+			var result autoscalingv2.HorizontalPodAutoscaler
+			admitInto(t, mutateHPA, req, &result)
+			var got *int32
+			if result.Spec.Behavior != nil && result.Spec.Behavior.ScaleDown != nil {
+				got = result.Spec.Behavior.ScaleDown.StabilizationWindowSeconds
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("stabilizationWindowSeconds = %v, want %v", got, tt.want)
+			}
+			if tt.behavior != nil && tt.behavior.ScaleUp != nil && result.Spec.Behavior.ScaleUp == nil {
+				t.Error("scaleUp removed")
+			}
+		})
+	}
+}
+
+func TestListenRetries(t *testing.T) {
+	tests := []struct {
+		name    string
+		retries int
+		wantErr bool
+	}{
+		{name: "without retries", retries: 0, wantErr: true},
+		{name: "retried until free", retries: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) { c.BindRetries = tt.retries })
+
+			// Hold the port like a previous process still shutting down
+			held, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			time.AfterFunc(bindBackoff/2, func() { held.Close() })
+
+			ln, err := listen(cfg, held.Addr().String())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listen(cfg) error = %v, want error: %t", err, tt.wantErr)
+			}
+			if err == nil {
+				ln.Close()
+			}
+		})
+	}
+}
+
+func TestMutatePodOwnerKinds(t *testing.T) {
+	controller := true
+	owned := func(kind string) []metav1.OwnerReference {
+		return []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: kind, Name: "app", Controller: &controller}}
+	}
+	tests := []struct {
+		name        string
+		ownerKinds  map[string]bool
+		owners      []metav1.OwnerReference
+		wantReduced bool
+	}{
+		{name: "all owners", owners: owned("Job"), wantReduced: true},
+		{name: "deployment pod", ownerKinds: map[string]bool{"Deployment": true}, owners: owned("ReplicaSet"), wantReduced: true},
+		{name: "job pod", ownerKinds: map[string]bool{"Deployment": true}, owners: owned("Job")},
+		{name: "bare pod", ownerKinds: map[string]bool{"Deployment": true}},
+		{name: "bare pods listed", ownerKinds: map[string]bool{"Pod": true}, wantReduced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ReduceOwnerKinds = tt.ownerKinds })
+
+			pod := testPod(1)
+			pod.OwnerReferences = tt.owners
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			cpu := result.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU]
+			if reduced := cpu.Cmp(resource.MustParse("250m")) < 0; reduced != tt.wantReduced {
+				t.Errorf("cpu request = %s, want reduced: %t", cpu.String(), tt.wantReduced)
+			}
+		})
+	}
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	const doNotDisrupt, doNotEvict = "karpenter.sh/do-not-disrupt", "karpenter.sh/do-not-evict"
+	tests := []struct {
+		name        string
+		policy      string
+		annotations map[string]string
+		// want are the eviction annotations left, "" for removed ones
+		wantSafeToEvict, wantDoNotDisrupt, wantDoNotEvict string
+	}{
+		{
+			name:             "ignore",
+			policy:           evictionPolicyIgnore,
+			annotations:      map[string]string{safeToEvictAnnotation: "false", doNotDisrupt: "true"},
+			wantSafeToEvict:  "true",
+			wantDoNotDisrupt: "true",
+		},
+		{
+			name:            "evictable",
+			policy:          evictionPolicyEvictable,
+			annotations:     map[string]string{safeToEvictAnnotation: "false", doNotDisrupt: "true", doNotEvict: "true"},
+			wantSafeToEvict: "true",
+		},
+		{
+			name:            "evictable, conflicting",
+			policy:          evictionPolicyEvictable,
+			annotations:     map[string]string{safeToEvictAnnotation: "true", doNotEvict: "true"},
+			wantSafeToEvict: "true",
+		},
+		{
+			name:             "evictable, not blocking",
+			policy:           evictionPolicyEvictable,
+			annotations:      map[string]string{doNotDisrupt: "false"},
+			wantSafeToEvict:  "true",
+			wantDoNotDisrupt: "false",
+		},
+		{
+			name:             "respect",
+			policy:           evictionPolicyRespect,
+			annotations:      map[string]string{safeToEvictAnnotation: "false", doNotDisrupt: "true"},
+			wantSafeToEvict:  "false",
+			wantDoNotDisrupt: "true",
+		},
+		{
+			name:            "respect, conflicting",
+			policy:          evictionPolicyRespect,
+			annotations:     map[string]string{safeToEvictAnnotation: "true", doNotEvict: "true"},
+			wantSafeToEvict: "true",
+			wantDoNotEvict:  "true",
+		},
+		{
+			name:            "respect, not blocking",
+			policy:          evictionPolicyRespect,
+			annotations:     map[string]string{safeToEvictAnnotation: "false"},
+			wantSafeToEvict: "true",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.EvictionPolicy = tt.policy
+				c.SafeToEvict = safeToEvictTrue
+			})
+
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: tt.annotations}}
+			var result corev1.Pod
+			patches := admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			for name, want := range map[string]string{
+				safeToEvictAnnotation: tt.wantSafeToEvict,
+				doNotDisrupt:          tt.wantDoNotDisrupt,
+				doNotEvict:            tt.wantDoNotEvict,
+			} {
+				if got := result.Annotations[name]; got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			// The result is stable
+			if len(patches) > 0 {
+				var again corev1.Pod
+				if patches := admitInto(t, mutatePod, createRequest(t, "Pod", &result), &again); len(patches) > 0 {
+					t.Errorf("patches for mutated pod = %v, want none", patches)
+				}
+			}
+		})
+	}
+}
+
+func TestMutatePodKeepsOverhead(t *testing.T) {
+	// The RuntimeClass admission plugin rejects pods whose overhead doesn't
+	// match their RuntimeClass
+	pod := testPod(1)
+	pod.Spec.Overhead = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("250m")}
+
+	var result corev1.Pod
+	patches := admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+	for _, p := range patches {
+		if strings.HasPrefix(p.Path, "/spec/overhead") {
+			t.Errorf("patched overhead: %+v", p)
+		}
+	}
+	if !equality.Semantic.DeepEqual(result.Spec.Overhead, pod.Spec.Overhead) {
+		t.Errorf("overhead = %v, want %v", result.Spec.Overhead, pod.Spec.Overhead)
+	}
+}
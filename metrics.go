@@ -0,0 +1,160 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Admission request results, as reported in the result label.
+const (
+	resultPatched   = "patched"
+	resultUnchanged = "unchanged"
+	resultShed      = "shed"
+	resultTimeout   = "timeout"
+	resultInvalid   = "invalid"
+	resultError     = "error"
+	resultPanic     = "panic"
+	resultDenied    = "denied"
+)
+
+// otherNamespace replaces namespaces beyond the namespace label limit.
+const otherNamespace = "other"
+
+var (
+	requestsTotal        *prometheus.CounterVec
+	patchesTotal         *prometheus.CounterVec
+	cpuReclaimedTotal    *prometheus.CounterVec
+	memoryReclaimedTotal *prometheus.CounterVec
+	requestDuration      *prometheus.HistogramVec
+
+	// metricNamespaces limits the values of the namespace label. It stays
+	// nil unless the label is enabled.
+	metricNamespaces *namespaceLimiter
+)
+
+// registerMetrics creates the webhook metrics and registers them with reg.
+// With namespaceLabel, metrics are also labeled with the namespace of the
+// object, for at most namespaceLimit distinct namespaces.
+func registerMetrics(reg prometheus.Registerer, namespaceLabel bool, namespaceLimit int) {
+	labels := []string{"handler"}
+	if namespaceLabel {
+		labels = append(labels, "namespace")
+		metricNamespaces = &namespaceLimiter{limit: namespaceLimit, seen: map[string]bool{}}
+	}
+
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "resource_remover_admission_requests_total",
+		Help: "Admission requests handled, by result.",
+	}, append(labels, "result"))
+	patchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "resource_remover_patch_operations_total",
+		Help: "JSON Patch operations returned in admission responses.",
+	}, labels)
+	cpuReclaimedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "resource_remover_cpu_millicores_reclaimed_total",
+		Help: "CPU requests reduced or removed in admission responses, in millicores. Counted once per admitted object, not per running pod.",
+	}, labels)
+	memoryReclaimedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "resource_remover_memory_bytes_reclaimed_total",
+		Help: "Memory requests reduced or removed in admission responses, in bytes. Counted once per admitted object, not per running pod.",
+	}, labels)
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "resource_remover_admission_duration_seconds",
+		Help:    "Time taken to answer admission requests.",
+		Buckets: prometheus.DefBuckets,
+	}, labels)
+
+	reg.MustRegister(requestsTotal, patchesTotal, cpuReclaimedTotal, memoryReclaimedTotal, requestDuration)
+}
+
+// observeRequest records the outcome of an admission request, answered with
+// patches.
+func observeRequest(handler, namespace, result string, patches []patchOperation) {
+	if requestsTotal == nil {
+		return
+	}
+	labels := prometheus.Labels{"handler": handler}
+	if metricNamespaces != nil {
+		labels["namespace"] = metricNamespaces.label(namespace)
+	}
+	patchesTotal.With(labels).Add(float64(len(patches)))
+	var cpuMillis, memoryBytes int64
+	for _, p := range patches {
+		switch {
+		case strings.HasSuffix(p.Path, "/cpu"):
+			cpuMillis += p.reclaimed
+		case strings.HasSuffix(p.Path, "/memory"):
+			memoryBytes += p.reclaimed
+		}
+	}
+	cpuReclaimedTotal.With(labels).Add(float64(cpuMillis))
+	memoryReclaimedTotal.With(labels).Add(float64(memoryBytes))
+	labels["result"] = result
+	requestsTotal.With(labels).Inc()
+}
+
+// observeDuration records the time taken to answer an admission request.
+// With the traceID of a sampled trace, from the traceparent header the API
+// server sends when tracing is enabled, the trace is attached as an exemplar,
+// leading from a latency spike to the trace of a slow request.
+func observeDuration(handler, namespace string, duration time.Duration, traceID string) {
+	if requestDuration == nil {
+		return
+	}
+	labels := prometheus.Labels{"handler": handler}
+	if metricNamespaces != nil {
+		labels["namespace"] = metricNamespaces.label(namespace)
+	}
+	observer := requestDuration.With(labels)
+	if traceID == "" {
+		observer.Observe(duration.Seconds())
+		return
+	}
+	observer.(prometheus.ExemplarObserver).ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"trace_id": traceID})
+}
+
+// traceparentPattern matches a W3C Trace Context traceparent header,
+// capturing the trace ID and the trace flags.
+var traceparentPattern = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-([0-9a-f]{2})$`)
+
+// sampledTraceID returns the trace ID in the traceparent header if the trace
+// is sampled, and so recorded, or "" otherwise.
+func sampledTraceID(traceparent string) string {
+	m := traceparentPattern.FindStringSubmatch(traceparent)
+	if m == nil || m[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	flags, _ := strconv.ParseUint(m[2], 16, 8)
+	if flags&1 == 0 {
+		return ""
+	}
+	return m[1]
+}
+
+// namespaceLimiter protects against unbounded label cardinality by passing
+// through the first limit namespaces seen and folding the rest into "other".
+type namespaceLimiter struct {
+	limit int
+
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (l *namespaceLimiter) label(namespace string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[namespace] {
+		return namespace
+	}
+	if len(l.seen) >= l.limit {
+		return otherNamespace
+	}
+	l.seen[namespace] = true
+	return namespace
+}
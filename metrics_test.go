@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNamespaceLimiter(t *testing.T) {
+	l := &namespaceLimiter{limit: 2, seen: map[string]bool{}}
+	tests := []struct {
+		namespace string
+		want      string
+	}{
+		{"team-a", "team-a"},
+		{"team-b", "team-b"},
+		{"team-c", otherNamespace},
+		// Namespaces seen keep their label
+		{"team-a", "team-a"},
+		{"team-d", otherNamespace},
+	}
+	for _, tt := range tests {
+		if got := l.label(tt.namespace); got != tt.want {
+			t.Errorf("label(%s) = %s, want %s", tt.namespace, got, tt.want)
+		}
+	}
+}
+
+func TestObserveRequestNamespaceLabel(t *testing.T) {
+	tests := []struct {
+		name           string
+		namespaceLabel bool
+		want           map[string]float64
+	}{
+		{
+			name: "without namespace label",
+			want: map[string]float64{"": 3},
+		},
+		{
+			name:           "with namespace label",
+			namespaceLabel: true,
+			want:           map[string]float64{"team-a": 2, otherNamespace: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() {
+				requestsTotal, patchesTotal, cpuReclaimedTotal, memoryReclaimedTotal, requestDuration = nil, nil, nil, nil, nil
+				metricNamespaces = nil
+			})
+			reg := prometheus.NewRegistry()
+			registerMetrics(reg, tt.namespaceLabel, 1)
+
+			for _, namespace := range []string{"team-a", "team-a", "team-b"} {
+				observeRequest("pod", namespace, resultPatched, nil)
+			}
+
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]float64{}
+			for _, family := range families {
+				if family.GetName() != "resource_remover_admission_requests_total" {
+					continue
+				}
+				for _, m := range family.GetMetric() {
+					namespace := ""
+					for _, label := range m.GetLabel() {
+						if label.GetName() == "namespace" {
+							namespace = label.GetValue()
+						}
+					}
+					got[namespace] += m.GetCounter().GetValue()
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("requests by namespace = %v, want %v", got, tt.want)
+			}
+			for namespace, want := range tt.want {
+				if got[namespace] != want {
+					t.Errorf("requests in %q = %g, want %g", namespace, got[namespace], want)
+				}
+			}
+		})
+	}
+}
+
+// counterSum returns the sum of the counter name over all label values in
+// reg.
+func counterSum(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sum float64
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			sum += m.GetCounter().GetValue()
+		}
+	}
+	return sum
+}
+
+func TestReclaimedMetrics(t *testing.T) {
+	// testPod(2) has three containers counting the init container, each
+	// requesting 250m CPU and 512Mi memory
+	tests := []struct {
+		name       string
+		set        func(c *Config)
+		wantCPU    float64
+		wantMemory float64
+	}{
+		{
+			name:       "reduced",
+			set:        func(c *Config) {},
+			wantCPU:    3 * (250 - 50),
+			wantMemory: 3 * (512*1024*1024 - 107374182),
+		},
+		{
+			name:       "removed",
+			set:        func(c *Config) { c.RemoveRequests = true },
+			wantCPU:    3 * 250,
+			wantMemory: 3 * 512 * 1024 * 1024,
+		},
+		{
+			// Reduced limits free nothing
+			name: "cpu left alone",
+			set: func(c *Config) {
+				c.ReduceLimits = true
+				c.ResourcePolicy = resourcePolicy{{name: corev1.ResourceMemory, action: policyReduce}}
+			},
+			wantMemory: 3 * (512*1024*1024 - 107374182),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.set)
+			t.Cleanup(func() {
+				requestsTotal, patchesTotal, cpuReclaimedTotal, memoryReclaimedTotal, requestDuration = nil, nil, nil, nil, nil
+			})
+			reg := prometheus.NewRegistry()
+			registerMetrics(reg, false, 0)
+
+			decodeResponse(t, postReview(handleMutate, reviewBody(t, createRequest(t, "Pod", testPod(2)))))
+			if got := counterSum(t, reg, "resource_remover_cpu_millicores_reclaimed_total"); got != tt.wantCPU {
+				t.Errorf("cpu reclaimed = %g, want %g", got, tt.wantCPU)
+			}
+			if got := counterSum(t, reg, "resource_remover_memory_bytes_reclaimed_total"); got != tt.wantMemory {
+				t.Errorf("memory reclaimed = %g, want %g", got, tt.wantMemory)
+			}
+		})
+	}
+}
+
+func TestSampledTraceID(t *testing.T) {
+	tests := []struct {
+		traceparent string
+		want        string
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		// Not sampled
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", ""},
+		// Invalid all-zero trace ID
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", ""},
+		{"00-4bf92f3577b34da6-00f067aa0ba902b7-01", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := sampledTraceID(tt.traceparent); got != tt.want {
+			t.Errorf("sampledTraceID(%q) = %q, want %q", tt.traceparent, got, tt.want)
+		}
+	}
+}
+
+func TestDurationExemplar(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		want        string
+	}{
+		{name: "sampled trace", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", want: "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{name: "unsampled trace", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{name: "no trace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {})
+			t.Cleanup(func() {
+				requestsTotal, patchesTotal, cpuReclaimedTotal, memoryReclaimedTotal, requestDuration = nil, nil, nil, nil, nil
+			})
+			reg := prometheus.NewRegistry()
+			registerMetrics(reg, false, 0)
+
+			r := httptest.NewRequest(http.MethodPost, "/mutate", bytes.NewReader(reviewBody(t, createRequest(t, "Pod", testPod(1)))))
+			r.Header.Set("Content-Type", "application/json")
+			if tt.traceparent != "" {
+				r.Header.Set("traceparent", tt.traceparent)
+			}
+			handleMutate(httptest.NewRecorder(), r)
+
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			for _, family := range families {
+				if family.GetName() != "resource_remover_admission_duration_seconds" {
+					continue
+				}
+				for _, m := range family.GetMetric() {
+					for _, bucket := range m.GetHistogram().GetBucket() {
+						for _, label := range bucket.GetExemplar().GetLabel() {
+							if label.GetName() == "trace_id" {
+								got = label.GetValue()
+							}
+						}
+					}
+				}
+			}
+			if got != tt.want {
+				t.Errorf("exemplar trace_id = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
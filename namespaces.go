@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// disabledAnnotation on a Namespace turns off all mutation in it.
+const disabledAnnotation = "resource-remover.nais.io/disabled"
+
+// namespaces answers whether mutation is disabled for a namespace. It stays
+// nil unless the namespace kill switch is enabled.
+var namespaces *namespaceCache
+
+// namespaceCache looks up the disabled annotation of namespaces, remembering
+// the answer for ttl so admission requests don't hammer the API server.
+type namespaceCache struct {
+	client kubernetes.Interface
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]namespaceEntry
+}
+
+type namespaceEntry struct {
+	disabled bool
+	expires  time.Time
+}
+
+func newNamespaceCache(client kubernetes.Interface, ttl time.Duration) *namespaceCache {
+	return &namespaceCache{
+		client:  client,
+		ttl:     ttl,
+		entries: map[string]namespaceEntry{},
+	}
+}
+
+// namespaceLookupTimeout bounds a namespace lookup, well within the admission
+// timeout, so a slow API server only delays admission requests briefly.
+const namespaceLookupTimeout = time.Second
+
+// disabled reports whether the namespace carries the disabled annotation.
+// Failed lookups are remembered for ttl as not disabled, like namespaces
+// without the annotation, so a struggling API server isn't asked again on
+// every admission request. Only the lookup that failed returns the error.
+func (c *namespaceCache) disabled(ctx context.Context, name string) (bool, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[name]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.disabled, nil
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, namespaceLookupTimeout)
+	defer cancel()
+	ns, err := c.client.CoreV1().Namespaces().Get(lookupCtx, name, metav1.GetOptions{})
+	if err != nil && ctx.Err() != nil {
+		// The admission request was given up on, not the lookup
+		return false, err
+	}
+	entry = namespaceEntry{expires: now.Add(c.ttl)}
+	if err == nil {
+		entry.disabled = ns.Annotations[disabledAnnotation] == "true"
+	}
+
+	c.mu.Lock()
+	c.entries[name] = entry
+	c.mu.Unlock()
+
+	return entry.disabled, err
+}
+
+// systemNamespaces hold the control plane and its addons, and are never
+// mutated unless AllowSystemNamespaces is set.
+var systemNamespaces = []string{"kube-system", "kube-node-lease", "kube-public"}
+
+// namespaceExcluded reports whether objects in namespace are left alone by
+// the configured include and exclude lists. Entries are namespace names or
+// path.Match patterns such as team-* or *-dev. A namespace listed by name
+// follows the list naming it, with exclude winning if both do. Otherwise an
+// exclude pattern matching it excludes it, and with an include list, so does
+// no include pattern matching it. The systemNamespaces are excluded whatever
+// the lists say, unless allowed.
+func namespaceExcluded(cfg *Config, namespace string) bool {
+	if namespace == "" {
+		return false
+	}
+	switch {
+	case !cfg.AllowSystemNamespaces && slices.Contains(systemNamespaces, namespace):
+		return true
+	case slices.Contains(cfg.ExcludeNamespaces, namespace):
+		return true
+	case slices.Contains(cfg.IncludeNamespaces, namespace):
+		return false
+	case matchesAny(cfg.ExcludeNamespaces, namespace):
+		return true
+	case cfg.IncludeNamespaces != nil:
+		return !matchesAny(cfg.IncludeNamespaces, namespace)
+	}
+	return false
+}
+
+// matchesAny reports whether any of patterns matches name.
+func matchesAny(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		matched, _ := path.Match(pattern, name)
+		return matched
+	})
+}
+
+// parsePatterns parses a comma separated list of names and path.Match
+// patterns.
+func parsePatterns(val string) ([]string, error) {
+	var patterns []string
+	for _, pattern := range strings.Split(val, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%q: %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
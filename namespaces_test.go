@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestNamespaceCacheDisabled(t *testing.T) {
+	client := fake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "incident", Annotations: map[string]string{disabledAnnotation: "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team", Annotations: map[string]string{disabledAnnotation: "false"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "plain"}},
+	)
+	cache := newNamespaceCache(client, time.Minute)
+
+	tests := []struct {
+		namespace string
+		want      bool
+		wantErr   bool
+	}{
+		{namespace: "incident", want: true},
+		{namespace: "team", want: false},
+		{namespace: "plain", want: false},
+		{namespace: "missing", want: false, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.namespace, func(t *testing.T) {
+			client.ClearActions()
+
+			disabled, err := cache.disabled(context.Background(), tt.namespace)
+			if disabled != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("disabled = %t, %v, want %t, error %t", disabled, err, tt.want, tt.wantErr)
+			}
+			// Failed lookups are cached like the others
+			disabled, err = cache.disabled(context.Background(), tt.namespace)
+			if disabled != tt.want || err != nil {
+				t.Errorf("cached disabled = %t, %v, want %t", disabled, err, tt.want)
+			}
+			if got := len(client.Actions()); got != 1 {
+				t.Errorf("got %d lookups, want 1", got)
+			}
+		})
+	}
+}
+
+func TestNamespaceCacheExpires(t *testing.T) {
+	client := fake.NewClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team"}})
+	cache := newNamespaceCache(client, time.Millisecond)
+
+	if disabled, err := cache.disabled(context.Background(), "team"); disabled || err != nil {
+		t.Fatalf("disabled = %t, %v, want false", disabled, err)
+	}
+	ns, _ := client.CoreV1().Namespaces().Get(context.Background(), "team", metav1.GetOptions{})
+	ns.Annotations = map[string]string{disabledAnnotation: "true"}
+	if _, err := client.CoreV1().Namespaces().Update(context.Background(), ns, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	if disabled, err := cache.disabled(context.Background(), "team"); !disabled || err != nil {
+		t.Errorf("disabled = %t, %v after expiry, want true", disabled, err)
+	}
+}
+
+func TestNamespaceCacheTimeout(t *testing.T) {
+	// The API server never answers
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newNamespaceCache(client, time.Minute)
+
+	start := time.Now()
+	disabled, err := cache.disabled(context.Background(), "team")
+	if disabled || err == nil {
+		t.Errorf("disabled = %t, %v, want false with an error", disabled, err)
+	}
+	if elapsed := time.Since(start); elapsed > namespaceLookupTimeout+time.Second {
+		t.Errorf("lookup took %s, want about %s", elapsed, namespaceLookupTimeout)
+	}
+
+	start = time.Now()
+	if disabled, err := cache.disabled(context.Background(), "team"); disabled || err != nil {
+		t.Errorf("cached disabled = %t, %v, want false", disabled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("cached lookup took %s", elapsed)
+	}
+}
+
+func TestServeAdmissionNamespaceDisabled(t *testing.T) {
+	namespaces = newNamespaceCache(fake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team", Annotations: map[string]string{disabledAnnotation: "true"}}},
+	), time.Minute)
+	t.Cleanup(func() { namespaces = nil })
+
+	response := decodeResponse(t, postReview(handleMutate, reviewBody(t, createRequest(t, "Pod", testPod(1)))))
+	if !response.Allowed || response.Patch != nil {
+		t.Errorf("response = %+v, want allowed without patch", response)
+	}
+}
+
+func TestServeAdmissionSystemNamespaces(t *testing.T) {
+	tests := []struct {
+		namespace string
+		allow     bool
+		wantPatch bool
+	}{
+		{namespace: "kube-system"},
+		{namespace: "kube-node-lease"},
+		{namespace: "kube-public"},
+		{namespace: "team", wantPatch: true},
+		{namespace: "kube-system", allow: true, wantPatch: true},
+		// Only the exact names are system namespaces
+		{namespace: "kube-system-addons", wantPatch: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s allowed=%t", tt.namespace, tt.allow), func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.AllowSystemNamespaces = tt.allow })
+			pod := testPod(1)
+			pod.Namespace = tt.namespace
+			req := createRequest(t, "Pod", pod)
+			req.Namespace = tt.namespace
+
+			response := decodeResponse(t, postReview(handleMutate, reviewBody(t, req)))
+			if !response.Allowed {
+				t.Fatalf("response = %+v, want allowed", response)
+			}
+			if got := response.Patch != nil; got != tt.wantPatch {
+				t.Errorf("patched = %t, want %t", got, tt.wantPatch)
+			}
+		})
+	}
+}
+
+func TestNamespaceExcluded(t *testing.T) {
+	tests := []struct {
+		name      string
+		include   []string
+		exclude   []string
+		namespace string
+		want      bool
+	}{
+		{name: "no lists", namespace: "team-a"},
+		{name: "cluster scoped", include: []string{"team-*"}, namespace: ""},
+		{name: "include pattern matches", include: []string{"team-*"}, namespace: "team-a"},
+		{name: "include pattern doesn't match", include: []string{"team-*"}, namespace: "platform", want: true},
+		{name: "suffix pattern", include: []string{"*-dev"}, namespace: "payments-dev"},
+		{name: "exclude pattern matches", exclude: []string{"*-prod"}, namespace: "payments-prod", want: true},
+		{name: "exclude pattern doesn't match", exclude: []string{"*-prod"}, namespace: "payments-dev"},
+		{name: "exclude pattern wins over include pattern", include: []string{"team-*"}, exclude: []string{"*-prod"}, namespace: "team-prod", want: true},
+		{name: "included name wins over exclude pattern", include: []string{"team-prod"}, exclude: []string{"*-prod"}, namespace: "team-prod"},
+		{name: "excluded name wins over include pattern", include: []string{"team-*"}, exclude: []string{"team-b"}, namespace: "team-b", want: true},
+		{name: "excluded name wins over included name", include: []string{"team-b"}, exclude: []string{"team-b"}, namespace: "team-b", want: true},
+		{name: "system namespace", namespace: "kube-system", want: true},
+		{name: "system namespace included by name", include: []string{"kube-system"}, namespace: "kube-system", want: true},
+		{name: "system namespace included by pattern", include: []string{"kube-*"}, namespace: "kube-public", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {
+				c.IncludeNamespaces = tt.include
+				c.ExcludeNamespaces = tt.exclude
+			})
+
+			if got := namespaceExcluded(cfg, tt.namespace); got != tt.want {
+				t.Errorf("namespaceExcluded(cfg, %q) = %t, want %t", tt.namespace, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePatterns(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    []string
+		wantErr bool
+	}{
+		{val: "team-a, team-*,*-dev,", want: []string{"team-a", "team-*", "*-dev"}},
+		{val: ""},
+		{val: "team-[", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePatterns(tt.val)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePatterns(%q) error = %v, want error: %t", tt.val, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parsePatterns(%q) = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
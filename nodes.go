@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// nodes answers the allocatable resources of the smallest node. It stays nil
+// unless requests are capped by node capacity.
+var nodes *nodeCache
+
+// nodeCache looks up the allocatable resources of the smallest schedulable
+// node, remembering the answer for ttl so admission requests don't list all
+// nodes every time.
+type nodeCache struct {
+	client kubernetes.Interface
+	ttl    time.Duration
+
+	mu       sync.Mutex
+	smallest nodeAllocatable
+	expires  time.Time
+	// refreshing is closed when the lookup in flight is done, and nil
+	// without one.
+	refreshing chan struct{}
+}
+
+// nodeAllocatable is the allocatable CPU and memory of a node.
+type nodeAllocatable struct {
+	cpuMillis   int64
+	memoryBytes int64
+}
+
+func newNodeCache(client kubernetes.Interface, ttl time.Duration) *nodeCache {
+	return &nodeCache{
+		client: client,
+		ttl:    ttl,
+	}
+}
+
+const (
+	// nodeLookupTimeout bounds a node lookup, well within the admission
+	// timeout, so a slow API server only delays admission requests briefly.
+	nodeLookupTimeout = time.Second
+	// nodeErrorTTL is how long a failed lookup is remembered, shorter than
+	// the ttl so the cap comes back soon after the API server does.
+	nodeErrorTTL = 10 * time.Second
+	// nodeListPageSize is the number of nodes listed per request, so a large
+	// cluster isn't listed in one response.
+	nodeListPageSize = 500
+)
+
+// allocatable returns the smallest allocatable CPU and memory of the
+// schedulable nodes, each taken separately. Zero means no node reported it.
+// Only one lookup runs at a time, concurrent callers wait for its answer.
+// Failed lookups are remembered for nodeErrorTTL, answering with the last
+// good value, so a struggling API server isn't asked again on every
+// admission request. Only the lookup that failed returns the error.
+func (c *nodeCache) allocatable(ctx context.Context) (nodeAllocatable, error) {
+	c.mu.Lock()
+	if time.Now().Before(c.expires) {
+		smallest := c.smallest
+		c.mu.Unlock()
+		return smallest, nil
+	}
+	if refreshing := c.refreshing; refreshing != nil {
+		c.mu.Unlock()
+		select {
+		case <-refreshing:
+		case <-ctx.Done():
+			return nodeAllocatable{}, ctx.Err()
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.smallest, nil
+	}
+	refreshing := make(chan struct{})
+	c.refreshing = refreshing
+	c.mu.Unlock()
+
+	lookupCtx, cancel := context.WithTimeout(ctx, nodeLookupTimeout)
+	defer cancel()
+	smallest, err := c.list(lookupCtx)
+
+	c.mu.Lock()
+	switch {
+	case err == nil:
+		c.smallest, c.expires = smallest, time.Now().Add(c.ttl)
+	case ctx.Err() == nil:
+		// Unless the admission request was given up on, not the lookup
+		c.expires = time.Now().Add(min(c.ttl, nodeErrorTTL))
+	}
+	smallest = c.smallest
+	c.refreshing = nil
+	c.mu.Unlock()
+	close(refreshing)
+
+	return smallest, err
+}
+
+// list lists the nodes, a page at a time, and returns the smallest
+// allocatable CPU and memory of the schedulable ones.
+func (c *nodeCache) list(ctx context.Context) (nodeAllocatable, error) {
+	var smallest nodeAllocatable
+	options := metav1.ListOptions{Limit: nodeListPageSize}
+	for {
+		list, err := c.client.CoreV1().Nodes().List(ctx, options)
+		if err != nil {
+			return nodeAllocatable{}, err
+		}
+		for _, node := range list.Items {
+			if node.Spec.Unschedulable {
+				continue
+			}
+			if cpu, ok := node.Status.Allocatable[corev1.ResourceCPU]; ok && (smallest.cpuMillis == 0 || cpu.MilliValue() < smallest.cpuMillis) {
+				smallest.cpuMillis = cpu.MilliValue()
+			}
+			if mem, ok := node.Status.Allocatable[corev1.ResourceMemory]; ok && (smallest.memoryBytes == 0 || mem.Value() < smallest.memoryBytes) {
+				smallest.memoryBytes = mem.Value()
+			}
+		}
+		if list.Continue == "" {
+			return smallest, nil
+		}
+		options.Continue = list.Continue
+	}
+}
+
+// withNodeCapacity caps the reduced requests in floors at the configured
+// NodeCapacityPercent of the smallest node's allocatable resources, so a
+// reduced request fits on every node. Failed lookups are logged and leave
+// floors as they are, unless an earlier lookup succeeded.
+func withNodeCapacity(ctx context.Context, cfg *Config, floors resourceFloors) resourceFloors {
+	if nodes == nil || cfg.NodeCapacityPercent == 0 {
+		return floors
+	}
+	// A failed lookup still answers with the last good value, if any
+	smallest, err := nodes.allocatable(ctx)
+	if err != nil {
+		slog.Warn("Failed to look up node capacity", "error", err)
+	}
+	floors.maxCPUMillis = smallest.cpuMillis * int64(cfg.NodeCapacityPercent) / 100
+	floors.maxMemoryBytes = smallest.memoryBytes * int64(cfg.NodeCapacityPercent) / 100
+	return floors
+}
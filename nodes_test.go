@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testNode returns a node with the given allocatable CPU and memory.
+func testNode(name, cpu, memory string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: corev1.NodeStatus{Allocatable: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpu),
+			corev1.ResourceMemory: resource.MustParse(memory),
+		}},
+	}
+}
+
+func TestNodeCacheAllocatable(t *testing.T) {
+	cordoned := testNode("cordoned", "100m", "128Mi")
+	cordoned.Spec.Unschedulable = true
+	client := fake.NewClientset(
+		testNode("large", "8", "32Gi"),
+		testNode("few-cpus", "2", "16Gi"),
+		testNode("little-memory", "4", "4Gi"),
+		cordoned,
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "not-ready"}},
+	)
+	cache := newNodeCache(client, time.Minute)
+
+	want := nodeAllocatable{cpuMillis: 2000, memoryBytes: 4 * 1024 * 1024 * 1024}
+	for range 2 {
+		got, err := cache.allocatable(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("allocatable = %+v, want %+v", got, want)
+		}
+	}
+	if got := len(client.Actions()); got != 1 {
+		t.Errorf("got %d node lists, want 1", got)
+	}
+}
+
+func TestNodeCacheAllocatablePages(t *testing.T) {
+	pages := map[string]*corev1.NodeList{
+		"": {
+			ListMeta: metav1.ListMeta{Continue: "second"},
+			Items:    []corev1.Node{*testNode("large", "8", "32Gi")},
+		},
+		"second": {Items: []corev1.Node{*testNode("small", "2", "4Gi")}},
+	}
+	client := fake.NewClientset()
+	client.PrependReactor("list", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		options := action.(k8stesting.ListActionImpl).GetListOptions()
+		if options.Limit != nodeListPageSize {
+			t.Errorf("limit = %d, want %d", options.Limit, nodeListPageSize)
+		}
+		return true, pages[options.Continue], nil
+	})
+	cache := newNodeCache(client, time.Minute)
+
+	got, err := cache.allocatable(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (nodeAllocatable{cpuMillis: 2000, memoryBytes: 4 * 1024 * 1024 * 1024}); got != want {
+		t.Errorf("allocatable = %+v, want %+v", got, want)
+	}
+	if got := len(client.Actions()); got != 2 {
+		t.Errorf("got %d node lists, want 2", got)
+	}
+}
+
+func TestNodeCacheAllocatableFailed(t *testing.T) {
+	client := fake.NewClientset(testNode("small", "1", "2Gi"))
+	cache := newNodeCache(client, time.Minute)
+	want := nodeAllocatable{cpuMillis: 1000, memoryBytes: 2 * 1024 * 1024 * 1024}
+	if _, err := cache.allocatable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expire the good answer and fail the next lookup
+	cache.expires = time.Time{}
+	client.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("etcdserver: request timed out")
+	})
+	got, err := cache.allocatable(context.Background())
+	if err == nil {
+		t.Error("allocatable() of failed lookup succeeded")
+	}
+	if got != want {
+		t.Errorf("allocatable of failed lookup = %+v, want the last good %+v", got, want)
+	}
+
+	// The failure is remembered
+	got, err = cache.allocatable(context.Background())
+	if err != nil {
+		t.Errorf("allocatable() after failed lookup: %v", err)
+	}
+	if got != want {
+		t.Errorf("allocatable after failed lookup = %+v, want the last good %+v", got, want)
+	}
+	if got := len(client.Actions()); got != 2 {
+		t.Errorf("got %d node lists, want 2", got)
+	}
+	if ttl := time.Until(cache.expires); ttl > nodeErrorTTL {
+		t.Errorf("failed lookup remembered for %s, want at most %s", ttl, nodeErrorTTL)
+	}
+}
+
+func TestNodeCacheAllocatableConcurrent(t *testing.T) {
+	listing := make(chan struct{})
+	release := make(chan struct{})
+	client := fake.NewClientset(testNode("small", "1", "2Gi"))
+	client.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+		close(listing)
+		<-release
+		return false, nil, nil
+	})
+	cache := newNodeCache(client, time.Minute)
+
+	want := nodeAllocatable{cpuMillis: 1000, memoryBytes: 2 * 1024 * 1024 * 1024}
+	var wg sync.WaitGroup
+	lookup := func() {
+		defer wg.Done()
+		got, err := cache.allocatable(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		if got != want {
+			t.Errorf("allocatable = %+v, want %+v", got, want)
+		}
+	}
+	wg.Add(1)
+	go lookup()
+	<-listing
+	// These wait for the blocked lookup instead of listing again
+	for range 10 {
+		wg.Add(1)
+		go lookup()
+	}
+	close(release)
+	wg.Wait()
+
+	if got := len(client.Actions()); got != 1 {
+		t.Errorf("got %d node lists, want 1", got)
+	}
+}
+
+func TestNodeCacheAllocatableCanceled(t *testing.T) {
+	cache := newNodeCache(fake.NewClientset(testNode("small", "1", "2Gi")), time.Minute)
+	// A lookup in flight that doesn't finish in time
+	cache.refreshing = make(chan struct{})
+
+	// A caller waiting for it gives up with its admission request
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := cache.allocatable(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("allocatable() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestWithNodeCapacity(t *testing.T) {
+	tests := []struct {
+		name       string
+		percent    int
+		floors     bool
+		node       *corev1.Node
+		listErr    error
+		wantCPU    string
+		wantMemory string
+	}{
+		{name: "disabled", node: testNode("small", "1", "2Gi"), wantCPU: "400m", wantMemory: "858993459"},
+		{name: "capped", percent: 10, node: testNode("small", "1", "2Gi"), wantCPU: "100m", wantMemory: "214748364"},
+		{name: "below the cap", percent: 50, node: testNode("small", "1", "2Gi"), wantCPU: "400m", wantMemory: "858993459"},
+		{name: "floors win", percent: 10, floors: true, node: testNode("small", "100m", "100Mi"), wantCPU: "50m", wantMemory: "64Mi"},
+		{name: "lookup failed", percent: 10, listErr: errors.New("forbidden"), wantCPU: "400m", wantMemory: "858993459"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.NodeCapacityPercent = tt.percent
+				if tt.floors {
+					c.LimitRangeMinCPU = resource.MustParse("50m")
+					c.LimitRangeMinMemory = resource.MustParse("64Mi")
+				}
+			})
+			var objects []runtime.Object
+			if tt.node != nil {
+				objects = append(objects, tt.node)
+			}
+			client := fake.NewClientset(objects...)
+			if tt.listErr != nil {
+				client.PrependReactor("list", "nodes", func(k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, tt.listErr
+				})
+			}
+			nodes = newNodeCache(client, time.Minute)
+			t.Cleanup(func() { nodes = nil })
+
+			pod := testPod(1)
+			pod.Spec.Containers[0].Resources.Requests = corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("2"),
+				corev1.ResourceMemory: resource.MustParse("4Gi"),
+			}
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			got := result.Spec.Containers[0].Resources.Requests
+			if cpu := got[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+				t.Errorf("cpu request = %s, want %s", cpu.String(), tt.wantCPU)
+			}
+			if memory := got[corev1.ResourceMemory]; memory.Cmp(resource.MustParse(tt.wantMemory)) != 0 {
+				t.Errorf("memory request = %s, want %s", memory.String(), tt.wantMemory)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// podFields are the parts of a pod the webhook looks at. Pods carry a lot
+// the webhook doesn't need, such as environment variables, volumes, probes
+// and managed fields, and decoding a complete corev1.Pod for every admission
+// request adds up under high pod churn.
+type podFields struct {
+	Metadata struct {
+		Name            string                  `json:"name"`
+		GenerateName    string                  `json:"generateName"`
+		Namespace       string                  `json:"namespace"`
+		UID             types.UID               `json:"uid"`
+		Labels          map[string]string       `json:"labels"`
+		Annotations     map[string]string       `json:"annotations"`
+		OwnerReferences []metav1.OwnerReference `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		Containers                []containerFields                 `json:"containers"`
+		InitContainers            []containerFields                 `json:"initContainers"`
+		ResourceClaims            []corev1.PodResourceClaim         `json:"resourceClaims"`
+		OS                        *corev1.PodOS                     `json:"os"`
+		NodeSelector              map[string]string                 `json:"nodeSelector"`
+		TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints"`
+		Affinity                  *corev1.Affinity                  `json:"affinity"`
+		PriorityClassName         string                            `json:"priorityClassName"`
+		Priority                  *int32                            `json:"priority"`
+		TerminationGracePeriod    *int64                            `json:"terminationGracePeriodSeconds"`
+		Tolerations               []corev1.Toleration               `json:"tolerations"`
+		SchedulerName             string                            `json:"schedulerName"`
+	} `json:"spec"`
+}
+
+// containerFields are the parts of a container the webhook looks at.
+type containerFields struct {
+	Name         string                         `json:"name"`
+	Image        string                         `json:"image"`
+	Resources    corev1.ResourceRequirements    `json:"resources"`
+	ResizePolicy []corev1.ContainerResizePolicy `json:"resizePolicy"`
+}
+
+// decodePod decodes the fields of the pod in raw the webhook looks at into a
+// corev1.Pod. Other fields are left empty.
+func decodePod(raw []byte) (*corev1.Pod, error) {
+	var fields podFields
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, err
+	}
+
+	pod := &corev1.Pod{}
+	pod.Name = fields.Metadata.Name
+	pod.GenerateName = fields.Metadata.GenerateName
+	pod.Namespace = fields.Metadata.Namespace
+	pod.UID = fields.Metadata.UID
+	pod.Labels = fields.Metadata.Labels
+	pod.Annotations = fields.Metadata.Annotations
+	pod.OwnerReferences = fields.Metadata.OwnerReferences
+
+	pod.Spec.Containers = toContainers(fields.Spec.Containers)
+	pod.Spec.InitContainers = toContainers(fields.Spec.InitContainers)
+	pod.Spec.ResourceClaims = fields.Spec.ResourceClaims
+	pod.Spec.OS = fields.Spec.OS
+	pod.Spec.NodeSelector = fields.Spec.NodeSelector
+	pod.Spec.TopologySpreadConstraints = fields.Spec.TopologySpreadConstraints
+	pod.Spec.Affinity = fields.Spec.Affinity
+	pod.Spec.PriorityClassName = fields.Spec.PriorityClassName
+	pod.Spec.Priority = fields.Spec.Priority
+	pod.Spec.TerminationGracePeriodSeconds = fields.Spec.TerminationGracePeriod
+	pod.Spec.Tolerations = fields.Spec.Tolerations
+	pod.Spec.SchedulerName = fields.Spec.SchedulerName
+	return pod, nil
+}
+
+func toContainers(fields []containerFields) []corev1.Container {
+	if fields == nil {
+		return nil
+	}
+	containers := make([]corev1.Container, len(fields))
+	for i, f := range fields {
+		containers[i] = corev1.Container{
+			Name:         f.Name,
+			Image:        f.Image,
+			Resources:    f.Resources,
+			ResizePolicy: f.ResizePolicy,
+		}
+	}
+	return containers
+}
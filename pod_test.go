@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDecodePod(t *testing.T) {
+	priority := int32(1000)
+	grace := int64(30)
+	pod := testPod(2)
+	pod.GenerateName = "app-7d4b9c8f6-"
+	pod.UID = "8a4a0b2c-6c5e-4c4b-9d3a-0f5d6c7b8a9e"
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app-7d4b9c8f6"}}
+	pod.Spec.Containers[0].ResizePolicy = []corev1.ContainerResizePolicy{{ResourceName: corev1.ResourceCPU, RestartPolicy: corev1.NotRequired}}
+	pod.Spec.OS = &corev1.PodOS{Name: corev1.Linux}
+	pod.Spec.NodeSelector = map[string]string{corev1.LabelOSStable: "linux"}
+	pod.Spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{{MaxSkew: 1, TopologyKey: corev1.LabelHostname, WhenUnsatisfiable: corev1.DoNotSchedule}}
+	pod.Spec.Affinity = &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{}}
+	pod.Spec.PriorityClassName = "high"
+	pod.Spec.Priority = &priority
+	pod.Spec.TerminationGracePeriodSeconds = &grace
+	pod.Spec.Tolerations = []corev1.Toleration{{Key: "spot", Operator: corev1.TolerationOpExists}}
+	pod.Spec.SchedulerName = "default-scheduler"
+	want := pod.DeepCopy()
+	want.TypeMeta = metav1.TypeMeta{}
+
+	// Fields the webhook doesn't look at are left out
+	pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}}
+	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+	pod.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kubectl"}}
+
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodePod(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !equality.Semantic.DeepEqual(got, want) {
+		t.Errorf("decodePod() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodePodInvalid(t *testing.T) {
+	if _, err := decodePod([]byte(`{"spec":{"containers":{}}}`)); err == nil {
+		t.Error("decodePod() of invalid pod succeeded")
+	}
+}
+
+// TestDecodePodPatches checks mutatePod returns the same patches for a pod
+// decoded by decodePod as for the complete corev1.Pod.
+func TestDecodePodPatches(t *testing.T) {
+	grace := int64(300)
+	tests := []struct {
+		name string
+		set  func(c *Config)
+		pod  func(pod *corev1.Pod)
+	}{
+		{
+			name: "scheduling",
+			set: func(c *Config) {
+				c.RelaxTopologySpread = true
+				c.RelaxAntiAffinity = true
+				c.ForcePriorityClass = "low"
+				c.ForceSchedulerName = "bin-packing"
+				c.MaxTerminationGracePeriod = 30 * time.Second
+			},
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{{MaxSkew: 1, TopologyKey: corev1.LabelHostname, WhenUnsatisfiable: corev1.DoNotSchedule}}
+				pod.Spec.Affinity = &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{TopologyKey: corev1.LabelHostname}},
+				}}
+				pod.Spec.PriorityClassName = "high"
+				pod.Spec.SchedulerName = "default-scheduler"
+				pod.Spec.TerminationGracePeriodSeconds = &grace
+			},
+		},
+		{
+			name: "tolerations",
+			set:  func(c *Config) { c.RemoveTolerations = []tolerationMatch{{key: "spot"}} },
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Tolerations = []corev1.Toleration{
+					{Key: "spot", Operator: corev1.TolerationOpExists},
+					{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "team", Effect: corev1.TaintEffectNoSchedule},
+				}
+			},
+		},
+		{
+			name: "hugepages",
+			set:  func(c *Config) { c.RemoveHugepages = true },
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Resources.Requests["hugepages-2Mi"] = resource.MustParse("128Mi")
+				pod.Spec.Containers[0].Resources.Limits["hugepages-2Mi"] = resource.MustParse("128Mi")
+			},
+		},
+		{
+			name: "overhead",
+			set:  func(c *Config) {},
+			pod: func(pod *corev1.Pod) {
+				runtimeClass := "gvisor"
+				pod.Spec.RuntimeClassName = &runtimeClass
+				pod.Spec.Overhead = corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("250m")}
+			},
+		},
+		{
+			name: "initContainers",
+			set:  func(c *Config) { c.SetResizePolicy = true },
+			pod: func(pod *corev1.Pod) {
+				always := corev1.ContainerRestartPolicyAlways
+				sidecar := pod.Spec.Containers[1].DeepCopy()
+				sidecar.Name = "sidecar"
+				sidecar.RestartPolicy = &always
+				pod.Spec.InitContainers = append(pod.Spec.InitContainers, *sidecar)
+			},
+		},
+		{
+			name: "ephemeral",
+			set:  func(c *Config) {},
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+					EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox"},
+					TargetContainerName:      pod.Spec.Containers[0].Name,
+				}}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, tt.set)
+			pod := testPod(2)
+			pod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}}
+			pod.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+			tt.pod(pod)
+			req := createRequest(t, "Pod", pod)
+
+			got, err := mutatePod(context.Background(), cfg, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var full corev1.Pod
+			if err := json.Unmarshal(req.Object.Raw, &full); err != nil {
+				t.Fatal(err)
+			}
+			want, err := mutateDecodedPod(context.Background(), cfg, req, &full)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(want) == 0 {
+				t.Fatal("no patches for the complete pod")
+			}
+
+			gotJSON, err := json.Marshal(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantJSON, err := json.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(gotJSON, wantJSON) {
+				t.Errorf("patches = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodePod(b *testing.B) {
+	pod := testPod(20)
+	for i := range pod.Spec.Containers {
+		pod.Spec.Containers[i].Env = []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "debug"}, {Name: "OTEL_SERVICE_NAME", Value: "app"}}
+		pod.Spec.Containers[i].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}
+	}
+	pod.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+	pod.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "kube-controller-manager", Operation: metav1.ManagedFieldsOperationUpdate}}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("decodePod", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := decodePod(raw); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("corev1.Pod", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			var pod corev1.Pod
+			if err := json.Unmarshal(raw, &pod); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Actions of a resource policy.
+const (
+	// policyReduce reduces the request and removes the limit.
+	policyReduce = "reduce"
+	// policyRemove removes both the request and the limit.
+	policyRemove = "remove"
+	// policyRemoveLimits removes the limit and keeps the request.
+	policyRemoveLimits = "remove-limits"
+	// policyLeave leaves the request and limit alone.
+	policyLeave = "leave"
+)
+
+// resourceRule is the action taken on a single resource.
+type resourceRule struct {
+	name   corev1.ResourceName
+	action string
+}
+
+// resourcePolicy lists the resources handled in container resources, in the
+// order their patches are emitted. Resources not listed are left alone.
+type resourcePolicy []resourceRule
+
+func defaultResourcePolicy() resourcePolicy {
+	return resourcePolicy{
+		{name: corev1.ResourceCPU, action: policyReduce},
+		{name: corev1.ResourceMemory, action: policyReduce},
+		{name: corev1.ResourceEphemeralStorage, action: policyReduce},
+	}
+}
+
+// parseResourcePolicy parses a comma separated list of name=action pairs,
+// e.g. "cpu=reduce,memory=reduce,nvidia.com/gpu=leave".
+func parseResourcePolicy(val string) (resourcePolicy, error) {
+	var policy resourcePolicy
+	seen := map[corev1.ResourceName]bool{}
+	for _, pair := range strings.Split(val, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, action, ok := strings.Cut(pair, "=")
+		name, action = strings.TrimSpace(name), strings.TrimSpace(action)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name=action, got %q", pair)
+		}
+		switch action {
+		case policyReduce, policyRemove, policyRemoveLimits, policyLeave:
+		default:
+			return nil, fmt.Errorf("action for %s must be one of reduce, remove, remove-limits or leave, got %q", name, action)
+		}
+		// Hugepages must be requested in full, with requests equal to limits
+		if isHugepages(corev1.ResourceName(name)) && action != policyRemove && action != policyLeave {
+			return nil, fmt.Errorf("action for %s must be remove or leave, hugepages requests must equal their limits", name)
+		}
+		if seen[corev1.ResourceName(name)] {
+			return nil, fmt.Errorf("%s listed more than once", name)
+		}
+		seen[corev1.ResourceName(name)] = true
+		policy = append(policy, resourceRule{name: corev1.ResourceName(name), action: action})
+	}
+	return policy, nil
+}
+
+// resourceAction returns the action of the ResourcePolicy for name, leaving
+// unlisted resources alone, except hugepages with RemoveHugepages.
+func (c *Config) resourceAction(name corev1.ResourceName) string {
+	for _, rule := range c.ResourcePolicy {
+		if rule.name == name {
+			return rule.action
+		}
+	}
+	if c.RemoveHugepages && isHugepages(name) {
+		return policyRemove
+	}
+	return policyLeave
+}
+
+// resourceRules returns the rules applying to the resources in list: the
+// ResourcePolicy, followed by the removal of unlisted hugepages with
+// RemoveHugepages, in order of their names.
+func (c *Config) resourceRules(list corev1.ResourceList) []resourceRule {
+	if !c.RemoveHugepages {
+		return c.ResourcePolicy
+	}
+	rules := slices.Clone(c.ResourcePolicy)
+	for _, name := range slices.Sorted(maps.Keys(list)) {
+		if isHugepages(name) && !slices.ContainsFunc(c.ResourcePolicy, func(rule resourceRule) bool { return rule.name == name }) {
+			rules = append(rules, resourceRule{name: name, action: policyRemove})
+		}
+	}
+	return rules
+}
+
+// isHugepages reports whether name is a hugepages resource, such as
+// hugepages-2Mi.
+func isHugepages(name corev1.ResourceName) bool {
+	return strings.HasPrefix(string(name), corev1.ResourceHugePagesPrefix)
+}
+
+// parseResourceList parses a comma separated list of name=quantity pairs,
+// e.g. "cpu=10m,memory=16Mi".
+func parseResourceList(val string) (corev1.ResourceList, error) {
+	list := corev1.ResourceList{}
+	for _, pair := range strings.Split(val, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, quantity, ok := strings.Cut(pair, "=")
+		name, quantity = strings.TrimSpace(name), strings.TrimSpace(quantity)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name=quantity, got %q", pair)
+		}
+		q, err := resource.ParseQuantity(quantity)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if _, ok := list[corev1.ResourceName(name)]; ok {
+			return nil, fmt.Errorf("%s listed more than once", name)
+		}
+		list[corev1.ResourceName(name)] = q
+	}
+	return list, nil
+}
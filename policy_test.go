@@ -0,0 +1,213 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestParseResourcePolicy(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    resourcePolicy
+		wantErr bool
+	}{
+		{
+			val: "cpu=reduce, memory=remove-limits,nvidia.com/gpu=leave,",
+			want: resourcePolicy{
+				{name: corev1.ResourceCPU, action: policyReduce},
+				{name: corev1.ResourceMemory, action: policyRemoveLimits},
+				{name: "nvidia.com/gpu", action: policyLeave},
+			},
+		},
+		{val: "cpu=remove", want: resourcePolicy{{name: corev1.ResourceCPU, action: policyRemove}}},
+		{val: "", want: nil},
+		{val: "cpu", wantErr: true},
+		{val: "=reduce", wantErr: true},
+		{val: "cpu=halve", wantErr: true},
+		{val: "cpu=reduce,cpu=leave", wantErr: true},
+		{val: "hugepages-2Mi=remove", want: resourcePolicy{{name: "hugepages-2Mi", action: policyRemove}}},
+		{val: "hugepages-1Gi=leave", want: resourcePolicy{{name: "hugepages-1Gi", action: policyLeave}}},
+		// Hugepages requests must equal their limits
+		{val: "hugepages-2Mi=reduce", wantErr: true},
+		{val: "hugepages-1Gi=remove-limits", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseResourcePolicy(tt.val)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseResourcePolicy(%q) error = %v, want error: %t", tt.val, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseResourcePolicy(%q) = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestResourcePolicy(t *testing.T) {
+	tests := []struct {
+		policy       string
+		wantRequests corev1.ResourceList
+		wantLimits   corev1.ResourceList
+	}{
+		{
+			policy: "cpu=reduce,memory=leave",
+			wantRequests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("50m"),
+				corev1.ResourceMemory: resource.MustParse("512Mi"),
+			},
+			wantLimits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+		},
+		{
+			policy:       "cpu=remove,memory=remove-limits",
+			wantRequests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+		},
+		{
+			// Unlisted resources are left alone
+			policy: "ephemeral-storage=reduce",
+			wantRequests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("250m"),
+				corev1.ResourceMemory: resource.MustParse("512Mi"),
+			},
+			wantLimits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("1"),
+				corev1.ResourceMemory: resource.MustParse("1Gi"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			policy, err := parseResourcePolicy(tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			withConfig(t, func(c *Config) { c.ResourcePolicy = policy })
+
+			var pod corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", testPod(1)), &pod)
+			for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+				if !equality.Semantic.DeepEqual(c.Resources.Requests, tt.wantRequests) {
+					t.Errorf("container %s: requests = %v, want %v", c.Name, c.Resources.Requests, tt.wantRequests)
+				}
+				if !equality.Semantic.DeepEqual(c.Resources.Limits, tt.wantLimits) {
+					t.Errorf("container %s: limits = %v, want %v", c.Name, c.Resources.Limits, tt.wantLimits)
+				}
+			}
+		})
+	}
+}
+
+func TestParseResourceList(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    corev1.ResourceList
+		wantErr bool
+	}{
+		{
+			val: "cpu=10m, memory = 16Mi,",
+			want: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("10m"),
+				corev1.ResourceMemory: resource.MustParse("16Mi"),
+			},
+		},
+		{val: "", want: corev1.ResourceList{}},
+		{val: "cpu", wantErr: true},
+		{val: "=10m", wantErr: true},
+		{val: "cpu=lots", wantErr: true},
+		{val: "cpu=10m,cpu=20m", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseResourceList(tt.val)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseResourceList(%q) error = %v, want error: %t", tt.val, err, tt.wantErr)
+			continue
+		}
+		if !equality.Semantic.DeepEqual(got, tt.want) {
+			t.Errorf("parseResourceList(%q) = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveHugepages(t *testing.T) {
+	hugepages := corev1.ResourceList{
+		"hugepages-2Mi": resource.MustParse("64Mi"),
+		"hugepages-1Gi": resource.MustParse("2Gi"),
+	}
+	tests := []struct {
+		name        string
+		remove      bool
+		policy      string
+		wantKept    []corev1.ResourceName
+		wantRemoved []string
+	}{
+		{name: "off", wantKept: []corev1.ResourceName{"hugepages-1Gi", "hugepages-2Mi"}},
+		{
+			name:   "removed",
+			remove: true,
+			wantRemoved: []string{
+				"/spec/containers/0/resources/requests/hugepages-1Gi",
+				"/spec/containers/0/resources/requests/hugepages-2Mi",
+				"/spec/containers/0/resources/limits/hugepages-1Gi",
+				"/spec/containers/0/resources/limits/hugepages-2Mi",
+			},
+		},
+		{
+			name:     "listed in the policy",
+			remove:   true,
+			policy:   "cpu=reduce,memory=reduce,hugepages-2Mi=leave",
+			wantKept: []corev1.ResourceName{"hugepages-2Mi"},
+			wantRemoved: []string{
+				"/spec/containers/0/resources/requests/hugepages-1Gi",
+				"/spec/containers/0/resources/limits/hugepages-1Gi",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := defaultResourcePolicy()
+			if tt.policy != "" {
+				var err error
+				if policy, err = parseResourcePolicy(tt.policy); err != nil {
+					t.Fatal(err)
+				}
+			}
+			withConfig(t, func(c *Config) {
+				c.RemoveHugepages = tt.remove
+				c.ResourcePolicy = policy
+			})
+			pod := testPod(1)
+			resources := &pod.Spec.Containers[0].Resources
+			maps.Copy(resources.Requests, hugepages)
+			maps.Copy(resources.Limits, hugepages)
+
+			var result corev1.Pod
+			patches := admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			var removed []string
+			for _, p := range patches {
+				if p.Op == "remove" && strings.Contains(p.Path, "/hugepages-") {
+					removed = append(removed, p.Path)
+				}
+			}
+			if !slices.Equal(removed, tt.wantRemoved) {
+				t.Errorf("removed %v, want %v", removed, tt.wantRemoved)
+			}
+			got := result.Spec.Containers[0].Resources
+			for name := range hugepages {
+				kept := slices.Contains(tt.wantKept, name)
+				if _, ok := got.Requests[name]; ok != kept {
+					t.Errorf("%s request kept = %t, want %t", name, ok, kept)
+				}
+				// Hugepages requests must equal their limits
+				if !got.Requests[name].Equal(got.Limits[name]) {
+					t.Errorf("%s request %v differs from limit %v", name, got.Requests[name], got.Limits[name])
+				}
+			}
+		})
+	}
+}
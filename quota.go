@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func handleMutateResourceQuota(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, "resourcequota", mutateResourceQuota)
+}
+
+// mutateResourceQuota removes the hard limits of a ResourceQuota on the
+// resources changed by the resource policy. A quota on limits.cpu rejects
+// pods without a CPU limit, and quotas sized for the original requests get
+// in the way when requests are removed. Limits are only ever removed, so the
+// quota is never tightened.
+func mutateResourceQuota(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+	var quota struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+		Spec     struct {
+			Hard corev1.ResourceList `json:"hard"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(req.Object.Raw, &quota); err != nil {
+		return nil, badRequestError("failed to unmarshal resourcequota")
+	}
+
+	if skips(quota.Metadata.Annotations, skipQuota) {
+		skipped(ctx, skipReasonAnnotation)
+		slog.Debug("Skipping ResourceQuota due to skip annotation", "namespace", quota.Metadata.Namespace, "name", quota.Metadata.Name)
+		return nil, nil
+	}
+
+	// Sort for a stable patch, the hard limits are a map
+	var names []string
+	for name := range quota.Spec.Hard {
+		if relaxesQuota(cfg, name) {
+			names = append(names, string(name))
+		}
+	}
+	slices.Sort(names)
+
+	var patches []patchOperation
+	for _, name := range names {
+		patches = append(patches, patchOperation{
+			Op:   "remove",
+			Path: "/spec/hard/" + escapeJSONPointer(name),
+		})
+	}
+	if len(patches) > 0 {
+		slog.Debug("Removing hard limits from ResourceQuota", "namespace", quota.Metadata.Namespace, "name", quota.Metadata.Name, "limits", strings.Join(names, ","))
+	}
+	return patches, nil
+}
+
+// relaxesQuota reports whether the quota on name covers requests or limits
+// changed by the resource policy. CPU, memory and ephemeral storage quotas
+// without a prefix are the same as their requests quota.
+func relaxesQuota(cfg *Config, name corev1.ResourceName) bool {
+	if resource, ok := strings.CutPrefix(string(name), "limits."); ok {
+		return limitAction(cfg, cfg.resourceAction(corev1.ResourceName(resource))) == policyRemove
+	}
+	resource, ok := strings.CutPrefix(string(name), "requests.")
+	if !ok {
+		switch name {
+		case corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage:
+			resource = string(name)
+		default:
+			return false
+		}
+	}
+	switch requestAction(cfg, cfg.resourceAction(corev1.ResourceName(resource))) {
+	case policyReduce, policyRemove:
+		return true
+	}
+	return false
+}
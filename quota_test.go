@@ -0,0 +1,79 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutateResourceQuota(t *testing.T) {
+	hard := corev1.ResourceList{
+		corev1.ResourceLimitsCPU:       resource.MustParse("10"),
+		corev1.ResourceLimitsMemory:    resource.MustParse("10Gi"),
+		corev1.ResourceRequestsCPU:     resource.MustParse("10"),
+		corev1.ResourceMemory:          resource.MustParse("10Gi"),
+		corev1.ResourcePods:            resource.MustParse("10"),
+		"requests.nvidia.com/gpu":      resource.MustParse("1"),
+		corev1.ResourceRequestsStorage: resource.MustParse("100Gi"),
+		"requests.hugepages-2Mi":       resource.MustParse("1Gi"),
+	}
+	tests := []struct {
+		name        string
+		set         func(c *Config)
+		annotations map[string]string
+		want        []corev1.ResourceName
+	}{
+		{
+			name: "defaults",
+			set:  func(c *Config) {},
+			want: []corev1.ResourceName{corev1.ResourcePods, "requests.hugepages-2Mi", "requests.nvidia.com/gpu", corev1.ResourceRequestsStorage},
+		},
+		{
+			name: "removing hugepages",
+			set:  func(c *Config) { c.RemoveHugepages = true },
+			want: []corev1.ResourceName{corev1.ResourcePods, "requests.nvidia.com/gpu", corev1.ResourceRequestsStorage},
+		},
+		{
+			name: "keeping limits",
+			set:  func(c *Config) { c.KeepLimits = true },
+			want: []corev1.ResourceName{corev1.ResourceLimitsCPU, corev1.ResourceLimitsMemory, corev1.ResourcePods, "requests.hugepages-2Mi", "requests.nvidia.com/gpu", corev1.ResourceRequestsStorage},
+		},
+		{
+			name: "leaving memory alone",
+			set: func(c *Config) {
+				c.ResourcePolicy = resourcePolicy{{name: corev1.ResourceCPU, action: policyReduce}}
+			},
+			want: []corev1.ResourceName{corev1.ResourceLimitsMemory, corev1.ResourceMemory, corev1.ResourcePods, "requests.hugepages-2Mi", "requests.nvidia.com/gpu", corev1.ResourceRequestsStorage},
+		},
+		{
+			name:        "skip annotation",
+			set:         func(c *Config) {},
+			annotations: map[string]string{skipAnnotation: "quota"},
+			want:        slices.Sorted(maps.Keys(hard)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.set)
+
+			quota := &corev1.ResourceQuota{
+				ObjectMeta: metav1.ObjectMeta{Name: "team", Annotations: tt.annotations},
+				Spec:       corev1.ResourceQuotaSpec{Hard: hard},
+			}
+			var result corev1.ResourceQuota
+			admitInto(t, mutateResourceQuota, createRequest(t, "ResourceQuota", quota), &result)
+			var got []corev1.ResourceName
+			for name := range result.Spec.Hard {
+				got = append(got, name)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("hard limits left = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// reductionStageAnnotation holds the stage of the reduction ramp a workload
+// is at, counting from 1.
+const reductionStageAnnotation = "resource-remover.nais.io/reduction-stage"
+
+// rampStage returns the stage of the reduction ramp the pod template of the
+// workload with meta is reduced at. Workloads start at the first stage. With
+// ReductionRampAdvance, every update reducing the template moves the
+// workload on to the next stage, until the last. An invalid stage annotation
+// is logged and treated as missing.
+func rampStage(cfg *Config, kind string, meta *metav1.ObjectMeta, operation admissionv1.Operation) int {
+	stage := 0
+	if val, ok := meta.Annotations[reductionStageAnnotation]; ok {
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			slog.Warn("Ignoring invalid "+reductionStageAnnotation+" annotation", "kind", kind, "namespace", meta.Namespace, "name", meta.Name, "value", val)
+		} else {
+			stage = n
+		}
+	}
+	switch {
+	case stage == 0:
+		stage = 1
+	case cfg.ReductionRampAdvance && operation == admissionv1.Update:
+		stage++
+	}
+	return min(stage, len(cfg.ReductionRamp))
+}
+
+// parseRamp parses a comma separated list of the percentages of requests
+// kept at each stage of a reduction ramp, e.g. "80,60,20".
+func parseRamp(val string) ([]int64, error) {
+	var ramp []int64
+	for _, step := range strings.Split(val, ",") {
+		step = strings.TrimSpace(step)
+		if step == "" {
+			continue
+		}
+		percent, err := strconv.ParseInt(step, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if percent < 1 || percent > 100 {
+			return nil, fmt.Errorf("percentages must be between 1 and 100, got %d", percent)
+		}
+		ramp = append(ramp, percent)
+	}
+	return ramp, nil
+}
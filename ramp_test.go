@@ -0,0 +1,108 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseRamp(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    []int64
+		wantErr bool
+	}{
+		{val: "80, 60,20,", want: []int64{80, 60, 20}},
+		{val: "100", want: []int64{100}},
+		{val: ""},
+		{val: "80,sixty", wantErr: true},
+		{val: "0", wantErr: true},
+		{val: "101", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseRamp(tt.val)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRamp(%q) error = %v, want error: %t", tt.val, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseRamp(%q) = %v, want %v", tt.val, got, tt.want)
+		}
+	}
+}
+
+func TestRampStage(t *testing.T) {
+	tests := []struct {
+		name      string
+		advance   bool
+		stage     string
+		operation admissionv1.Operation
+		want      int
+	}{
+		{name: "new workload", operation: admissionv1.Create, want: 1},
+		{name: "new workload, advancing", advance: true, operation: admissionv1.Create, want: 1},
+		{name: "kept", stage: "2", operation: admissionv1.Update, want: 2},
+		{name: "advanced", advance: true, stage: "1", operation: admissionv1.Update, want: 2},
+		{name: "advanced to the last", advance: true, stage: "2", operation: admissionv1.Update, want: 3},
+		{name: "last kept", advance: true, stage: "3", operation: admissionv1.Update, want: 3},
+		{name: "past the last", stage: "7", operation: admissionv1.Update, want: 3},
+		{name: "created with a stage", advance: true, stage: "2", operation: admissionv1.Create, want: 2},
+		{name: "invalid", advance: true, stage: "two", operation: admissionv1.Update, want: 1},
+		{name: "zero", advance: true, stage: "0", operation: admissionv1.Update, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {
+				c.ReductionRamp = []int64{80, 60, 20}
+				c.ReductionRampAdvance = tt.advance
+			})
+
+			meta := &metav1.ObjectMeta{}
+			if tt.stage != "" {
+				meta.Annotations = map[string]string{reductionStageAnnotation: tt.stage}
+			}
+			if got := rampStage(cfg, "Deployment", meta, tt.operation); got != tt.want {
+				t.Errorf("rampStage(cfg) = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateDeploymentRamp(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.ReductionRamp = []int64{80, 60, 20}
+		c.ReductionRampAdvance = true
+	})
+
+	// Every deploy of the original template moves the ramp on a stage
+	stages := []struct {
+		operation admissionv1.Operation
+		wantCPU   string
+		wantStage string
+	}{
+		{admissionv1.Create, "200m", "1"},
+		{admissionv1.Update, "150m", "2"},
+		{admissionv1.Update, "50m", "3"},
+		{admissionv1.Update, "50m", "3"},
+	}
+	var annotations map[string]string
+	for i, stage := range stages {
+		req := createRequest(t, "Deployment", testDeployment(annotations))
+		req.Operation = stage.operation
+		var result appsv1.Deployment
+		admitInto(t, mutateDeployment, req, &result)
+		cpu := result.Spec.Template.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU]
+		if cpu.Cmp(resource.MustParse(stage.wantCPU)) != 0 {
+			t.Errorf("deploy %d: cpu request = %s, want %s", i+1, cpu.String(), stage.wantCPU)
+		}
+		if got := result.Annotations[reductionStageAnnotation]; got != stage.wantStage {
+			t.Errorf("deploy %d: stage = %q, want %q", i+1, got, stage.wantStage)
+		}
+		annotations = result.Annotations
+	}
+}
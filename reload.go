@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchConfig reloads the configuration whenever the config file at path
+// changes, until the watcher fails. The directory of the file is watched
+// rather than the file itself, since a mounted ConfigMap is updated by
+// swapping a symlink. An invalid configuration is logged and the last good
+// one kept.
+func watchConfig(path string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	last, _ := os.ReadFile(path)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// Other files in the directory, and the several events of
+				// a single update, leave the content unchanged
+				content, err := os.ReadFile(path)
+				if err != nil || bytes.Equal(content, last) {
+					continue
+				}
+				last = content
+				reloadConfig()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Watching config file failed", "path", path, "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// reloadConfig replaces the active configuration with the one loaded anew,
+// keeping the current one if the new one is invalid. Requests already running
+// finish with the configuration they started with.
+func reloadConfig() {
+	c, err := loadConfig()
+	if err != nil {
+		slog.Error("Invalid configuration, keeping the current one", "error", err)
+		return
+	}
+	activeConfig.Store(c)
+	slog.Info("Reloaded configuration")
+}
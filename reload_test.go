@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// waitForConfig waits for the active configuration to satisfy check.
+func waitForConfig(t *testing.T, check func(c *Config) bool) bool {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if check(activeConfig.Load()) {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// replaceFile replaces the file at path with content in one step, like the
+// kubelet does, so it's never read half written.
+func replaceFile(t *testing.T, path, content string) {
+	t.Helper()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	withConfig(t, func(c *Config) {})
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("admissionTimeout: 5s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	if err := watchConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	updates := []struct {
+		name string
+		file string
+		want time.Duration
+	}{
+		{name: "valid", file: "admissionTimeout: 3s\n", want: 3 * time.Second},
+		// The last good configuration is kept
+		{name: "invalid", file: "admissionTimeout: soon\n", want: 3 * time.Second},
+		{name: "valid again", file: "admissionTimeout: 4s\n", want: 4 * time.Second},
+	}
+	for _, update := range updates {
+		replaceFile(t, path, update.file)
+		if !waitForConfig(t, func(c *Config) bool { return c.AdmissionTimeout == update.want }) {
+			t.Errorf("%s: AdmissionTimeout = %s, want %s", update.name, activeConfig.Load().AdmissionTimeout, update.want)
+		}
+	}
+}
+
+func TestWatchConfigSymlinkSwap(t *testing.T) {
+	withConfig(t, func(c *Config) {})
+
+	// A mounted ConfigMap links the file through ..data to a timestamped
+	// directory, and is updated by swapping the ..data link
+	dir := t.TempDir()
+	write := func(version, content string) {
+		t.Helper()
+		if err := os.Mkdir(filepath.Join(dir, version), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, version, "config.yaml"), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("..v1", "failOpen: false\n")
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+	if err := watchConfig(path); err != nil {
+		t.Fatal(err)
+	}
+
+	write("..v2", "failOpen: true\n")
+	if !waitForConfig(t, func(c *Config) bool { return c.FailOpen }) {
+		t.Error("configuration not reloaded after swapping ..data")
+	}
+}
+
+func TestReloadConfigWhileQueued(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.MaxConcurrent = 1
+		c.QueueTimeout = 5 * time.Second
+	})
+	previous := inflight
+	inflight = make(chan struct{}, 1)
+	t.Cleanup(func() { inflight = previous })
+	inflight <- struct{}{}
+
+	req := createRequest(t, "Pod", testPod(1))
+	body := reviewBody(t, req)
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() { queued <- postReview(handleMutate, body) }()
+	select {
+	case <-queued:
+		t.Fatal("request was answered while all slots were taken")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The queued request doesn't hold up the reload
+	t.Setenv("REDUCTION_MODE", reductionModeCap)
+	reloaded := make(chan struct{})
+	go func() {
+		reloadConfig()
+		close(reloaded)
+	}()
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("reload waited for the queued request")
+	}
+	if mode := activeConfig.Load().ReductionMode; mode != reductionModeCap {
+		t.Errorf("ReductionMode = %q after reload, want %q", mode, reductionModeCap)
+	}
+
+	// Once let through, it finishes with the configuration it started with
+	<-inflight
+	response := decodeResponse(t, <-queued)
+	var patches []patchOperation
+	if err := json.Unmarshal(response.Patch, &patches); err != nil {
+		t.Fatal(err)
+	}
+	patched, err := applyPatches(req.Object.Raw, patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result corev1.Pod
+	if err := json.Unmarshal(patched, &result); err != nil {
+		t.Fatal(err)
+	}
+	if cpu := result.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse("50m")) != 0 {
+		t.Errorf("cpu request = %s, want the proportional 50m", cpu.String())
+	}
+}
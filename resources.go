@@ -0,0 +1,833 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// reductionFactor is what requests are divided by (1/5 = 20%).
+	reductionFactor = 5
+
+	minCPUMillis             = 1
+	minMemoryBytes           = 1024 * 1024 // 1Mi
+	minEphemeralStorageBytes = 1024 * 1024 // 1Mi
+)
+
+// resourceFloors are the lowest CPU and memory requests are reduced to, and
+// how far requests are reduced on the way there.
+type resourceFloors struct {
+	cpuMillis   int64
+	memoryBytes int64
+	// containerMemoryBytes are memory floors of single containers, from the
+	// min-memory annotation. The empty name applies to all containers.
+	containerMemoryBytes map[string]int64
+	// keepPercent is the percentage of requests kept by a ramped reduction.
+	// Zero means the usual 20%.
+	keepPercent int64
+	// maxCPUMillis and maxMemoryBytes are the highest CPU and memory
+	// requests are reduced to, from the node capacity. Zero means no limit.
+	// The floors win over them.
+	maxCPUMillis   int64
+	maxMemoryBytes int64
+}
+
+// reduce returns value reduced proportionally.
+func (f resourceFloors) reduce(value int64) int64 {
+	if f.keepPercent > 0 {
+		return value * f.keepPercent / 100
+	}
+	return value / reductionFactor
+}
+
+// ratio returns the factor requests are reduced by proportionally.
+func (f resourceFloors) ratio() float64 {
+	if f.keepPercent > 0 {
+		return float64(f.keepPercent) / 100
+	}
+	return 1.0 / reductionFactor
+}
+
+// atMost returns value, lowered to ceiling unless it's zero.
+func atMost(value, ceiling int64) int64 {
+	if ceiling > 0 {
+		return min(value, ceiling)
+	}
+	return value
+}
+
+// preservingRatio returns the floors raised so the CPU and memory requests
+// in requests are reduced by the same factor when either would reach its
+// floor: the one reaching it is reduced to the floor, and the other by the
+// same factor rather than further. Only applies to proportional reductions
+// of both.
+func (f resourceFloors) preservingRatio(cfg *Config, requests corev1.ResourceList) resourceFloors {
+	cpu, hasCPU := requests[corev1.ResourceCPU]
+	mem, hasMem := requests[corev1.ResourceMemory]
+	if !hasCPU || !hasMem || cpu.MilliValue() == 0 || mem.Value() == 0 ||
+		cfg.ReductionMode != reductionModeProportional ||
+		requestAction(cfg, cfg.resourceAction(corev1.ResourceCPU)) != policyReduce ||
+		requestAction(cfg, cfg.resourceAction(corev1.ResourceMemory)) != policyReduce {
+		return f
+	}
+	keep := max(float64(f.cpuMillis)/float64(cpu.MilliValue()), float64(f.memoryBytes)/float64(mem.Value()))
+	if keep <= f.ratio() {
+		return f
+	}
+	keep = min(keep, 1)
+	f.cpuMillis = max(f.cpuMillis, int64(math.Ceil(float64(cpu.MilliValue())*keep)))
+	f.memoryBytes = max(f.memoryBytes, int64(math.Ceil(float64(mem.Value())*keep)))
+	return f
+}
+
+// forContainer returns the floors for the container name.
+func (f resourceFloors) forContainer(name string) resourceFloors {
+	f.memoryBytes = max(f.memoryBytes, f.containerMemoryBytes[name], f.containerMemoryBytes[""])
+	return f
+}
+
+// aggressiveAnnotation set to "true" volunteers a pod, or the pods of a
+// template, for a stronger reduction, keeping AggressiveKeepPercent of their
+// requests.
+const aggressiveAnnotation = "resource-remover.nais.io/aggressive"
+
+// withAggressive sets the percentage of requests kept in floors to the
+// configured AggressiveKeepPercent when annotations carry the aggressive
+// annotation. Only applies in proportional mode.
+func withAggressive(cfg *Config, floors resourceFloors, annotations map[string]string) resourceFloors {
+	if annotations[aggressiveAnnotation] == "true" && cfg.ReductionMode == reductionModeProportional {
+		floors.keepPercent = int64(cfg.AggressiveKeepPercent)
+	}
+	return floors
+}
+
+// minMemoryAnnotation holds the memory the containers of a pod are known to
+// need, e.g. their working set, either as a single quantity for all
+// containers or as a comma separated list of name=quantity pairs. Memory
+// requests aren't reduced below it, scaled by MemoryRequestFloorRatio.
+const minMemoryAnnotation = "resource-remover.nais.io/min-memory"
+
+// startupMemoryAnnotation holds the memory the containers of a pod need
+// while starting, e.g. for a JVM sizing its heap, in the format of the
+// min-memory annotation. Memory requests aren't reduced below it, so pods
+// aren't placed on nodes they'd run out of memory on during startup.
+const startupMemoryAnnotation = "resource-remover.nais.io/startup-memory"
+
+// withMinMemory adds the memory floors in the min-memory and startup-memory
+// annotations in annotations to floors, taking the higher of the two. An
+// invalid annotation is logged and ignored.
+func withMinMemory(cfg *Config, floors resourceFloors, meta *metav1.ObjectMeta, annotations map[string]string) resourceFloors {
+	for _, annotation := range []struct {
+		name  string
+		ratio float64
+	}{
+		{minMemoryAnnotation, cfg.MemoryRequestFloorRatio},
+		// Startup needs the memory in full
+		{startupMemoryAnnotation, 1},
+	} {
+		val, ok := annotations[annotation.name]
+		if !ok {
+			continue
+		}
+		mins, err := parseMinMemory(val)
+		if err != nil {
+			slog.Warn("Ignoring invalid "+annotation.name+" annotation", "namespace", meta.Namespace, "name", meta.Name, "error", err)
+			continue
+		}
+		if floors.containerMemoryBytes == nil {
+			floors.containerMemoryBytes = map[string]int64{}
+		}
+		for name, q := range mins {
+			floor := int64(float64(q.Value()) * annotation.ratio)
+			floors.containerMemoryBytes[name] = max(floors.containerMemoryBytes[name], floor)
+		}
+	}
+	return floors
+}
+
+// parseMinMemory parses the min-memory annotation, returning the quantity
+// for all containers under the empty name.
+func parseMinMemory(val string) (map[string]resource.Quantity, error) {
+	mins := map[string]resource.Quantity{}
+	if !strings.Contains(val, "=") {
+		q, err := resource.ParseQuantity(strings.TrimSpace(val))
+		if err != nil {
+			return nil, err
+		}
+		mins[""] = q
+		return mins, nil
+	}
+	for _, pair := range strings.Split(val, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, quantity, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected name=quantity, got %q", pair)
+		}
+		q, err := resource.ParseQuantity(strings.TrimSpace(quantity))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		mins[name] = q
+	}
+	return mins, nil
+}
+
+// podFloors returns the floors for the pod with spec. Windows pods get the
+// configured Windows floors, as they don't run with the tiny requests Linux
+// pods get away with. No pod goes below the configured LimitRange minimums,
+// which would have the LimitRange admission plugin reject it after us.
+func podFloors(cfg *Config, spec *corev1.PodSpec) resourceFloors {
+	floors := resourceFloors{cpuMillis: minCPUMillis, memoryBytes: minMemoryBytes}
+	if isWindows(spec) {
+		floors = resourceFloors{
+			cpuMillis:   cfg.WindowsMinCPU.MilliValue(),
+			memoryBytes: cfg.WindowsMinMemory.Value(),
+		}
+	}
+	floors.cpuMillis = max(floors.cpuMillis, cfg.LimitRangeMinCPU.MilliValue())
+	floors.memoryBytes = max(floors.memoryBytes, cfg.LimitRangeMinMemory.Value())
+	return floors
+}
+
+// isWindows reports whether the pod with spec runs on Windows nodes.
+func isWindows(spec *corev1.PodSpec) bool {
+	if spec.OS != nil {
+		return spec.OS.Name == corev1.Windows
+	}
+	return spec.NodeSelector[corev1.LabelOSStable] == string(corev1.Windows)
+}
+
+// skipContainersAnnotation lists names of containers to leave alone.
+const skipContainersAnnotation = "resource-remover.nais.io/skip-containers"
+
+// onlyContainersAnnotation lists names of the only containers to reduce,
+// leaving all others alone.
+const onlyContainersAnnotation = "resource-remover.nais.io/only-containers"
+
+// skipImagePatternAnnotation holds a regular expression matched against the
+// images of containers to leave alone.
+const skipImagePatternAnnotation = "resource-remover.nais.io/skip-image-pattern"
+
+// containerFilter decides which containers of an object are reduced.
+type containerFilter struct {
+	skip         map[string]bool
+	only         map[string]bool
+	imagePattern *regexp.Regexp
+}
+
+// newContainerFilter builds the filter from the annotations of the object.
+// An invalid image pattern is logged and ignored, and the containers to skip
+// are ignored when the only containers to reduce are listed as well.
+func newContainerFilter(meta *metav1.ObjectMeta, annotations map[string]string) containerFilter {
+	filter := containerFilter{
+		skip: parseNameSet(annotations[skipContainersAnnotation]),
+	}
+	if only := parseNameSet(annotations[onlyContainersAnnotation]); len(only) > 0 {
+		if len(filter.skip) > 0 {
+			slog.Warn("Ignoring "+skipContainersAnnotation+" annotation, "+onlyContainersAnnotation+" takes precedence", "namespace", meta.Namespace, "name", meta.Name)
+			filter.skip = nil
+		}
+		filter.only = only
+	}
+	if pattern := annotations[skipImagePatternAnnotation]; pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			slog.Warn("Ignoring invalid "+skipImagePatternAnnotation+" annotation", "namespace", meta.Namespace, "name", meta.Name, "error", err)
+		} else {
+			filter.imagePattern = re
+		}
+	}
+	return filter
+}
+
+// skips reports whether container should be left alone.
+func (f containerFilter) skips(container corev1.Container) bool {
+	if f.imagePattern != nil && f.imagePattern.MatchString(container.Image) {
+		return true
+	}
+	if f.only != nil {
+		return !f.only[container.Name]
+	}
+	return f.skip[container.Name]
+}
+
+// skipAnnotation opts an object out of mutation. Its value is a comma
+// separated list of the concerns to skip, or "true" or "all" to skip them
+// all.
+const skipAnnotation = "resource-remover.nais.io/skip"
+
+// Concerns that can be listed in the skip annotation.
+const (
+	skipResources = "resources"
+	skipReplicas  = "replicas"
+	skipHPA       = "hpa"
+	skipQuota     = "quota"
+	skipAll       = "all"
+)
+
+// skips reports whether the skip annotation in annotations covers concern.
+func skips(annotations map[string]string, concern string) bool {
+	val, ok := annotations[skipAnnotation]
+	if !ok {
+		return false
+	}
+	set := parseNameSet(val)
+	return set["true"] || set[skipAll] || set[concern]
+}
+
+// selected reports whether pods with labels match the configured selector.
+// Without a selector every pod does.
+func selected(cfg *Config, podLabels map[string]string) bool {
+	return cfg.Selector == nil || cfg.Selector.Matches(labels.Set(podLabels))
+}
+
+// parseNameSet parses a comma separated list of names.
+func parseNameSet(val string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range strings.Split(val, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// reduceContainers applies the resource policy to the requests and limits of
+// containers, found at basePath (e.g. /spec/containers) in the object. By
+// default CPU and memory requests are reduced to 20% (or removed, with
+// RemoveRequests) and their limits removed. Containers rejected by filter are
+// left alone. Requests aren't reduced below floors. containerKind is only
+// used for logging.
+func reduceContainers(cfg *Config, meta *metav1.ObjectMeta, basePath, containerKind string, containers []corev1.Container, filter containerFilter, floors resourceFloors) []patchOperation {
+	var patches []patchOperation
+
+	for i, container := range containers {
+		if filter.skips(container) {
+			slog.Debug("Skipping container due to annotation", "namespace", meta.Namespace, "name", meta.Name, "containerKind", containerKind, "container", container.Name)
+			continue
+		}
+		path := fmt.Sprintf("%s/%d/resources", basePath, i)
+		containerFloors := floors.forContainer(container.Name)
+		if cfg.PreserveCPUMemoryRatio {
+			containerFloors = containerFloors.preservingRatio(cfg, container.Resources.Requests)
+		}
+		requestPatches, requestsRemoved := reduceResourceList(cfg, path+"/requests", container.Resources.Requests, requestAction, containerFloors, nil)
+		requestPatches = append(requestPatches, defaultRequests(cfg, path, container.Resources)...)
+		requests := patchedRequests(cfg, path+"/requests", container.Resources.Requests, requestPatches)
+		limitPatches, limitsRemoved := reduceResourceList(cfg, path+"/limits", container.Resources.Limits, limitAction, containerFloors, requests)
+		patches = append(patches, requestPatches...)
+		patches = append(patches, limitPatches...)
+
+		if len(requestPatches) > 0 {
+			msg := reductionDescription(cfg, floors)
+			if requestsRemoved {
+				msg = "Removing requests"
+			}
+			slog.Debug(msg, "namespace", meta.Namespace, "name", meta.Name, "containerKind", containerKind, "container", container.Name)
+		}
+		if len(limitPatches) > 0 {
+			msg := "Reducing limits"
+			if limitsRemoved {
+				msg = "Removing limits"
+			}
+			slog.Debug(msg, "namespace", meta.Namespace, "name", meta.Name, "containerKind", containerKind, "container", container.Name)
+		}
+		if (requestsRemoved || limitsRemoved) && bestEffort(cfg, container.Resources) {
+			slog.Warn("Container is left without CPU and memory requests and limits, the pod gets BestEffort QoS unless another container keeps some", "namespace", meta.Namespace, "name", meta.Name, "containerKind", containerKind, "container", container.Name)
+		}
+	}
+
+	return patches
+}
+
+// floorGuardTripped reports whether more than the configured FloorGuardCount
+// containers of a pod would have a CPU or memory request clamped to the
+// floors, in which case the pod isn't reduced: requests that small add up to
+// an unrealistic pod. Floors from the min-memory and startup-memory
+// annotations are set on purpose and aren't counted.
+func floorGuardTripped(cfg *Config, containers []corev1.Container, filter containerFilter, floors resourceFloors) bool {
+	if cfg.FloorGuardCount == 0 || cfg.ReductionMode != reductionModeProportional {
+		return false
+	}
+	hits := 0
+	for _, container := range containers {
+		if filter.skips(container) {
+			continue
+		}
+		cpu, hasCPU := container.Resources.Requests[corev1.ResourceCPU]
+		mem, hasMem := container.Resources.Requests[corev1.ResourceMemory]
+		if hasCPU && requestAction(cfg, cfg.resourceAction(corev1.ResourceCPU)) == policyReduce && floors.reduce(cpu.MilliValue()) < floors.cpuMillis ||
+			hasMem && requestAction(cfg, cfg.resourceAction(corev1.ResourceMemory)) == policyReduce && floors.reduce(mem.Value()) < floors.memoryBytes {
+			hits++
+		}
+	}
+	return hits > cfg.FloorGuardCount
+}
+
+// Annotations recording the factor requests were reduced by, for cost
+// analysis.
+const (
+	cpuRatioAnnotation    = "resource-remover.nais.io/cpu-ratio"
+	memoryRatioAnnotation = "resource-remover.nais.io/memory-ratio"
+)
+
+// ratioAnnotations returns the ratio annotations for the CPU and memory
+// requests reduced by patches. They're only recorded when requests are
+// reduced proportionally, as caps don't reduce by a fixed factor.
+func ratioAnnotations(cfg *Config, patches []patchOperation, floors resourceFloors) map[string]string {
+	if !cfg.AnnotateReductionRatio || cfg.ReductionMode != reductionModeProportional {
+		return nil
+	}
+	ratio := strconv.FormatFloat(floors.ratio(), 'f', -1, 64)
+	annotations := map[string]string{}
+	for _, p := range patches {
+		if p.Op != "replace" {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(p.Path, "/resources/requests/cpu"):
+			annotations[cpuRatioAnnotation] = ratio
+		case strings.HasSuffix(p.Path, "/resources/requests/memory"):
+			annotations[memoryRatioAnnotation] = ratio
+		}
+	}
+	return annotations
+}
+
+// addAnnotations returns the patches adding annotations to the object
+// metadata at path (e.g. /metadata), which has the annotations existing.
+// patches are those already made to the object, which may have added the
+// annotations map.
+func addAnnotations(path string, existing map[string]string, patches []patchOperation, annotations map[string]string) []patchOperation {
+	if len(annotations) == 0 {
+		return nil
+	}
+	created := slices.ContainsFunc(patches, func(p patchOperation) bool {
+		return p.Op == "add" && p.Path == path+"/annotations"
+	})
+	if existing == nil && !created {
+		return []patchOperation{{
+			Op:    "add",
+			Path:  path + "/annotations",
+			Value: annotations,
+		}}
+	}
+	var added []patchOperation
+	for _, name := range slices.Sorted(maps.Keys(annotations)) {
+		// add replaces an existing value too
+		added = append(added, patchOperation{
+			Op:    "add",
+			Path:  path + "/annotations/" + escapeJSONPointer(name),
+			Value: annotations[name],
+		})
+	}
+	return added
+}
+
+// defaultRequests returns the patches assigning the configured default
+// requests to the container with resources at path, for the resources it has
+// no request for. Missing resources and requests objects are created, since
+// JSON Patch can't add to an object that isn't there. Resources removed by
+// the resource policy get no default.
+func defaultRequests(cfg *Config, path string, resources corev1.ResourceRequirements) []patchOperation {
+	missing := corev1.ResourceList{}
+	for name, q := range cfg.DefaultRequests {
+		if _, ok := resources.Requests[name]; !ok && requestAction(cfg, cfg.resourceAction(name)) != policyRemove {
+			missing[name] = q
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	switch {
+	case resources.Requests == nil && resources.Limits == nil && resources.Claims == nil:
+		// resources is missing or empty, so it can be replaced as a whole
+		return []patchOperation{{
+			Op:    "add",
+			Path:  path,
+			Value: corev1.ResourceRequirements{Requests: missing},
+		}}
+	case resources.Requests == nil:
+		return []patchOperation{{
+			Op:    "add",
+			Path:  path + "/requests",
+			Value: missing,
+		}}
+	}
+	var patches []patchOperation
+	for _, name := range slices.Sorted(maps.Keys(missing)) {
+		q := missing[name]
+		patches = append(patches, patchOperation{
+			Op:    "add",
+			Path:  path + "/requests/" + escapeJSONPointer(string(name)),
+			Value: q.String(),
+		})
+	}
+	return patches
+}
+
+// patchedRequests returns the requests at path as they are once patches are
+// applied, including the defaults for missing requests.
+func patchedRequests(cfg *Config, path string, requests corev1.ResourceList, patches []patchOperation) corev1.ResourceList {
+	patched := corev1.ResourceList{}
+	for name, q := range requests {
+		patched[name] = q
+		for _, p := range patches {
+			if p.Path != path+"/"+escapeJSONPointer(string(name)) {
+				continue
+			}
+			if value, ok := p.Value.(string); ok {
+				patched[name] = resource.MustParse(value)
+			} else if p.Op == "remove" {
+				delete(patched, name)
+			}
+		}
+	}
+	for name, q := range cfg.DefaultRequests {
+		if _, ok := requests[name]; !ok && requestAction(cfg, cfg.resourceAction(name)) != policyRemove {
+			patched[name] = q
+		}
+	}
+	return patched
+}
+
+// reduceResourceList returns the patches applying the resource policy to the
+// requests or limits in list, found at path. actionFor maps the policy action
+// of a resource to what's done with it in list. Reduced values aren't lowered
+// below those in atLeast, so limits stay at or above requests that weren't
+// reduced as far, e.g. below MinReduceCPU. It also reports whether any
+// resource was removed.
+func reduceResourceList(cfg *Config, path string, list corev1.ResourceList, actionFor func(*Config, string) string, floors resourceFloors, atLeast corev1.ResourceList) ([]patchOperation, bool) {
+	var patches []patchOperation
+	removed := false
+	for _, rule := range cfg.resourceRules(list) {
+		q, ok := list[rule.name]
+		if !ok {
+			continue
+		}
+		resourcePath := path + "/" + escapeJSONPointer(string(rule.name))
+		switch actionFor(cfg, rule.action) {
+		case policyReduce:
+			if value, ok := reduceQuantity(cfg, rule.name, q, floors); ok {
+				if request, ok := atLeast[rule.name]; ok && request.Cmp(resource.MustParse(value)) > 0 {
+					// The API server rejects a limit below its request
+					if request.Cmp(q) >= 0 {
+						continue
+					}
+					value = request.String()
+				}
+				patches = append(patches, patchOperation{
+					Op:        "replace",
+					Path:      resourcePath,
+					Value:     value,
+					reclaimed: reclaimed(path, rule.name, q, resource.MustParse(value)),
+				})
+			}
+		case policyRemove:
+			patches = append(patches, patchOperation{
+				Op:        "remove",
+				Path:      resourcePath,
+				reclaimed: reclaimed(path, rule.name, q, resource.Quantity{}),
+			})
+			removed = true
+		}
+	}
+	return patches, removed
+}
+
+// reclaimed returns the CPU millicores or memory bytes freed by lowering the
+// resource name in the list at path from original to reduced. Only requests
+// reserve capacity, so lowering limits frees nothing.
+func reclaimed(path string, name corev1.ResourceName, original, reduced resource.Quantity) int64 {
+	if !strings.HasSuffix(path, "/requests") {
+		return 0
+	}
+	switch name {
+	case corev1.ResourceCPU:
+		return original.MilliValue() - reduced.MilliValue()
+	case corev1.ResourceMemory:
+		return original.Value() - reduced.Value()
+	}
+	return 0
+}
+
+// cpuResizeWithoutRestart returns the patches setting the CPU resize policy
+// of containers, found at basePath in the object, to NotRequired, so later
+// in-place CPU resizes don't restart them. Containers rejected by filter are
+// left alone.
+func cpuResizeWithoutRestart(basePath string, containers []corev1.Container, filter containerFilter) []patchOperation {
+	notRequired := corev1.ContainerResizePolicy{
+		ResourceName:  corev1.ResourceCPU,
+		RestartPolicy: corev1.NotRequired,
+	}
+	var patches []patchOperation
+	for i, container := range containers {
+		if filter.skips(container) {
+			continue
+		}
+		path := fmt.Sprintf("%s/%d/resizePolicy", basePath, i)
+		j := slices.IndexFunc(container.ResizePolicy, func(p corev1.ContainerResizePolicy) bool {
+			return p.ResourceName == corev1.ResourceCPU
+		})
+		switch {
+		case container.ResizePolicy == nil:
+			patches = append(patches, patchOperation{
+				Op:    "add",
+				Path:  path,
+				Value: []corev1.ContainerResizePolicy{notRequired},
+			})
+		case j < 0:
+			patches = append(patches, patchOperation{
+				Op:    "add",
+				Path:  path + "/-",
+				Value: notRequired,
+			})
+		case container.ResizePolicy[j].RestartPolicy != corev1.NotRequired:
+			patches = append(patches, patchOperation{
+				Op:    "replace",
+				Path:  fmt.Sprintf("%s/%d/restartPolicy", path, j),
+				Value: corev1.NotRequired,
+			})
+		}
+	}
+	return patches
+}
+
+// removeResourceClaims removes the Dynamic Resource Allocation claims of the
+// pod and the references to them from its containers, so pods don't stay
+// Pending when the DRA driver is missing.
+func removeResourceClaims(pod *corev1.Pod) []patchOperation {
+	var patches []patchOperation
+	for _, containers := range []struct {
+		path       string
+		containers []corev1.Container
+	}{
+		{"/spec/containers", pod.Spec.Containers},
+		{"/spec/initContainers", pod.Spec.InitContainers},
+	} {
+		for i, container := range containers.containers {
+			if len(container.Resources.Claims) > 0 {
+				patches = append(patches, patchOperation{
+					Op:   "remove",
+					Path: fmt.Sprintf("%s/%d/resources/claims", containers.path, i),
+				})
+			}
+		}
+	}
+	if len(pod.Spec.ResourceClaims) > 0 {
+		patches = append(patches, patchOperation{
+			Op:   "remove",
+			Path: "/spec/resourceClaims",
+		})
+	}
+	if len(patches) > 0 {
+		slog.Debug("Removing resource claims", "namespace", pod.Namespace, "name", pod.Name)
+	}
+	return patches
+}
+
+// requestAction returns the action taken on a request under the policy
+// action, which RemoveRequests turns from reducing into removing.
+func requestAction(cfg *Config, action string) string {
+	switch {
+	case action == policyReduce && cfg.RemoveRequests:
+		return policyRemove
+	case action == policyRemoveLimits:
+		return policyLeave
+	}
+	return action
+}
+
+// limitAction returns the action taken on a limit under the policy action.
+// Limits are removed unless the resource is left alone or KeepLimits is set.
+// With ReduceLimits, limits of reduced resources are reduced like requests,
+// so they stay above them.
+func limitAction(cfg *Config, action string) string {
+	switch {
+	case action == policyLeave || cfg.KeepLimits:
+		return policyLeave
+	case action == policyReduce && cfg.ReduceLimits:
+		return policyReduce
+	}
+	return policyRemove
+}
+
+// bestEffort reports whether resources are left without CPU and memory
+// requests and limits once the policy is applied.
+func bestEffort(cfg *Config, resources corev1.ResourceRequirements) bool {
+	for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+		action := cfg.resourceAction(name)
+		if _, ok := resources.Requests[name]; ok && requestAction(cfg, action) != policyRemove {
+			return false
+		}
+		if _, ok := resources.Limits[name]; ok && limitAction(cfg, action) != policyRemove {
+			return false
+		}
+		// A missing request gets the default
+		if _, ok := cfg.DefaultRequests[name]; ok && requestAction(cfg, action) != policyRemove {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeJSONPointer escapes a reference token of a JSON Pointer, such as the
+// name of an extended resource.
+func escapeJSONPointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+// Reduction modes.
+const (
+	// reductionModeProportional reduces requests to 20%.
+	reductionModeProportional = "proportional"
+	// reductionModeCap lowers requests above the configured caps to the cap
+	// and leaves smaller requests alone.
+	reductionModeCap = "cap"
+)
+
+// reductionDescription describes the reduction with floors for logging.
+func reductionDescription(cfg *Config, floors resourceFloors) string {
+	if cfg.ReductionMode == reductionModeCap {
+		return fmt.Sprintf("Capping requests at %s CPU and %s memory", cfg.CPUCap.String(), cfg.MemoryCap.String())
+	}
+	return fmt.Sprintf("Reducing requests to %g%%", floors.ratio()*100)
+}
+
+// reduceQuantity returns the reduced request of the resource name in
+// canonical Kubernetes notation (e.g. "200m", "64Mi"), or false if the
+// request is left as is. CPU and memory requests below MinReduceCPU and
+// MinReduceMemory are left as is. Caps only apply to CPU and memory, other
+// resources are always reduced proportionally to at least 1. Requests already
+// at or below the reduced value, e.g. at the floor, are left as is so they
+// don't show up as no-op replace operations, and are never raised.
+func reduceQuantity(cfg *Config, name corev1.ResourceName, q resource.Quantity, floors resourceFloors) (string, bool) {
+	if minReduce, ok := minReduceRequest(cfg, name); ok && q.Cmp(minReduce) < 0 {
+		return "", false
+	}
+
+	var value string
+	var ok bool
+	switch name {
+	case corev1.ResourceCPU:
+		value, ok = reduceCPU(cfg, q, floors)
+	case corev1.ResourceMemory:
+		value, ok = reduceMemory(cfg, q, floors)
+	case corev1.ResourceEphemeralStorage:
+		value, ok = reduceEphemeralStorage(q, floors)
+	default:
+		reduced := floors.reduce(q.Value())
+		if reduced < 1 {
+			reduced = 1
+		}
+		value, ok = resource.NewQuantity(reduced, q.Format).String(), true
+	}
+	if !ok {
+		return "", false
+	}
+	if reduced := resource.MustParse(value); reduced.Cmp(q) >= 0 {
+		return "", false
+	}
+	return value, true
+}
+
+// minReduceRequest returns the request of the resource name below which it
+// isn't reduced at all, if configured.
+func minReduceRequest(cfg *Config, name corev1.ResourceName) (resource.Quantity, bool) {
+	var minReduce resource.Quantity
+	switch name {
+	case corev1.ResourceCPU:
+		minReduce = cfg.MinReduceCPU
+	case corev1.ResourceMemory:
+		minReduce = cfg.MinReduceMemory
+	}
+	return minReduce, !minReduce.IsZero()
+}
+
+// reduceCPU returns the reduced CPU request, or false if the request is left
+// as is. Reductions, including caps, are at least the CPU floor.
+func reduceCPU(cfg *Config, cpu resource.Quantity, floors resourceFloors) (string, bool) {
+	minMillis := floors.cpuMillis
+	if cfg.ReductionMode == reductionModeCap {
+		capMillis := max(atMost(cfg.CPUCap.MilliValue(), floors.maxCPUMillis), minMillis)
+		if cpu.MilliValue() <= capMillis {
+			return "", false
+		}
+		return resource.NewMilliQuantity(capMillis, resource.DecimalSI).String(), true
+	}
+
+	reducedCPU := atMost(floors.reduce(cpu.MilliValue()), floors.maxCPUMillis)
+	if reducedCPU < minMillis {
+		reducedCPU = minMillis
+	}
+	return resource.NewMilliQuantity(reducedCPU, resource.DecimalSI).String(), true
+}
+
+// reduceMemory returns the reduced memory request, or false if the request is
+// left as is. Proportional reductions are rounded according to the
+// configured MemoryRounding. Reductions, including caps, are at least the
+// memory floor.
+func reduceMemory(cfg *Config, mem resource.Quantity, floors resourceFloors) (string, bool) {
+	minBytes := floors.memoryBytes
+	if cfg.ReductionMode == reductionModeCap {
+		capBytes := max(atMost(cfg.MemoryCap.Value(), floors.maxMemoryBytes), minBytes)
+		if mem.Value() <= capBytes {
+			return "", false
+		}
+		return resource.NewQuantity(capBytes, resource.BinarySI).String(), true
+	}
+
+	reducedMem := roundMemory(atMost(floors.reduce(mem.Value()), floors.maxMemoryBytes), cfg.MemoryRounding, cfg.MemoryAlignment.Value())
+	if reducedMem < minBytes {
+		reducedMem = minBytes
+	}
+	return resource.NewQuantity(reducedMem, resource.BinarySI).String(), true
+}
+
+// reduceEphemeralStorage returns the ephemeral storage request reduced
+// proportionally, to at least 1Mi.
+func reduceEphemeralStorage(storage resource.Quantity, floors resourceFloors) (string, bool) {
+	reduced := floors.reduce(storage.Value())
+	if reduced < minEphemeralStorageBytes {
+		reduced = minEphemeralStorageBytes
+	}
+	return resource.NewQuantity(reduced, resource.BinarySI).String(), true
+}
+
+// Memory rounding modes, rounding reduced memory to a multiple of the
+// memory alignment.
+const (
+	memoryRoundingNone    = "none"
+	memoryRoundingDown    = "down"
+	memoryRoundingNearest = "nearest"
+	memoryRoundingUp      = "up"
+)
+
+// roundMemory rounds bytes to a multiple of alignment according to mode.
+func roundMemory(bytes int64, mode string, alignment int64) int64 {
+	switch mode {
+	case memoryRoundingDown:
+		return bytes / alignment * alignment
+	case memoryRoundingNearest:
+		return (bytes + alignment/2) / alignment * alignment
+	case memoryRoundingUp:
+		return (bytes + alignment - 1) / alignment * alignment
+	default:
+		return bytes
+	}
+}
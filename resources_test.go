@@ -0,0 +1,1104 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestReduceMemoryRounding(t *testing.T) {
+	tests := []struct {
+		mode   string
+		memory string
+		want   string
+	}{
+		{memoryRoundingNone, "1001Mi", "209924915"},
+		{memoryRoundingDown, "1001Mi", "200Mi"},
+		{memoryRoundingNearest, "1001Mi", "200Mi"},
+		{memoryRoundingNearest, "1003Mi", "201Mi"},
+		{memoryRoundingUp, "1001Mi", "201Mi"},
+		{memoryRoundingUp, "1000Mi", "200Mi"},
+		// Rounding never goes below the floor
+		{memoryRoundingDown, "6Mi", "1Mi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.memory, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) { c.MemoryRounding = tt.mode })
+
+			got, ok := reduceQuantity(cfg, corev1.ResourceMemory, resource.MustParse(tt.memory), podFloors(cfg, &corev1.PodSpec{}))
+			if !ok || got != tt.want {
+				t.Errorf("reduceQuantity(cfg, %s) = %q, %t, want %q", tt.memory, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundMemory(t *testing.T) {
+	const ki, mi = 1024, 1024 * 1024
+	tests := []struct {
+		mode      string
+		bytes     int64
+		alignment int64
+		want      int64
+	}{
+		{memoryRoundingNone, 10000, 4 * ki, 10000},
+		{memoryRoundingDown, 10000, 4 * ki, 8 * ki},
+		{memoryRoundingNearest, 10000, 4 * ki, 8 * ki},
+		{memoryRoundingNearest, 10300, 4 * ki, 12 * ki},
+		{memoryRoundingUp, 8*ki + 1, 4 * ki, 12 * ki},
+		{memoryRoundingUp, 8 * ki, 4 * ki, 8 * ki},
+		{memoryRoundingDown, 201*mi + 1, 2 * mi, 200 * mi},
+		{memoryRoundingNearest, 201*mi - 1, 2 * mi, 200 * mi},
+		{memoryRoundingNearest, 201 * mi, 2 * mi, 202 * mi},
+		{memoryRoundingUp, 200*mi + 1, 2 * mi, 202 * mi},
+		// An alignment of a byte leaves every value as is
+		{memoryRoundingUp, 10000, 1, 10000},
+	}
+	for _, tt := range tests {
+		if got := roundMemory(tt.bytes, tt.mode, tt.alignment); got != tt.want {
+			t.Errorf("roundMemory(%d, %s, %d) = %d, want %d", tt.bytes, tt.mode, tt.alignment, got, tt.want)
+		}
+	}
+}
+
+func TestReduceMemoryAlignment(t *testing.T) {
+	tests := []struct {
+		mode      string
+		alignment string
+		memory    string
+		want      string
+	}{
+		{memoryRoundingNone, "2Mi", "1001Mi", "209924915"},
+		{memoryRoundingDown, "2Mi", "1001Mi", "200Mi"},
+		{memoryRoundingUp, "2Mi", "1001Mi", "202Mi"},
+		{memoryRoundingUp, "4Ki", "1001Mi", "205008Ki"},
+		// Rounding down to the alignment never goes below the floor
+		{memoryRoundingDown, "2Mi", "6Mi", "1Mi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+" "+tt.alignment+" "+tt.memory, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {
+				c.MemoryRounding = tt.mode
+				c.MemoryAlignment = resource.MustParse(tt.alignment)
+			})
+
+			got, ok := reduceQuantity(cfg, corev1.ResourceMemory, resource.MustParse(tt.memory), podFloors(cfg, &corev1.PodSpec{}))
+			if !ok || got != tt.want {
+				t.Errorf("reduceQuantity(cfg, %s) = %q, %t, want %q", tt.memory, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestReduceQuantityCap(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource corev1.ResourceName
+		request  string
+		want     string
+	}{
+		{"cpu above cap", corev1.ResourceCPU, "2", "100m"},
+		{"cpu at cap", corev1.ResourceCPU, "100m", ""},
+		{"cpu below cap", corev1.ResourceCPU, "50m", ""},
+		{"memory above cap", corev1.ResourceMemory, "1Gi", "128Mi"},
+		{"memory below cap", corev1.ResourceMemory, "64Mi", ""},
+		// Other resources are still reduced proportionally
+		{"ephemeral storage", corev1.ResourceEphemeralStorage, "10Gi", "2Gi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) { c.ReductionMode = reductionModeCap })
+
+			got, ok := reduceQuantity(cfg, tt.resource, resource.MustParse(tt.request), podFloors(cfg, &corev1.PodSpec{}))
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("reduceQuantity(cfg, %s) = %q, %t, want %q", tt.request, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerFilter(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+	}{
+		{
+			name: "no annotations",
+			want: []string{"app", "sidecar", "istio-proxy"},
+		},
+		{
+			name:        "skip containers",
+			annotations: map[string]string{skipContainersAnnotation: "sidecar, istio-proxy"},
+			want:        []string{"app"},
+		},
+		{
+			name:        "only containers",
+			annotations: map[string]string{onlyContainersAnnotation: "app"},
+			want:        []string{"app"},
+		},
+		{
+			name: "only containers take precedence",
+			annotations: map[string]string{
+				skipContainersAnnotation: "app",
+				onlyContainersAnnotation: "app,sidecar",
+			},
+			want: []string{"app", "sidecar"},
+		},
+		{
+			name:        "image pattern",
+			annotations: map[string]string{skipImagePatternAnnotation: "^docker.io/istio/"},
+			want:        []string{"app", "sidecar"},
+		},
+		{
+			name:        "invalid image pattern",
+			annotations: map[string]string{skipImagePatternAnnotation: "("},
+			want:        []string{"app", "sidecar", "istio-proxy"},
+		},
+	}
+	containers := []corev1.Container{
+		{Name: "app", Image: "europe-north1-docker.pkg.dev/nais-io/nais/app:latest"},
+		{Name: "sidecar", Image: "europe-north1-docker.pkg.dev/nais-io/nais/sidecar:latest"},
+		{Name: "istio-proxy", Image: "docker.io/istio/proxyv2:1.24.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := newContainerFilter(&metav1.ObjectMeta{}, tt.annotations)
+			var got []string
+			for _, container := range containers {
+				if !filter.skips(container) {
+					got = append(got, container.Name)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("reduced containers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReduceCPU(t *testing.T) {
+	tests := []struct {
+		cpu  string
+		want string
+	}{
+		{"1", "200m"},
+		{"1.5", "300m"},
+		{"0.25", "50m"},
+		{"2500m", "500m"},
+		// Whole cores stay cores
+		{"60", "12"},
+		// Never below the floor
+		{"0.001", "1m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cpu, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {})
+
+			got, ok := reduceCPU(cfg, resource.MustParse(tt.cpu), podFloors(cfg, &corev1.PodSpec{}))
+			if !ok || got != tt.want {
+				t.Errorf("reduceCPU(cfg, %s) = %q, %t, want %q", tt.cpu, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSkips(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		concern     string
+		want        bool
+	}{
+		{nil, skipResources, false},
+		{map[string]string{skipAnnotation: "true"}, skipResources, true},
+		{map[string]string{skipAnnotation: "all"}, skipHPA, true},
+		{map[string]string{skipAnnotation: "replicas, hpa"}, skipHPA, true},
+		{map[string]string{skipAnnotation: "replicas,hpa"}, skipResources, false},
+		{map[string]string{skipAnnotation: "false"}, skipResources, false},
+		{map[string]string{skipAnnotation: ""}, skipResources, false},
+	}
+	for _, tt := range tests {
+		if got := skips(tt.annotations, tt.concern); got != tt.want {
+			t.Errorf("skips(%v, %s) = %t, want %t", tt.annotations, tt.concern, got, tt.want)
+		}
+	}
+}
+
+func TestReduceEphemeralStorage(t *testing.T) {
+	tests := []struct {
+		request     string
+		wantRequest string
+	}{
+		{"10Gi", "2Gi"},
+		{"100Mi", "20Mi"},
+		// Never below 1Mi
+		{"2Mi", "1Mi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.request, func(t *testing.T) {
+			withConfig(t, func(c *Config) {})
+
+			resources := corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse(tt.request)},
+				Limits:   corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse("20Gi")},
+			}
+			container := corev1.Container{Name: "app", Resources: resources}
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{container}}}
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			got := result.Spec.Containers[0].Resources
+			if storage := got.Requests[corev1.ResourceEphemeralStorage]; storage.Cmp(resource.MustParse(tt.wantRequest)) != 0 {
+				t.Errorf("ephemeral-storage request = %s, want %s", storage.String(), tt.wantRequest)
+			}
+			if _, ok := got.Limits[corev1.ResourceEphemeralStorage]; ok {
+				t.Errorf("limits = %v, want ephemeral-storage removed", got.Limits)
+			}
+		})
+	}
+}
+
+func TestRemoveResourceClaims(t *testing.T) {
+	template := "gpu"
+	claimed := func() *corev1.Pod {
+		pod := testPod(2)
+		pod.Spec.ResourceClaims = []corev1.PodResourceClaim{{Name: "gpu", ResourceClaimTemplateName: &template}}
+		pod.Spec.Containers[1].Resources.Claims = []corev1.ResourceClaim{{Name: "gpu"}}
+		return pod
+	}
+	tests := []struct {
+		name       string
+		remove     bool
+		pod        *corev1.Pod
+		wantClaims int
+	}{
+		{name: "kept by default", pod: claimed(), wantClaims: 1},
+		{name: "removed", remove: true, pod: claimed()},
+		{name: "without claims", remove: true, pod: testPod(1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.RemoveResourceClaims = tt.remove })
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", tt.pod), &result)
+			if got := len(result.Spec.ResourceClaims); got != tt.wantClaims {
+				t.Errorf("pod resource claims = %d, want %d", got, tt.wantClaims)
+			}
+			containerClaims := 0
+			for _, c := range result.Spec.Containers {
+				containerClaims += len(c.Resources.Claims)
+			}
+			if containerClaims != tt.wantClaims {
+				t.Errorf("container resource claims = %d, want %d", containerClaims, tt.wantClaims)
+			}
+		})
+	}
+}
+
+func TestReduceQuantityAtFloor(t *testing.T) {
+	tests := []struct {
+		resource corev1.ResourceName
+		request  string
+		want     string
+	}{
+		{corev1.ResourceCPU, "1m", ""},
+		{corev1.ResourceCPU, "3m", "1m"},
+		{corev1.ResourceMemory, "1Mi", ""},
+		// Requests below the floor are never raised
+		{corev1.ResourceMemory, "512Ki", ""},
+		{corev1.ResourceEphemeralStorage, "1Mi", ""},
+		{"nvidia.com/gpu", "1", ""},
+		{"nvidia.com/gpu", "10", "2"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.resource)+" "+tt.request, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {})
+
+			got, ok := reduceQuantity(cfg, tt.resource, resource.MustParse(tt.request), podFloors(cfg, &corev1.PodSpec{}))
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("reduceQuantity(cfg, %s) = %q, %t, want %q", tt.request, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestCPUResizeWithoutRestart(t *testing.T) {
+	notRequired := corev1.ContainerResizePolicy{ResourceName: corev1.ResourceCPU, RestartPolicy: corev1.NotRequired}
+	memory := corev1.ContainerResizePolicy{ResourceName: corev1.ResourceMemory, RestartPolicy: corev1.RestartContainer}
+	tests := []struct {
+		name   string
+		policy []corev1.ContainerResizePolicy
+		want   []corev1.ContainerResizePolicy
+	}{
+		{name: "none", want: []corev1.ContainerResizePolicy{notRequired}},
+		{
+			name:   "memory only",
+			policy: []corev1.ContainerResizePolicy{memory},
+			want:   []corev1.ContainerResizePolicy{memory, notRequired},
+		},
+		{
+			name:   "restart",
+			policy: []corev1.ContainerResizePolicy{memory, {ResourceName: corev1.ResourceCPU, RestartPolicy: corev1.RestartContainer}},
+			want:   []corev1.ContainerResizePolicy{memory, notRequired},
+		},
+		{
+			name:   "already not required",
+			policy: []corev1.ContainerResizePolicy{notRequired},
+			want:   []corev1.ContainerResizePolicy{notRequired},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.SetResizePolicy = true })
+
+			pod := testPod(1)
+			pod.Spec.Containers[0].ResizePolicy = tt.policy
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			if got := result.Spec.Containers[0].ResizePolicy; !slices.Equal(got, tt.want) {
+				t.Errorf("resizePolicy = %v, want %v", got, tt.want)
+			}
+			// Init containers can't be resized
+			if got := result.Spec.InitContainers[0].ResizePolicy; got != nil {
+				t.Errorf("init container resizePolicy = %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestPodFloorsLimitRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		minCPU     string
+		minMemory  string
+		windows    bool
+		wantCPU    int64
+		wantMemory int64
+	}{
+		{name: "defaults", wantCPU: 1, wantMemory: 1 << 20},
+		{name: "limit range", minCPU: "10m", minMemory: "16Mi", wantCPU: 10, wantMemory: 16 << 20},
+		{name: "below the floors", minCPU: "0", minMemory: "512Ki", wantCPU: 1, wantMemory: 1 << 20},
+		{name: "windows", minCPU: "10m", minMemory: "512Mi", windows: true, wantCPU: 100, wantMemory: 512 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {
+				if tt.minCPU != "" {
+					c.LimitRangeMinCPU = resource.MustParse(tt.minCPU)
+				}
+				if tt.minMemory != "" {
+					c.LimitRangeMinMemory = resource.MustParse(tt.minMemory)
+				}
+			})
+
+			spec := &corev1.PodSpec{}
+			if tt.windows {
+				spec.OS = &corev1.PodOS{Name: corev1.Windows}
+			}
+			floors := podFloors(cfg, spec)
+			if floors.cpuMillis != tt.wantCPU || floors.memoryBytes != tt.wantMemory {
+				t.Errorf("podFloors(cfg) = %dm, %d bytes, want %dm, %d bytes", floors.cpuMillis, floors.memoryBytes, tt.wantCPU, tt.wantMemory)
+			}
+		})
+	}
+}
+
+func TestReduceQuantityFormat(t *testing.T) {
+	tests := []struct {
+		resource corev1.ResourceName
+		request  string
+		want     string
+	}{
+		{corev1.ResourceCPU, "10", "2"},
+		{corev1.ResourceCPU, "10000m", "2"},
+		{corev1.ResourceCPU, "1500m", "300m"},
+		{corev1.ResourceMemory, "10Gi", "2Gi"},
+		{corev1.ResourceMemory, "640Mi", "128Mi"},
+		// Memory is formatted in binary units, decimal ones end up in bytes
+		{corev1.ResourceMemory, "5G", "1000000000"},
+		{corev1.ResourceEphemeralStorage, "5Gi", "1Gi"},
+		{"nvidia.com/gpu", "5", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.resource)+" "+tt.request, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {})
+
+			got, ok := reduceQuantity(cfg, tt.resource, resource.MustParse(tt.request), podFloors(cfg, &corev1.PodSpec{}))
+			if !ok || got != tt.want {
+				t.Errorf("reduceQuantity(cfg, %s) = %q, %t, want %q", tt.request, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMinMemory(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    map[string]string
+		wantErr bool
+	}{
+		{val: "300Mi", want: map[string]string{"": "300Mi"}},
+		{val: " 1Gi ", want: map[string]string{"": "1Gi"}},
+		{val: "app=300Mi, sidecar = 64Mi,", want: map[string]string{"app": "300Mi", "sidecar": "64Mi"}},
+		{val: "lots", wantErr: true},
+		{val: "app=300Mi,64Mi", wantErr: true},
+		{val: "=300Mi", wantErr: true},
+		{val: "app=lots", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseMinMemory(tt.val)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseMinMemory(%q) error = %v, want error: %t", tt.val, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseMinMemory(%q) = %v, want %v", tt.val, got, tt.want)
+			continue
+		}
+		for name, want := range tt.want {
+			if q, ok := got[name]; !ok || q.Cmp(resource.MustParse(want)) != 0 {
+				t.Errorf("parseMinMemory(%q)[%q] = %v, want %s", tt.val, name, got[name], want)
+			}
+		}
+	}
+}
+
+func TestMinMemory(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ratio       float64
+		// want is the memory request of container-0 and container-1
+		want [2]string
+	}{
+		{name: "none", ratio: 1, want: [2]string{"107374182", "107374182"}},
+		{name: "all containers", annotations: map[string]string{minMemoryAnnotation: "300Mi"}, ratio: 1, want: [2]string{"300Mi", "300Mi"}},
+		{name: "ratio", annotations: map[string]string{minMemoryAnnotation: "300Mi"}, ratio: 0.5, want: [2]string{"150Mi", "150Mi"}},
+		{name: "single container", annotations: map[string]string{minMemoryAnnotation: "container-0=300Mi"}, ratio: 1, want: [2]string{"300Mi", "107374182"}},
+		{name: "not above request", annotations: map[string]string{minMemoryAnnotation: "2Gi"}, ratio: 1, want: [2]string{"512Mi", "512Mi"}},
+		{
+			name:        "startup memory ignores ratio",
+			annotations: map[string]string{minMemoryAnnotation: "300Mi", startupMemoryAnnotation: "container-1=400Mi"},
+			ratio:       0.5,
+			want:        [2]string{"150Mi", "400Mi"},
+		},
+		{name: "invalid", annotations: map[string]string{minMemoryAnnotation: "lots"}, ratio: 1, want: [2]string{"107374182", "107374182"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.MemoryRequestFloorRatio = tt.ratio })
+
+			pod := testPod(2)
+			maps.Copy(pod.Annotations, tt.annotations)
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			for i, want := range tt.want {
+				got := result.Spec.Containers[i].Resources.Requests[corev1.ResourceMemory]
+				if got.Cmp(resource.MustParse(want)) != 0 {
+					t.Errorf("%s memory request = %s, want %s", result.Spec.Containers[i].Name, got.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestRatioAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		set         func(c *Config)
+		annotations map[string]string
+		// noAnnotations drops the annotations of the pod
+		noAnnotations bool
+		want          map[string]string
+	}{
+		{name: "disabled", set: func(c *Config) {}},
+		{
+			name: "enabled",
+			set:  func(c *Config) { c.AnnotateReductionRatio = true },
+			want: map[string]string{cpuRatioAnnotation: "0.2", memoryRatioAnnotation: "0.2"},
+		},
+		{
+			name:          "without annotations",
+			set:           func(c *Config) { c.AnnotateReductionRatio = true },
+			noAnnotations: true,
+			want:          map[string]string{cpuRatioAnnotation: "0.2", memoryRatioAnnotation: "0.2"},
+		},
+		{
+			name:        "aggressive",
+			set:         func(c *Config) { c.AnnotateReductionRatio = true },
+			annotations: map[string]string{aggressiveAnnotation: "true"},
+			want:        map[string]string{cpuRatioAnnotation: "0.05", memoryRatioAnnotation: "0.05"},
+		},
+		{
+			name: "cap",
+			set: func(c *Config) {
+				c.AnnotateReductionRatio = true
+				c.ReductionMode = reductionModeCap
+			},
+		},
+		{
+			name: "nothing reduced",
+			set: func(c *Config) {
+				c.AnnotateReductionRatio = true
+				c.RemoveRequests = true
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, tt.set)
+
+			pod := testPod(1)
+			maps.Copy(pod.Annotations, tt.annotations)
+			if tt.noAnnotations {
+				pod.Annotations = nil
+			}
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			for _, name := range []string{cpuRatioAnnotation, memoryRatioAnnotation} {
+				got, ok := result.Annotations[name]
+				want, wantOK := tt.want[name]
+				if ok != wantOK || got != want {
+					t.Errorf("annotation %s = %q (set: %t), want %q (set: %t)", name, got, ok, want, wantOK)
+				}
+			}
+		})
+	}
+}
+
+func TestAddAnnotations(t *testing.T) {
+	annotations := map[string]string{"b": "2", "example.com/a": "1"}
+	tests := []struct {
+		name     string
+		existing map[string]string
+		patches  []patchOperation
+		want     []patchOperation
+	}{
+		{
+			name: "no annotations",
+			want: []patchOperation{{Op: "add", Path: "/metadata/annotations", Value: annotations}},
+		},
+		{
+			name:     "existing annotations",
+			existing: map[string]string{"c": "3"},
+			want: []patchOperation{
+				{Op: "add", Path: "/metadata/annotations/b", Value: "2"},
+				{Op: "add", Path: "/metadata/annotations/example.com~1a", Value: "1"},
+			},
+		},
+		{
+			name:    "annotations added by an earlier patch",
+			patches: []patchOperation{{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}}},
+			want: []patchOperation{
+				{Op: "add", Path: "/metadata/annotations/b", Value: "2"},
+				{Op: "add", Path: "/metadata/annotations/example.com~1a", Value: "1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := addAnnotations("/metadata", tt.existing, tt.patches, annotations)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("addAnnotations() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := addAnnotations("/metadata", nil, nil, nil); got != nil {
+		t.Errorf("addAnnotations() without annotations = %v, want none", got)
+	}
+}
+
+func TestMutatePodOnlyContainers(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		// wantReduced lists whether init, container-0 and container-1 are
+		// reduced
+		wantReduced [3]bool
+	}{
+		{name: "none", wantReduced: [3]bool{true, true, true}},
+		{name: "only", annotations: map[string]string{onlyContainersAnnotation: "container-1"}, wantReduced: [3]bool{false, false, true}},
+		{
+			name: "only wins over skip",
+			annotations: map[string]string{
+				onlyContainersAnnotation: "container-1",
+				skipContainersAnnotation: "container-1",
+			},
+			wantReduced: [3]bool{false, false, true},
+		},
+		{
+			name: "empty only list",
+			annotations: map[string]string{
+				onlyContainersAnnotation: " , ",
+				skipContainersAnnotation: "container-1",
+			},
+			wantReduced: [3]bool{true, true, false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {})
+
+			pod := testPod(2)
+			maps.Copy(pod.Annotations, tt.annotations)
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			containers := append(result.Spec.InitContainers, result.Spec.Containers...)
+			for i, container := range containers {
+				cpu := container.Resources.Requests[corev1.ResourceCPU]
+				if reduced := cpu.Cmp(resource.MustParse("250m")) < 0; reduced != tt.wantReduced[i] {
+					t.Errorf("%s cpu request = %s, want reduced: %t", container.Name, cpu.String(), tt.wantReduced[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultRequests(t *testing.T) {
+	defaults := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("10m"),
+		corev1.ResourceMemory: resource.MustParse("16Mi"),
+	}
+	tests := []struct {
+		name      string
+		policy    string
+		resources corev1.ResourceRequirements
+		want      corev1.ResourceList
+	}{
+		{name: "best effort", want: defaults},
+		{
+			name:      "empty requests",
+			resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{}},
+			want:      defaults,
+		},
+		{
+			name:      "cpu request only",
+			resources: corev1.ResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")}},
+			// The defaults aren't reduced, existing requests are
+			want: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("100m"),
+				corev1.ResourceMemory: resource.MustParse("16Mi"),
+			},
+		},
+		{
+			name:   "removed by the policy",
+			policy: "cpu=reduce,memory=remove",
+			want:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.DefaultRequests = defaults
+				if tt.policy != "" {
+					policy, err := parseResourcePolicy(tt.policy)
+					if err != nil {
+						t.Fatal(err)
+					}
+					c.ResourcePolicy = policy
+				}
+			})
+
+			pod := testPod(1)
+			pod.Spec.InitContainers = nil
+			pod.Spec.Containers[0].Resources = tt.resources
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			if got := result.Spec.Containers[0].Resources.Requests; !equality.Semantic.DeepEqual(got, tt.want) {
+				t.Errorf("requests = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultRequestsLimitsOnly(t *testing.T) {
+	limits := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse("1"),
+		corev1.ResourceMemory: resource.MustParse("1Gi"),
+	}
+	tests := []struct {
+		name       string
+		set        func(c *Config)
+		wantLimits corev1.ResourceList
+	}{
+		{name: "limits removed", set: func(c *Config) {}},
+		{name: "limits kept", set: func(c *Config) { c.KeepLimits = true }, wantLimits: limits},
+		{
+			// Limits aren't reduced below the default requests
+			name: "limits reduced",
+			set:  func(c *Config) { c.ReduceLimits = true },
+			wantLimits: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("200m"),
+				corev1.ResourceMemory: resource.MustParse("214748364"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, func(c *Config) {
+				c.DefaultRequests = corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("10m"),
+					corev1.ResourceMemory: resource.MustParse("16Mi"),
+				}
+				tt.set(c)
+			})
+
+			pod := testPod(1)
+			pod.Spec.InitContainers = nil
+			pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{Limits: limits}
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			got := result.Spec.Containers[0].Resources
+			if !equality.Semantic.DeepEqual(got.Requests, cfg.DefaultRequests) {
+				t.Errorf("requests = %v, want %v", got.Requests, cfg.DefaultRequests)
+			}
+			if !equality.Semantic.DeepEqual(got.Limits, tt.wantLimits) {
+				t.Errorf("limits = %v, want %v", got.Limits, tt.wantLimits)
+			}
+		})
+	}
+}
+
+func TestSelector(t *testing.T) {
+	// The pods and templates tested are labeled app=app
+	tests := []struct {
+		selector    string
+		wantReduced bool
+	}{
+		{selector: "", wantReduced: true},
+		{selector: "app=app", wantReduced: true},
+		{selector: "app in (app, worker)", wantReduced: true},
+		{selector: "tier=batch"},
+		{selector: "app!=app"},
+		{selector: "!app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			selector, err := labels.Parse(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			withConfig(t, func(c *Config) {
+				if tt.selector != "" {
+					c.Selector = selector
+				}
+			})
+
+			var pod corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", testPod(1)), &pod)
+			cpu := pod.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU]
+			if reduced := cpu.Cmp(resource.MustParse("250m")) < 0; reduced != tt.wantReduced {
+				t.Errorf("pod cpu request = %s, want reduced: %t", cpu.String(), tt.wantReduced)
+			}
+
+			var deployment appsv1.Deployment
+			admitInto(t, mutateDeployment, createRequest(t, "Deployment", testDeployment(nil)), &deployment)
+			cpu = deployment.Spec.Template.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU]
+			if reduced := cpu.Cmp(resource.MustParse("250m")) < 0; reduced != tt.wantReduced {
+				t.Errorf("template cpu request = %s, want reduced: %t", cpu.String(), tt.wantReduced)
+			}
+		})
+	}
+}
+
+func TestStartupMemory(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+	}{
+		{name: "none", want: "107374182"},
+		{name: "floor", annotations: map[string]string{startupMemoryAnnotation: "384Mi"}, want: "384Mi"},
+		{name: "single container", annotations: map[string]string{startupMemoryAnnotation: "container-0=384Mi"}, want: "384Mi"},
+		{name: "other container", annotations: map[string]string{startupMemoryAnnotation: "worker=384Mi"}, want: "107374182"},
+		{
+			name:        "higher than min-memory",
+			annotations: map[string]string{startupMemoryAnnotation: "384Mi", minMemoryAnnotation: "256Mi"},
+			want:        "384Mi",
+		},
+		{
+			name:        "lower than min-memory",
+			annotations: map[string]string{startupMemoryAnnotation: "96Mi", minMemoryAnnotation: "256Mi"},
+			want:        "128Mi",
+		},
+		{name: "invalid", annotations: map[string]string{startupMemoryAnnotation: "a lot"}, want: "107374182"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The ratio only scales min-memory
+			withConfig(t, func(c *Config) { c.MemoryRequestFloorRatio = 0.5 })
+
+			pod := testPod(1)
+			maps.Copy(pod.Annotations, tt.annotations)
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			if got := result.Spec.Containers[0].Resources.Requests[corev1.ResourceMemory]; got.Cmp(resource.MustParse(tt.want)) != 0 {
+				t.Errorf("pod memory request = %s, want %s", got.String(), tt.want)
+			}
+
+			deployment := testDeployment(nil)
+			deployment.Spec.Template.Annotations = tt.annotations
+			var reduced appsv1.Deployment
+			admitInto(t, mutateDeployment, createRequest(t, "Deployment", deployment), &reduced)
+			if got := reduced.Spec.Template.Spec.Containers[0].Resources.Requests[corev1.ResourceMemory]; got.Cmp(resource.MustParse(tt.want)) != 0 {
+				t.Errorf("template memory request = %s, want %s", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestFloorGuard(t *testing.T) {
+	tests := []struct {
+		name  string
+		guard int
+		// tiny lists the containers of testPod(3) given a 3m CPU request,
+		// which a reduction would floor
+		tiny        []int
+		annotations map[string]string
+		mode        string
+		wantReduced bool
+	}{
+		{name: "disabled", guard: 0, tiny: []int{0, 1, 2}, wantReduced: true},
+		{name: "below the count", guard: 2, tiny: []int{0, 1}, wantReduced: true},
+		{name: "above the count", guard: 1, tiny: []int{0, 1}},
+		{
+			name:        "skipped containers not counted",
+			guard:       1,
+			tiny:        []int{0, 1},
+			annotations: map[string]string{skipContainersAnnotation: "container-1"},
+			wantReduced: true,
+		},
+		{name: "cap mode", guard: 1, tiny: []int{0, 1}, mode: reductionModeCap, wantReduced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.FloorGuardCount = tt.guard
+				if tt.mode != "" {
+					c.ReductionMode = tt.mode
+				}
+			})
+
+			pod := testPod(3)
+			maps.Copy(pod.Annotations, tt.annotations)
+			for _, i := range tt.tiny {
+				pod.Spec.Containers[i].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("3m")
+			}
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			// The pod is reduced as a whole or not at all
+			cpu := result.Spec.Containers[2].Resources.Requests[corev1.ResourceCPU]
+			original := pod.Spec.Containers[2].Resources.Requests[corev1.ResourceCPU]
+			if reduced := cpu.Cmp(original) < 0; reduced != tt.wantReduced {
+				t.Errorf("cpu request = %s, want reduced: %t", cpu.String(), tt.wantReduced)
+			}
+		})
+	}
+}
+
+func TestMinReduce(t *testing.T) {
+	tests := []struct {
+		name       string
+		minCPU     string
+		minMemory  string
+		wantCPU    string
+		wantMemory string
+	}{
+		{name: "no thresholds", wantCPU: "50m", wantMemory: "107374182"},
+		{name: "cpu below threshold", minCPU: "300m", wantCPU: "250m", wantMemory: "107374182"},
+		{name: "cpu at threshold", minCPU: "250m", wantCPU: "50m", wantMemory: "107374182"},
+		{name: "memory below threshold", minMemory: "1Gi", wantCPU: "50m", wantMemory: "512Mi"},
+		{name: "memory above threshold", minMemory: "256Mi", wantCPU: "50m", wantMemory: "107374182"},
+		{name: "both below", minCPU: "1", minMemory: "1Gi", wantCPU: "250m", wantMemory: "512Mi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				if tt.minCPU != "" {
+					c.MinReduceCPU = resource.MustParse(tt.minCPU)
+				}
+				if tt.minMemory != "" {
+					c.MinReduceMemory = resource.MustParse(tt.minMemory)
+				}
+			})
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", testPod(1)), &result)
+			got := result.Spec.Containers[0].Resources
+			if cpu := got.Requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+				t.Errorf("cpu request = %s, want %s", cpu.String(), tt.wantCPU)
+			}
+			if memory := got.Requests[corev1.ResourceMemory]; memory.Cmp(resource.MustParse(tt.wantMemory)) != 0 {
+				t.Errorf("memory request = %s, want %s", memory.String(), tt.wantMemory)
+			}
+			// Limits are removed whether or not the requests are reduced
+			if len(got.Limits) > 0 {
+				t.Errorf("limits = %v, want none", got.Limits)
+			}
+		})
+	}
+}
+
+func TestPreserveCPUMemoryRatio(t *testing.T) {
+	tests := []struct {
+		name       string
+		preserve   bool
+		cpu        string
+		memory     string
+		wantCPU    string
+		wantMemory string
+	}{
+		{name: "off", cpu: "2m", memory: "10Gi", wantCPU: "1m", wantMemory: "2Gi"},
+		{name: "cpu floor reached", preserve: true, cpu: "2m", memory: "10Gi", wantCPU: "1m", wantMemory: "5Gi"},
+		{name: "memory floor reached", preserve: true, cpu: "10", memory: "2Mi", wantCPU: "5", wantMemory: "1Mi"},
+		{name: "both at their floors", preserve: true, cpu: "1m", memory: "1Mi", wantCPU: "1m", wantMemory: "1Mi"},
+		{name: "no floor reached", preserve: true, cpu: "250m", memory: "512Mi", wantCPU: "50m", wantMemory: "107374182"},
+		{name: "cpu only", preserve: true, cpu: "2m", wantCPU: "1m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.PreserveCPUMemoryRatio = tt.preserve })
+			pod := testPod(1)
+			requests := corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(tt.cpu)}
+			if tt.memory != "" {
+				requests[corev1.ResourceMemory] = resource.MustParse(tt.memory)
+			}
+			pod.Spec.Containers[0].Resources.Requests = requests
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			got := result.Spec.Containers[0].Resources.Requests
+			if cpu := got[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+				t.Errorf("cpu request = %s, want %s", cpu.String(), tt.wantCPU)
+			}
+			if tt.wantMemory == "" {
+				return
+			}
+			if memory := got[corev1.ResourceMemory]; memory.Cmp(resource.MustParse(tt.wantMemory)) != 0 {
+				t.Errorf("memory request = %s, want %s", memory.String(), tt.wantMemory)
+			}
+		})
+	}
+}
+
+func TestReduceLimits(t *testing.T) {
+	tests := []struct {
+		name         string
+		minReduceCPU string
+		request      string
+		limit        string
+		wantRequest  string
+		wantLimit    string
+	}{
+		{name: "reduced", request: "250m", limit: "1", wantRequest: "50m", wantLimit: "200m"},
+		{name: "request below threshold", minReduceCPU: "500m", request: "250m", limit: "1", wantRequest: "250m", wantLimit: "250m"},
+		{name: "limit raised to request", minReduceCPU: "500m", request: "250m", limit: "600m", wantRequest: "250m", wantLimit: "250m"},
+		{name: "limit below request once reduced", minReduceCPU: "100m", request: "250m", limit: "250m", wantRequest: "50m", wantLimit: "50m"},
+		// A limit below the threshold isn't reduced either
+		{name: "limit below threshold", minReduceCPU: "500m", request: "250m", limit: "300m", wantRequest: "250m", wantLimit: "300m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ReduceLimits = true
+				if tt.minReduceCPU != "" {
+					c.MinReduceCPU = resource.MustParse(tt.minReduceCPU)
+				}
+			})
+
+			resources := corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(tt.request)},
+				Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse(tt.limit)},
+			}
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app", Resources: resources}}}}
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+			got := result.Spec.Containers[0].Resources
+			if cpu := got.Requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantRequest)) != 0 {
+				t.Errorf("cpu request = %s, want %s", cpu.String(), tt.wantRequest)
+			}
+			if cpu := got.Limits[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantLimit)) != 0 {
+				t.Errorf("cpu limit = %s, want %s", cpu.String(), tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestAggressive(t *testing.T) {
+	tests := []struct {
+		name        string
+		set         func(c *Config)
+		annotations map[string]string
+		wantCPU     string
+		wantMemory  string
+	}{
+		{name: "normal", wantCPU: "50m", wantMemory: "107374182"},
+		{name: "aggressive", annotations: map[string]string{aggressiveAnnotation: "true"}, wantCPU: "12m", wantMemory: "26843545"},
+		{name: "not true", annotations: map[string]string{aggressiveAnnotation: "yes"}, wantCPU: "50m", wantMemory: "107374182"},
+		{
+			name:        "configured percentage",
+			set:         func(c *Config) { c.AggressiveKeepPercent = 50 },
+			annotations: map[string]string{aggressiveAnnotation: "true"},
+			wantCPU:     "125m",
+			wantMemory:  "256Mi",
+		},
+		{
+			name:        "cap mode",
+			set:         func(c *Config) { c.ReductionMode = reductionModeCap },
+			annotations: map[string]string{aggressiveAnnotation: "true"},
+			wantCPU:     "100m",
+			wantMemory:  "128Mi",
+		},
+		{
+			name:        "floors still apply",
+			set:         func(c *Config) { c.AggressiveKeepPercent = 1 },
+			annotations: map[string]string{aggressiveAnnotation: "true"},
+			wantCPU:     "2m",
+			wantMemory:  "5368709",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := tt.set
+			if set == nil {
+				set = func(c *Config) {}
+			}
+
+			check := func(t *testing.T, requests corev1.ResourceList) {
+				t.Helper()
+				if cpu := requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+					t.Errorf("cpu request = %s, want %s", cpu.String(), tt.wantCPU)
+				}
+				if memory := requests[corev1.ResourceMemory]; memory.Cmp(resource.MustParse(tt.wantMemory)) != 0 {
+					t.Errorf("memory request = %s, want %s", memory.String(), tt.wantMemory)
+				}
+			}
+			t.Run("pod", func(t *testing.T) {
+				withConfig(t, set)
+				pod := testPod(1)
+				maps.Copy(pod.Annotations, tt.annotations)
+				var result corev1.Pod
+				admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+				check(t, result.Spec.Containers[0].Resources.Requests)
+			})
+			t.Run("pod template", func(t *testing.T) {
+				withConfig(t, set)
+				deployment := testDeployment(nil)
+				deployment.Spec.Template.Annotations = tt.annotations
+				var result appsv1.Deployment
+				admitInto(t, mutateDeployment, createRequest(t, "Deployment", deployment), &result)
+				check(t, result.Spec.Template.Spec.Containers[0].Resources.Requests)
+			})
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// relaxTopologySpread rewrites hard topology spread constraints to soft ones,
+// so pods on small clusters are scheduled even when they can't be spread.
+func relaxTopologySpread(pod *corev1.Pod) []patchOperation {
+	var patches []patchOperation
+	for i, constraint := range pod.Spec.TopologySpreadConstraints {
+		if constraint.WhenUnsatisfiable != corev1.DoNotSchedule {
+			continue
+		}
+		patches = append(patches, patchOperation{
+			Op:    "replace",
+			Path:  fmt.Sprintf("/spec/topologySpreadConstraints/%d/whenUnsatisfiable", i),
+			Value: corev1.ScheduleAnyway,
+		})
+		slog.Debug("Relaxing topology spread constraint", "namespace", pod.Namespace, "name", pod.Name, "topologyKey", constraint.TopologyKey)
+	}
+	return patches
+}
+
+// relaxAntiAffinity turns required pod anti-affinity terms into preferred
+// ones, so replicas that can't be kept apart still get scheduled.
+func relaxAntiAffinity(pod *corev1.Pod) []patchOperation {
+	affinity := pod.Spec.Affinity
+	if affinity == nil || affinity.PodAntiAffinity == nil {
+		return nil
+	}
+	antiAffinity := affinity.PodAntiAffinity
+	if len(antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution) == 0 {
+		return nil
+	}
+
+	const basePath = "/spec/affinity/podAntiAffinity"
+	var patches []patchOperation
+
+	preferred := make([]corev1.WeightedPodAffinityTerm, 0, len(antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution))
+	for _, term := range antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution {
+		preferred = append(preferred, corev1.WeightedPodAffinityTerm{
+			Weight:          100,
+			PodAffinityTerm: term,
+		})
+	}
+	if len(antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution) == 0 {
+		patches = append(patches, patchOperation{
+			Op:    "add",
+			Path:  basePath + "/preferredDuringSchedulingIgnoredDuringExecution",
+			Value: preferred,
+		})
+	} else {
+		for _, term := range preferred {
+			patches = append(patches, patchOperation{
+				Op:    "add",
+				Path:  basePath + "/preferredDuringSchedulingIgnoredDuringExecution/-",
+				Value: term,
+			})
+		}
+	}
+	patches = append(patches, patchOperation{
+		Op:   "remove",
+		Path: basePath + "/requiredDuringSchedulingIgnoredDuringExecution",
+	})
+
+	slog.Debug("Converting required pod anti-affinity to preferred", "namespace", pod.Namespace, "name", pod.Name)
+	return patches
+}
+
+// forcePriorityClass sets the pod's priorityClassName to class and drops the
+// priority resolved from the old class, so the new class takes effect.
+func forcePriorityClass(pod *corev1.Pod, class string) []patchOperation {
+	if pod.Spec.PriorityClassName == class {
+		return nil
+	}
+
+	var patches []patchOperation
+	op := "replace"
+	if pod.Spec.PriorityClassName == "" {
+		op = "add"
+	}
+	patches = append(patches, patchOperation{
+		Op:    op,
+		Path:  "/spec/priorityClassName",
+		Value: class,
+	})
+	if pod.Spec.Priority != nil {
+		patches = append(patches, patchOperation{
+			Op:   "remove",
+			Path: "/spec/priority",
+		})
+	}
+
+	slog.Debug("Setting priorityClassName", "namespace", pod.Namespace, "name", pod.Name, "priorityClassName", class, "previous", pod.Spec.PriorityClassName)
+	return patches
+}
+
+// forceSchedulerName sets the pod's schedulerName to scheduler.
+func forceSchedulerName(pod *corev1.Pod, scheduler string) []patchOperation {
+	if pod.Spec.SchedulerName == scheduler {
+		return nil
+	}
+
+	op := "replace"
+	if pod.Spec.SchedulerName == "" {
+		op = "add"
+	}
+	slog.Debug("Setting schedulerName", "namespace", pod.Namespace, "name", pod.Name, "schedulerName", scheduler, "previous", pod.Spec.SchedulerName)
+	return []patchOperation{{
+		Op:    op,
+		Path:  "/spec/schedulerName",
+		Value: scheduler,
+	}}
+}
+
+// capTerminationGracePeriod lowers the pod's terminationGracePeriodSeconds
+// to maxSeconds, so a node running it drains faster. A pod without one gets
+// the default of 30 seconds, which is capped too.
+func capTerminationGracePeriod(pod *corev1.Pod, maxSeconds int64) []patchOperation {
+	current, op := int64(corev1.DefaultTerminationGracePeriodSeconds), "add"
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		current, op = *pod.Spec.TerminationGracePeriodSeconds, "replace"
+	}
+	if current <= maxSeconds {
+		return nil
+	}
+
+	slog.Debug("Capping terminationGracePeriodSeconds", "namespace", pod.Namespace, "name", pod.Name, "terminationGracePeriodSeconds", maxSeconds, "previous", current)
+	return []patchOperation{{
+		Op:    op,
+		Path:  "/spec/terminationGracePeriodSeconds",
+		Value: maxSeconds,
+	}}
+}
+
+// tolerationMatch matches tolerations by key and, unless empty, effect.
+type tolerationMatch struct {
+	key    string
+	effect corev1.TaintEffect
+}
+
+// matches reports whether m matches toleration. An empty key only matches
+// tolerations without a key, which tolerate every taint.
+func (m tolerationMatch) matches(toleration corev1.Toleration) bool {
+	return toleration.Key == m.key && (m.effect == "" || toleration.Effect == m.effect)
+}
+
+// parseTolerationMatches parses a comma separated list of toleration keys,
+// each optionally followed by a colon and an effect, e.g.
+// "dedicated:NoSchedule,gpu". A key left empty, e.g. ":NoSchedule", matches
+// tolerations without a key.
+func parseTolerationMatches(val string) ([]tolerationMatch, error) {
+	var matches []tolerationMatch
+	for _, entry := range strings.Split(val, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, effect, _ := strings.Cut(entry, ":")
+		switch corev1.TaintEffect(effect) {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return nil, fmt.Errorf("%q: effect must be NoSchedule, PreferNoSchedule or NoExecute", entry)
+		}
+		matches = append(matches, tolerationMatch{key: key, effect: corev1.TaintEffect(effect)})
+	}
+	return matches, nil
+}
+
+// removeTolerations removes the tolerations of the pod matched by any of
+// matches. The kept tolerations replace the list as a whole, as removing
+// elements by index depends on the order of the patches.
+func removeTolerations(pod *corev1.Pod, matches []tolerationMatch) []patchOperation {
+	kept := slices.DeleteFunc(slices.Clone(pod.Spec.Tolerations), func(toleration corev1.Toleration) bool {
+		return slices.ContainsFunc(matches, func(m tolerationMatch) bool {
+			return m.matches(toleration)
+		})
+	})
+	if len(kept) == len(pod.Spec.Tolerations) {
+		return nil
+	}
+
+	slog.Debug("Removing tolerations", "namespace", pod.Namespace, "name", pod.Name, "removed", len(pod.Spec.Tolerations)-len(kept))
+	if len(kept) == 0 {
+		return []patchOperation{{
+			Op:   "remove",
+			Path: "/spec/tolerations",
+		}}
+	}
+	return []patchOperation{{
+		Op:    "replace",
+		Path:  "/spec/tolerations",
+		Value: kept,
+	}}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRelaxTopologySpread(t *testing.T) {
+	constraints := []corev1.TopologySpreadConstraint{
+		{MaxSkew: 1, TopologyKey: "topology.kubernetes.io/zone", WhenUnsatisfiable: corev1.ScheduleAnyway},
+		{MaxSkew: 1, TopologyKey: "kubernetes.io/hostname", WhenUnsatisfiable: corev1.DoNotSchedule},
+	}
+	tests := []struct {
+		name  string
+		relax bool
+		want  []corev1.UnsatisfiableConstraintAction
+	}{
+		{"relaxed", true, []corev1.UnsatisfiableConstraintAction{corev1.ScheduleAnyway, corev1.ScheduleAnyway}},
+		{"disabled", false, []corev1.UnsatisfiableConstraintAction{corev1.ScheduleAnyway, corev1.DoNotSchedule}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.RelaxTopologySpread = tt.relax })
+			pod := testPod(1)
+			pod.Spec.TopologySpreadConstraints = constraints
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+
+			if len(result.Spec.TopologySpreadConstraints) != len(tt.want) {
+				t.Fatalf("constraints = %v, want %d", result.Spec.TopologySpreadConstraints, len(tt.want))
+			}
+			for i, constraint := range result.Spec.TopologySpreadConstraints {
+				if constraint.WhenUnsatisfiable != tt.want[i] {
+					t.Errorf("constraint %d: whenUnsatisfiable = %s, want %s", i, constraint.WhenUnsatisfiable, tt.want[i])
+				}
+				if constraint.TopologyKey != constraints[i].TopologyKey {
+					t.Errorf("constraint %d: topologyKey = %s, want %s", i, constraint.TopologyKey, constraints[i].TopologyKey)
+				}
+			}
+		})
+	}
+}
+
+func TestRelaxAntiAffinity(t *testing.T) {
+	term := func(app string) corev1.PodAffinityTerm {
+		return corev1.PodAffinityTerm{
+			TopologyKey:   "kubernetes.io/hostname",
+			LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": app}},
+		}
+	}
+	nodeAffinity := &corev1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+			NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+				MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"small"}}},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		affinity *corev1.Affinity
+		want     *corev1.Affinity
+	}{
+		{
+			name: "required",
+			affinity: &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{term("a"), term("b")},
+			}},
+			want: &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+					{Weight: 100, PodAffinityTerm: term("a")},
+					{Weight: 100, PodAffinityTerm: term("b")},
+				},
+			}},
+		},
+		{
+			name: "required and preferred",
+			affinity: &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution:  []corev1.PodAffinityTerm{term("a")},
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{{Weight: 10, PodAffinityTerm: term("b")}},
+			}},
+			want: &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+					{Weight: 10, PodAffinityTerm: term("b")},
+					{Weight: 100, PodAffinityTerm: term("a")},
+				},
+			}},
+		},
+		{
+			name:     "node affinity only",
+			affinity: &corev1.Affinity{NodeAffinity: nodeAffinity},
+			want:     &corev1.Affinity{NodeAffinity: nodeAffinity},
+		},
+		{
+			name: "no affinity",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.RelaxAntiAffinity = true })
+			pod := testPod(1)
+			pod.Spec.Affinity = tt.affinity
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, createRequest(t, "Pod", pod), &result)
+
+			if !equality.Semantic.DeepEqual(result.Spec.Affinity, tt.want) {
+				t.Errorf("affinity = %+v, want %+v", result.Spec.Affinity, tt.want)
+			}
+		})
+	}
+}
+
+func TestForcePriorityClass(t *testing.T) {
+	priority := int32(1000000)
+	tests := []struct {
+		name         string
+		operation    admissionv1.Operation
+		class        string
+		priority     *int32
+		wantClass    string
+		wantPriority *int32
+	}{
+		{"replaced", admissionv1.Create, "high", &priority, "low", nil},
+		{"added", admissionv1.Create, "", nil, "low", nil},
+		{"already low", admissionv1.Create, "low", &priority, "low", &priority},
+		{"update", admissionv1.Update, "high", &priority, "high", &priority},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ForcePriorityClass = "low" })
+			pod := testPod(1)
+			pod.Spec.PriorityClassName = tt.class
+			pod.Spec.Priority = tt.priority
+			req := createRequest(t, "Pod", pod)
+			req.Operation = tt.operation
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, req, &result)
+
+			if result.Spec.PriorityClassName != tt.wantClass {
+				t.Errorf("priorityClassName = %q, want %q", result.Spec.PriorityClassName, tt.wantClass)
+			}
+			if !equality.Semantic.DeepEqual(result.Spec.Priority, tt.wantPriority) {
+				t.Errorf("priority = %v, want %v", result.Spec.Priority, tt.wantPriority)
+			}
+		})
+	}
+}
+
+func TestForceSchedulerName(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		scheduler string
+		want      string
+		wantOp    string
+	}{
+		{"unset", admissionv1.Create, "", "bin-packing", "add"},
+		{"default scheduler", admissionv1.Create, corev1.DefaultSchedulerName, "bin-packing", "replace"},
+		{"custom scheduler", admissionv1.Create, "gpu-scheduler", "bin-packing", "replace"},
+		{"already set", admissionv1.Create, "bin-packing", "bin-packing", ""},
+		// schedulerName can't be changed after creation
+		{"update", admissionv1.Update, corev1.DefaultSchedulerName, corev1.DefaultSchedulerName, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ForceSchedulerName = "bin-packing" })
+			pod := testPod(1)
+			pod.Spec.SchedulerName = tt.scheduler
+			req := createRequest(t, "Pod", pod)
+			req.Operation = tt.operation
+
+			var result corev1.Pod
+			patches := admitInto(t, mutatePod, req, &result)
+
+			if result.Spec.SchedulerName != tt.want {
+				t.Errorf("schedulerName = %q, want %q", result.Spec.SchedulerName, tt.want)
+			}
+			var op string
+			for _, p := range patches {
+				if p.Path == "/spec/schedulerName" {
+					op = p.Op
+				}
+			}
+			if op != tt.wantOp {
+				t.Errorf("schedulerName patch op = %q, want %q", op, tt.wantOp)
+			}
+		})
+	}
+}
+
+func TestCapTerminationGracePeriod(t *testing.T) {
+	seconds := func(s int64) *int64 { return &s }
+	tests := []struct {
+		name      string
+		operation admissionv1.Operation
+		grace     *int64
+		want      *int64
+	}{
+		{"long", admissionv1.Create, seconds(600), seconds(10)},
+		{"none set", admissionv1.Create, nil, seconds(10)},
+		{"short", admissionv1.Create, seconds(5), seconds(5)},
+		{"at the cap", admissionv1.Create, seconds(10), seconds(10)},
+		{"update", admissionv1.Update, seconds(600), seconds(600)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.MaxTerminationGracePeriod = 10 * time.Second })
+			pod := testPod(1)
+			pod.Spec.TerminationGracePeriodSeconds = tt.grace
+			req := createRequest(t, "Pod", pod)
+			req.Operation = tt.operation
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, req, &result)
+
+			if !equality.Semantic.DeepEqual(result.Spec.TerminationGracePeriodSeconds, tt.want) {
+				t.Errorf("terminationGracePeriodSeconds = %v, want %v", ptrString(result.Spec.TerminationGracePeriodSeconds), ptrString(tt.want))
+			}
+		})
+	}
+}
+
+// ptrString formats an optional number for test failures.
+func ptrString(v *int64) string {
+	if v == nil {
+		return "<nil>"
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+func TestParseTolerationMatches(t *testing.T) {
+	tests := []struct {
+		val     string
+		want    []tolerationMatch
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"gpu", []tolerationMatch{{key: "gpu"}}, false},
+		{" dedicated:NoSchedule , gpu ,", []tolerationMatch{{key: "dedicated", effect: corev1.TaintEffectNoSchedule}, {key: "gpu"}}, false},
+		{":NoExecute", []tolerationMatch{{effect: corev1.TaintEffectNoExecute}}, false},
+		{"gpu:Sometimes", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.val, func(t *testing.T) {
+			got, err := parseTolerationMatches(tt.val)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveTolerations(t *testing.T) {
+	everything := corev1.Toleration{Operator: corev1.TolerationOpExists}
+	gpu := corev1.Toleration{Key: "gpu", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}
+	dedicated := corev1.Toleration{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "team", Effect: corev1.TaintEffectNoExecute}
+	notReady := corev1.Toleration{Key: "node.kubernetes.io/not-ready", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoExecute}
+	tests := []struct {
+		name        string
+		operation   admissionv1.Operation
+		remove      string
+		tolerations []corev1.Toleration
+		want        []corev1.Toleration
+	}{
+		{"by key", admissionv1.Create, "gpu,dedicated", []corev1.Toleration{gpu, dedicated, notReady}, []corev1.Toleration{notReady}},
+		{"by key and effect", admissionv1.Create, "gpu:NoExecute,dedicated:NoExecute", []corev1.Toleration{gpu, dedicated, notReady}, []corev1.Toleration{gpu, notReady}},
+		{"without a key", admissionv1.Create, ":NoSchedule,:", []corev1.Toleration{everything, gpu}, []corev1.Toleration{gpu}},
+		{"all removed", admissionv1.Create, "gpu,dedicated", []corev1.Toleration{gpu, dedicated}, nil},
+		{"none matched", admissionv1.Create, "spot", []corev1.Toleration{gpu, notReady}, []corev1.Toleration{gpu, notReady}},
+		{"none set", admissionv1.Create, "gpu", nil, nil},
+		{"update", admissionv1.Update, "gpu", []corev1.Toleration{gpu, notReady}, []corev1.Toleration{gpu, notReady}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches, err := parseTolerationMatches(tt.remove)
+			if err != nil {
+				t.Fatal(err)
+			}
+			withConfig(t, func(c *Config) { c.RemoveTolerations = matches })
+			pod := testPod(1)
+			pod.Spec.Tolerations = tt.tolerations
+			req := createRequest(t, "Pod", pod)
+			req.Operation = tt.operation
+
+			var result corev1.Pod
+			admitInto(t, mutatePod, req, &result)
+
+			if !equality.Semantic.DeepEqual(result.Spec.Tolerations, tt.want) {
+				t.Errorf("tolerations = %+v, want %+v", result.Spec.Tolerations, tt.want)
+			}
+		})
+	}
+}
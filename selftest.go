@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// selfTestCase is a synthetic object run through an admitFunc at startup.
+type selfTestCase struct {
+	name  string
+	kind  string
+	admit admitFunc
+	// object is what the API server would send, result receives the object
+	// after the patch is applied.
+	object any
+	result any
+	// verify checks the patched object.
+	verify func() error
+}
+
+// selfTest runs the mutations on synthetic objects and applies the resulting
+// patches, so broken patch paths fail the startup instead of admissions.
+func selfTest(cfg *Config) error {
+	for _, tc := range selfTestCases() {
+		if err := runSelfTestCase(cfg, tc); err != nil {
+			return fmt.Errorf("%s: %w", tc.name, err)
+		}
+	}
+	return nil
+}
+
+func runSelfTestCase(cfg *Config, tc selfTestCase) error {
+	raw, err := json.Marshal(tc.object)
+	if err != nil {
+		return err
+	}
+	req := &admissionv1.AdmissionRequest{
+		UID:       "self-test",
+		Kind:      metav1.GroupVersionKind{Kind: tc.kind},
+		Namespace: "self-test",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+
+	patches, err := tc.admit(context.Background(), cfg, req)
+	if err != nil {
+		return fmt.Errorf("admitting: %w", err)
+	}
+	patched, err := applyPatches(raw, patches)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(patched, tc.result); err != nil {
+		return fmt.Errorf("decoding patched object: %w", err)
+	}
+	return tc.verify()
+}
+
+// applyPatches applies patches to the JSON document raw.
+func applyPatches(raw []byte, patches []patchOperation) ([]byte, error) {
+	patchBytes, err := json.Marshal(patches)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return nil, fmt.Errorf("decoding patch %s: %w", patchBytes, err)
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		return nil, fmt.Errorf("applying patch %s: %w", patchBytes, err)
+	}
+	return patched, nil
+}
+
+func selfTestCases() []selfTestCase {
+	resources := corev1.ResourceRequirements{
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("1"),
+			corev1.ResourceMemory: resource.MustParse("1Gi"),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse("2"),
+			corev1.ResourceMemory: resource.MustParse("2Gi"),
+		},
+	}
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "self-test",
+			Namespace: "self-test",
+			Annotations: map[string]string{
+				"cluster-autoscaler.kubernetes.io/safe-to-evict": "false",
+			},
+		},
+		Spec: corev1.PodSpec{
+			InitContainers: []corev1.Container{{Name: "init", Image: "init", Resources: resources}},
+			Containers: []corev1.Container{
+				{Name: "app", Image: "app", Resources: resources},
+				{Name: "sidecar", Image: "sidecar", Resources: resources},
+			},
+		},
+	}
+	patchedPod := &corev1.Pod{}
+
+	minReplicas := int32(2)
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "autoscaling/v2", Kind: "HorizontalPodAutoscaler"},
+		ObjectMeta: metav1.ObjectMeta{Name: "self-test", Namespace: "self-test"},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			MinReplicas: &minReplicas,
+			MaxReplicas: 10,
+		},
+	}
+	patchedHPA := &autoscalingv2.HorizontalPodAutoscaler{}
+
+	replicas := int32(3)
+	deployment := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "self-test", Namespace: "self-test"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas},
+	}
+	patchedDeployment := &appsv1.Deployment{}
+
+	quota := &corev1.ResourceQuota{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ResourceQuota"},
+		ObjectMeta: metav1.ObjectMeta{Name: "self-test", Namespace: "self-test"},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: corev1.ResourceList{
+				corev1.ResourceLimitsCPU:   resource.MustParse("10"),
+				corev1.ResourceRequestsCPU: resource.MustParse("10"),
+				corev1.ResourceMemory:      resource.MustParse("10Gi"),
+				corev1.ResourcePods:        resource.MustParse("10"),
+				"requests.nvidia.com/gpu":  resource.MustParse("1"),
+			},
+		},
+	}
+	patchedQuota := &corev1.ResourceQuota{}
+
+	return []selfTestCase{
+		{
+			name:   "pod",
+			kind:   "Pod",
+			admit:  mutatePod,
+			object: pod,
+			result: patchedPod,
+			verify: func() error {
+				containers := append(patchedPod.Spec.InitContainers, patchedPod.Spec.Containers...)
+				for _, c := range containers {
+					for name, q := range c.Resources.Requests {
+						if q.Cmp(resources.Requests[name]) > 0 {
+							return fmt.Errorf("container %s: %s request increased to %s", c.Name, name, q.String())
+						}
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name:   "hpa",
+			kind:   "HorizontalPodAutoscaler",
+			admit:  mutateHPA,
+			object: hpa,
+			result: patchedHPA,
+			verify: func() error {
+				if patchedHPA.Spec.MinReplicas == nil || *patchedHPA.Spec.MinReplicas > patchedHPA.Spec.MaxReplicas {
+					return fmt.Errorf("invalid replicas min=%v max=%d", patchedHPA.Spec.MinReplicas, patchedHPA.Spec.MaxReplicas)
+				}
+				return nil
+			},
+		},
+		{
+			name:   "replicas",
+			kind:   "Deployment",
+			admit:  mutateReplicas,
+			object: deployment,
+			result: patchedDeployment,
+			verify: func() error {
+				if r := patchedDeployment.Spec.Replicas; r == nil || *r > replicas {
+					return fmt.Errorf("invalid replicas %v", r)
+				}
+				return nil
+			},
+		},
+		{
+			name:   "resourcequota",
+			kind:   "ResourceQuota",
+			admit:  mutateResourceQuota,
+			object: quota,
+			result: patchedQuota,
+			verify: func() error {
+				for name, q := range patchedQuota.Spec.Hard {
+					if original, ok := quota.Spec.Hard[name]; !ok || q.Cmp(original) != 0 {
+						return fmt.Errorf("hard limit %s changed to %s", name, q.String())
+					}
+				}
+				return nil
+			},
+		},
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSelfTest(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(c *Config)
+	}{
+		{"defaults", func(c *Config) {}},
+		{"cap", func(c *Config) { c.ReductionMode = reductionModeCap }},
+		{"remove requests", func(c *Config) { c.RemoveRequests = true }},
+		{"reduce limits", func(c *Config) { c.ReduceLimits = true }},
+		{"keep limits", func(c *Config) { c.KeepLimits = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := withConfig(t, tt.set)
+			if err := selfTest(cfg); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestSelfTestBrokenPatch(t *testing.T) {
+	tc := selfTestCase{
+		name: "broken",
+		kind: "Pod",
+		admit: func(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+			return []patchOperation{{Op: "replace", Path: "/spec/containers/3/resources"}}, nil
+		},
+		object: testPod(1),
+		result: &corev1.Pod{},
+		verify: func() error { return nil },
+	}
+	if err := runSelfTestCase(defaultConfig(), tc); err == nil {
+		t.Error("patching a missing container passed the self-test")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+// handleSimulate runs a plain Pod manifest, YAML or JSON, through the pod
+// mutations and answers the patched pod as JSON. It's meant for trying out a
+// configuration locally, without a cluster.
+func handleSimulate(w http.ResponseWriter, r *http.Request) {
+	cfg := activeConfig.Load()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	raw, err := yaml.YAMLToJSON(body)
+	if err != nil {
+		http.Error(w, "failed to parse pod manifest: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Marked as a dry run so no Event is created for the pod
+	dryRun := true
+	req := &admissionv1.AdmissionRequest{
+		UID:       "simulate",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Operation: admissionv1.Create,
+		DryRun:    &dryRun,
+		Object:    runtime.RawExtension{Raw: raw},
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.AdmissionTimeout)
+	defer cancel()
+	patches, err := admitRecovered(ctx, cfg, req, mutatePod)
+	var denied deniedError
+	var badRequest badRequestError
+	switch {
+	case errors.As(err, &denied):
+		http.Error(w, "pod denied: "+denied.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.As(err, &badRequest):
+		http.Error(w, badRequest.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		slog.Error("Failed to simulate pod", "error", err)
+		http.Error(w, "failed to process pod", http.StatusInternalServerError)
+		return
+	}
+
+	patched, err := applyPatches(raw, patches)
+	if err != nil {
+		http.Error(w, "failed to apply patches: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Resource-Remover-Patches", strconv.Itoa(len(patches)))
+	w.Write(patched)
+}
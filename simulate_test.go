@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestHandleSimulate(t *testing.T) {
+	podYAML := `apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  containers:
+    - name: app
+      image: app
+      resources:
+        requests:
+          cpu: 500m
+        limits:
+          cpu: "1"
+`
+	tests := []struct {
+		name        string
+		validate    bool
+		body        string
+		want        int
+		wantCPU     string
+		wantPatches string
+	}{
+		{name: "yaml", body: podYAML, want: http.StatusOK, wantCPU: "100m", wantPatches: "2"},
+		{
+			name:        "json",
+			body:        `{"apiVersion":"v1","kind":"Pod","spec":{"containers":[{"name":"app","resources":{"requests":{"cpu":"500m"}}}]}}`,
+			want:        http.StatusOK,
+			wantCPU:     "100m",
+			wantPatches: "1",
+		},
+		{name: "not a manifest", body: "\t{", want: http.StatusBadRequest},
+		{name: "not a pod", body: `spec: []`, want: http.StatusBadRequest},
+		{name: "denied", validate: true, body: `{"apiVersion":"v1","kind":"Pod","spec":{}}`, want: http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ValidatePodShape = tt.validate })
+
+			r := httptest.NewRequest(http.MethodPost, "/simulate", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			handleSimulate(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d, body: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("X-Resource-Remover-Patches"); got != tt.wantPatches {
+				t.Errorf("patches = %s, want %s", got, tt.wantPatches)
+			}
+			var pod corev1.Pod
+			if err := json.Unmarshal(w.Body.Bytes(), &pod); err != nil {
+				t.Fatalf("decoding pod: %v", err)
+			}
+			resources := pod.Spec.Containers[0].Resources
+			if cpu := resources.Requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse(tt.wantCPU)) != 0 {
+				t.Errorf("cpu request = %s, want %s", cpu.String(), tt.wantCPU)
+			}
+			if len(resources.Limits) > 0 {
+				t.Errorf("limits = %v, want none", resources.Limits)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime"
+)
+
+// debugStats is served on /debug/stats, for diagnosing memory and goroutine
+// leaks without enabling pprof.
+type debugStats struct {
+	Goroutines int              `json:"goroutines"`
+	MemStats   runtime.MemStats `json:"memStats"`
+}
+
+func handleDebugStats(w http.ResponseWriter, r *http.Request) {
+	stats := debugStats{Goroutines: runtime.NumGoroutine()}
+	// Briefly stops the world, which is fine for an occasional request
+	runtime.ReadMemStats(&stats.MemStats)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		slog.Error("Failed to write debug stats", "error", err)
+	}
+}
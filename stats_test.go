@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleDebugStats(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleDebugStats(w, httptest.NewRequest(http.MethodGet, "/debug/stats", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var stats struct {
+		Goroutines int                        `json:"goroutines"`
+		MemStats   map[string]json.RawMessage `json:"memStats"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	if stats.Goroutines < 1 {
+		t.Errorf("goroutines = %d, want at least 1", stats.Goroutines)
+	}
+
+	tests := []struct {
+		field   string
+		nonZero bool
+	}{
+		{field: "Alloc", nonZero: true},
+		{field: "HeapAlloc", nonZero: true},
+		{field: "HeapObjects", nonZero: true},
+		{field: "Sys", nonZero: true},
+		{field: "NumGC"},
+		{field: "PauseTotalNs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			raw, ok := stats.MemStats[tt.field]
+			if !ok {
+				t.Fatalf("memStats.%s missing from %s", tt.field, w.Body)
+			}
+			var value uint64
+			if err := json.Unmarshal(raw, &value); err != nil {
+				t.Fatalf("memStats.%s = %s: %v", tt.field, raw, err)
+			}
+			if tt.nonZero && value == 0 {
+				t.Errorf("memStats.%s = 0, want more", tt.field)
+			}
+		})
+	}
+}
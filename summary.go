@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Reasons an object is left alone, as reported in the request summary.
+const (
+	skipReasonAnnotation     = "skip annotation"
+	skipReasonNamespace      = "namespace disabled"
+	skipReasonExcluded       = "namespace excluded"
+	skipReasonWindows        = "windows"
+	skipReasonDaemonSet      = "daemonset"
+	skipReasonOwned          = "owned by deployment"
+	skipReasonAlreadyReduced = "already reduced"
+	skipReasonNotSelected    = "not selected"
+	skipReasonOwnerKind      = "owner kind"
+	skipReasonScale          = "scale subresource"
+)
+
+// requestSummary collects what happened to the object of an admission
+// request, logged as a single line once the request is answered.
+type requestSummary struct {
+	skipReason string
+}
+
+type summaryKey struct{}
+
+// withSummary returns a context carrying a new request summary.
+func withSummary(ctx context.Context) (context.Context, *requestSummary) {
+	summary := &requestSummary{}
+	return context.WithValue(ctx, summaryKey{}, summary), summary
+}
+
+// skipped records in the summary of the request in ctx why its object was
+// left alone.
+func skipped(ctx context.Context, reason string) {
+	if summary, ok := ctx.Value(summaryKey{}).(*requestSummary); ok {
+		summary.skipReason = reason
+	}
+}
+
+// containerResourcesPath matches the paths of patches to container resources
+// of pods, pod templates and other objects embedding containers, capturing
+// the container.
+var containerResourcesPath = regexp.MustCompile(`^((?:/[^/]+)*/(?:init)?[cC]ontainers/\d+)/resources/(requests|limits)/`)
+
+// attrs returns the summary attributes describing patches.
+func (s *requestSummary) attrs(patches []patchOperation) []any {
+	containers := map[string]bool{}
+	limitsRemoved, annotationsRemoved, replicasPatched := 0, 0, false
+	for _, p := range patches {
+		if m := containerResourcesPath.FindStringSubmatch(p.Path); m != nil {
+			if m[2] == "requests" {
+				containers[m[1]] = true
+			} else if p.Op == "remove" {
+				limitsRemoved++
+			}
+		}
+		if p.Op == "remove" && strings.HasPrefix(p.Path, "/metadata/annotations/") {
+			annotationsRemoved++
+		}
+		switch p.Path {
+		case "/spec/replicas", "/spec/minReplicas", "/spec/maxReplicas", "/spec/minReplicaCount", "/spec/maxReplicaCount":
+			replicasPatched = true
+		}
+	}
+	return []any{
+		slog.Bool("skipped", s.skipReason != ""),
+		slog.String("skipReason", s.skipReason),
+		slog.Int("containersReduced", len(containers)),
+		slog.Int("limitsRemoved", limitsRemoved),
+		slog.Int("annotationsRemoved", annotationsRemoved),
+		slog.Bool("replicasPatched", replicasPatched),
+		slog.Int("patchCount", len(patches)),
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestRequestSummaryAttrs(t *testing.T) {
+	tests := []struct {
+		name    string
+		patches []patchOperation
+		want    map[string]any
+	}{
+		{
+			name: "none",
+			want: map[string]any{"containersReduced": 0, "limitsRemoved": 0, "annotationsRemoved": 0, "replicasPatched": false, "patchCount": 0},
+		},
+		{
+			name: "pod",
+			patches: []patchOperation{
+				{Op: "remove", Path: "/metadata/annotations/cluster-autoscaler.kubernetes.io~1safe-to-evict"},
+				{Op: "replace", Path: "/spec/containers/0/resources/requests/cpu"},
+				{Op: "replace", Path: "/spec/containers/0/resources/requests/memory"},
+				{Op: "remove", Path: "/spec/containers/0/resources/limits/cpu"},
+				{Op: "replace", Path: "/spec/initContainers/0/resources/requests/cpu"},
+				{Op: "remove", Path: "/spec/initContainers/0/resources/limits/cpu"},
+			},
+			want: map[string]any{"containersReduced": 2, "limitsRemoved": 2, "annotationsRemoved": 1, "replicasPatched": false, "patchCount": 6},
+		},
+		{
+			name: "pod template",
+			patches: []patchOperation{
+				{Op: "replace", Path: "/spec/template/spec/containers/1/resources/requests/cpu"},
+				{Op: "replace", Path: "/spec/template/spec/containers/1/resources/limits/cpu"},
+			},
+			want: map[string]any{"containersReduced": 1, "limitsRemoved": 0, "annotationsRemoved": 0, "replicasPatched": false, "patchCount": 2},
+		},
+		{
+			name:    "replicas",
+			patches: []patchOperation{{Op: "replace", Path: "/spec/replicas", Value: 1}},
+			want:    map[string]any{"containersReduced": 0, "limitsRemoved": 0, "annotationsRemoved": 0, "replicasPatched": true, "patchCount": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]any{}
+			for _, attr := range (&requestSummary{}).attrs(tt.patches) {
+				a := attr.(slog.Attr)
+				got[a.Key] = a.Value.Any()
+			}
+			for key, want := range tt.want {
+				if v, ok := got[key].(int64); ok {
+					got[key] = int(v)
+				}
+				if got[key] != want {
+					t.Errorf("%s = %v, want %v", key, got[key], want)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmissionSummaryLine(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	withConfig(t, func(c *Config) {})
+
+	pod := testPod(1)
+	pod.Annotations[skipAnnotation] = "true"
+	postReview(handleMutate, reviewBody(t, createRequest(t, "Pod", pod)))
+
+	var lines []map[string]any
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		if line["msg"] == "Admission request" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) != 1 {
+		t.Fatalf("%d summary lines, want 1", len(lines))
+	}
+	if got := lines[0]; got["handler"] != "pod" || got["skipped"] != true || got["skipReason"] != skipReasonAnnotation {
+		t.Errorf("summary = %v, want skipped pod", got)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewTLSConfig(t *testing.T) {
+	certFile, _ := writeTestCert(t, t.TempDir())
+	empty := filepath.Join(t.TempDir(), "empty.crt")
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		clientCAFile   string
+		minVersion     string
+		wantMinVersion uint16
+		wantClientAuth tls.ClientAuthType
+		wantErr        bool
+	}{
+		{name: "defaults", wantMinVersion: tls.VersionTLS12},
+		{name: "TLS 1.3", minVersion: "1.3", wantMinVersion: tls.VersionTLS13},
+		{name: "TLS 1.1", minVersion: "1.1", wantErr: true},
+		{name: "client CA", clientCAFile: certFile, wantMinVersion: tls.VersionTLS12, wantClientAuth: tls.VerifyClientCertIfGiven},
+		{name: "missing client CA", clientCAFile: filepath.Join(t.TempDir(), "missing.crt"), wantErr: true},
+		{name: "empty client CA", clientCAFile: empty, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := newTLSConfig(tt.clientCAFile, tt.minVersion)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error: %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if config.MinVersion != tt.wantMinVersion || config.ClientAuth != tt.wantClientAuth {
+				t.Errorf("MinVersion = %x, ClientAuth = %v, want %x, %v", config.MinVersion, config.ClientAuth, tt.wantMinVersion, tt.wantClientAuth)
+			}
+		})
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := newTLSConfig(certFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(requireClientCert(handleHealth))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		certificates []tls.Certificate
+		want         int
+	}{
+		{name: "verified", certificates: []tls.Certificate{clientCert}, want: http.StatusOK},
+		{name: "without certificate", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A transport of its own, so no connection is reused
+			transport := server.Client().Transport.(*http.Transport).Clone()
+			transport.TLSClientConfig.Certificates = tt.certificates
+			defer transport.CloseIdleConnections()
+			resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	config, err := newTLSConfig("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handleHealth))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name         string
+		version      uint16
+		cipherSuites []uint16
+		wantErr      bool
+	}{
+		{name: "TLS 1.3", version: tls.VersionTLS13},
+		{name: "TLS 1.2", version: tls.VersionTLS12},
+		{name: "TLS 1.1", version: tls.VersionTLS11, wantErr: true},
+		{name: "TLS 1.0", version: tls.VersionTLS10, wantErr: true},
+		{name: "TLS 1.2 CBC", version: tls.VersionTLS12, cipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA, tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+			clientConfig.MinVersion = tt.version
+			clientConfig.MaxVersion = tt.version
+			clientConfig.CipherSuites = tt.cipherSuites
+			conn, err := tls.Dial("tcp", server.Listener.Addr().String(), clientConfig)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handshake error = %v, want error: %t", err, tt.wantErr)
+			}
+			if err == nil {
+				conn.Close()
+			}
+		})
+	}
+}
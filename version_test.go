@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestHandleVersion(t *testing.T) {
+	tests := []struct {
+		name                                   string
+		version, commit, buildDate             string
+		wantVersion, wantCommit, wantBuildDate string
+	}{
+		{
+			name:          "set at build time",
+			version:       "1.2.3",
+			commit:        "abc123",
+			buildDate:     "2026-10-16T12:00:00Z",
+			wantVersion:   "1.2.3",
+			wantCommit:    "abc123",
+			wantBuildDate: "2026-10-16T12:00:00Z",
+		},
+		{name: "empty version", wantVersion: "dev"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := [3]string{version, commit, buildDate}
+			t.Cleanup(func() { version, commit, buildDate = previous[0], previous[1], previous[2] })
+			version, commit, buildDate = tt.version, tt.commit, tt.buildDate
+
+			w := httptest.NewRecorder()
+			handleVersion(w, httptest.NewRequest(http.MethodGet, "/version", nil))
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", ct)
+			}
+			var fields map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+				t.Fatalf("decoding %s: %v", w.Body, err)
+			}
+			for _, key := range []string{"version", "commit", "buildDate", "goVersion"} {
+				if _, ok := fields[key]; !ok {
+					t.Errorf("%s missing from %s", key, w.Body)
+				}
+			}
+			if fields["version"] != tt.wantVersion || fields["goVersion"] != runtime.Version() {
+				t.Errorf("version = %q, goVersion = %q, want %q, %q", fields["version"], fields["goVersion"], tt.wantVersion, runtime.Version())
+			}
+			// Test binaries carry no VCS information to fall back to
+			if fields["commit"] != tt.wantCommit || fields["buildDate"] != tt.wantBuildDate {
+				t.Errorf("commit = %q, buildDate = %q, want %q, %q", fields["commit"], fields["buildDate"], tt.wantCommit, tt.wantBuildDate)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// reducedAnnotation is set on pod templates reduced by /mutate-deployment.
+// Its value is a hash of the reduced resources, so an unchanged template
+// isn't reduced again on every update, and pods created from it are left
+// alone by /mutate.
+const reducedAnnotation = "resource-remover.nais.io/reduced"
+
+func handleMutateDeployment(w http.ResponseWriter, r *http.Request) {
+	serveAdmission(w, r, "deployment", mutateDeployment)
+}
+
+// mutateDeployment reduces the resources in the pod template of a workload,
+// making the reduction visible on the workload itself.
+func mutateDeployment(ctx context.Context, cfg *Config, req *admissionv1.AdmissionRequest) ([]patchOperation, error) {
+	var workload struct {
+		Metadata metav1.ObjectMeta `json:"metadata"`
+		Spec     struct {
+			Template corev1.PodTemplateSpec `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(req.Object.Raw, &workload); err != nil {
+		return nil, badRequestError("failed to unmarshal workload")
+	}
+
+	kind := req.Kind.Kind
+	meta := &workload.Metadata
+	template := &workload.Spec.Template
+
+	// Check for skip annotation on the workload and its pod template. The
+	// pods are created from the template only, so a skip annotation on the
+	// workload is propagated to the template for /mutate to see it.
+	if skips(meta.Annotations, skipResources) {
+		skipped(ctx, skipReasonAnnotation)
+		slog.Debug("Skipping workload due to skip annotation", "kind", kind, "namespace", meta.Namespace, "name", meta.Name)
+		if _, ok := template.Annotations[skipAnnotation]; ok {
+			return nil, nil
+		}
+		return addAnnotations("/spec/template/metadata", template.Annotations, nil, map[string]string{skipAnnotation: meta.Annotations[skipAnnotation]}), nil
+	}
+	if skips(template.Annotations, skipResources) {
+		skipped(ctx, skipReasonAnnotation)
+		slog.Debug("Skipping workload due to skip annotation", "kind", kind, "namespace", meta.Namespace, "name", meta.Name)
+		return nil, nil
+	}
+
+	if cfg.SkipWindows && isWindows(&template.Spec) {
+		skipped(ctx, skipReasonWindows)
+		slog.Debug("Skipping workload with Windows pods", "kind", kind, "namespace", meta.Namespace, "name", meta.Name)
+		return nil, nil
+	}
+
+	if !selected(cfg, template.Labels) {
+		skipped(ctx, skipReasonNotSelected)
+		slog.Debug("Skipping workload with pods not matching the selector", "kind", kind, "namespace", meta.Namespace, "name", meta.Name)
+		return nil, nil
+	}
+
+	if val, ok := template.Annotations[reducedAnnotation]; ok && val == resourcesHash(&template.Spec) {
+		skipped(ctx, skipReasonAlreadyReduced)
+		return nil, nil
+	}
+
+	const basePath = "/spec/template/spec"
+	filter := newContainerFilter(meta, template.Annotations)
+	floors := withNodeCapacity(ctx, cfg, withMinMemory(cfg, podFloors(cfg, &template.Spec), meta, template.Annotations))
+	stage := 0
+	if len(cfg.ReductionRamp) > 0 && cfg.ReductionMode == reductionModeProportional {
+		stage = rampStage(cfg, kind, meta, req.Operation)
+		floors.keepPercent = cfg.ReductionRamp[stage-1]
+	}
+	// Volunteering for the stronger reduction skips the ramp
+	floors = withAggressive(cfg, floors, template.Annotations)
+	if floorGuardTripped(cfg, slices.Concat(template.Spec.Containers, template.Spec.InitContainers), filter, floors) {
+		slog.Info("Not reducing pod template, too many of its containers would be reduced to the floor", "kind", kind, "namespace", meta.Namespace, "name", meta.Name)
+		return nil, nil
+	}
+	var patches []patchOperation
+	patches = append(patches, reduceContainers(cfg, meta, basePath+"/containers", "container", template.Spec.Containers, filter, floors)...)
+	patches = append(patches, reduceContainers(cfg, meta, basePath+"/initContainers", "init container", template.Spec.InitContainers, filter, floors)...)
+	if len(patches) == 0 {
+		return nil, nil
+	}
+
+	// Hash the resources as they'll be once patched
+	patched, err := applyPatches(req.Object.Raw, patches)
+	if err != nil {
+		return nil, err
+	}
+	var reduced struct {
+		Spec struct {
+			Template corev1.PodTemplateSpec `json:"template"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(patched, &reduced); err != nil {
+		return nil, fmt.Errorf("decoding patched workload: %w", err)
+	}
+	hash := resourcesHash(&reduced.Spec.Template.Spec)
+
+	annotations := ratioAnnotations(cfg, patches, floors)
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[reducedAnnotation] = hash
+	patches = append(patches, addAnnotations("/spec/template/metadata", template.Annotations, patches, annotations)...)
+
+	// The stage is kept on the workload, where it survives template changes
+	if val := strconv.Itoa(stage); stage > 0 && meta.Annotations[reductionStageAnnotation] != val {
+		patches = append(patches, addAnnotations("/metadata", meta.Annotations, patches, map[string]string{reductionStageAnnotation: val})...)
+		slog.Debug("Reduction ramp stage", "kind", kind, "namespace", meta.Namespace, "name", meta.Name, "stage", stage, "keepPercent", floors.keepPercent)
+	}
+
+	slog.Debug("Reduced pod template", "kind", kind, "namespace", meta.Namespace, "name", meta.Name)
+	return patches, nil
+}
+
+// resourcesHash returns a short hash of the resources of all containers in
+// spec.
+func resourcesHash(spec *corev1.PodSpec) string {
+	var resources []corev1.ResourceRequirements
+	for _, c := range spec.InitContainers {
+		resources = append(resources, c.Resources)
+	}
+	for _, c := range spec.Containers {
+		resources = append(resources, c.Resources)
+	}
+	b, _ := json.Marshal(resources)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
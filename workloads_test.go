@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testDeployment returns a deployment with the containers of testPod in its
+// pod template.
+func testDeployment(annotations map[string]string) *appsv1.Deployment {
+	pod := testPod(2)
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "team",
+			Annotations: annotations,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: pod.Labels},
+				Spec:       pod.Spec,
+			},
+		},
+	}
+}
+
+func TestMutateDeployment(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantReduced bool
+		wantSkip    string
+	}{
+		{name: "reduced", wantReduced: true},
+		{
+			name:        "skip annotation is propagated",
+			annotations: map[string]string{skipAnnotation: "resources"},
+			wantSkip:    "resources",
+		},
+		{
+			name:        "skipping other concerns",
+			annotations: map[string]string{skipAnnotation: "replicas"},
+			wantReduced: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {})
+
+			var result appsv1.Deployment
+			admitInto(t, mutateDeployment, createRequest(t, "Deployment", testDeployment(tt.annotations)), &result)
+			template := result.Spec.Template
+			if got := template.Annotations[skipAnnotation]; got != tt.wantSkip {
+				t.Errorf("template skip annotation = %q, want %q", got, tt.wantSkip)
+			}
+			_, reduced := template.Annotations[reducedAnnotation]
+			if reduced != tt.wantReduced {
+				t.Fatalf("template annotations = %v, want reduced: %t", template.Annotations, tt.wantReduced)
+			}
+			if !reduced {
+				return
+			}
+			for _, c := range append(template.Spec.InitContainers, template.Spec.Containers...) {
+				if cpu := c.Resources.Requests[corev1.ResourceCPU]; cpu.Cmp(resource.MustParse("50m")) != 0 {
+					t.Errorf("container %s: cpu request = %s, want 50m", c.Name, cpu.String())
+				}
+				if len(c.Resources.Limits) > 0 {
+					t.Errorf("container %s: limits = %v, want none", c.Name, c.Resources.Limits)
+				}
+			}
+
+			// An update leaving the reduced template alone isn't reduced again
+			var again appsv1.Deployment
+			if patches := admitInto(t, mutateDeployment, createRequest(t, "Deployment", &result), &again); len(patches) > 0 {
+				t.Errorf("patches for reduced template = %v, want none", patches)
+			}
+		})
+	}
+}
+
+func TestResourcesHash(t *testing.T) {
+	spec := testPod(2).Spec
+	hash := resourcesHash(&spec)
+	if hash != resourcesHash(&spec) {
+		t.Error("hash of the same resources differs")
+	}
+	b, err := json.Marshal(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changed corev1.PodSpec
+	if err := json.Unmarshal(b, &changed); err != nil {
+		t.Fatal(err)
+	}
+	changed.Containers[1].Resources.Requests[corev1.ResourceCPU] = resource.MustParse("1")
+	if hash == resourcesHash(&changed) {
+		t.Error("hash unchanged by a changed request")
+	}
+}
+
+func TestMutateWorkloadSkipPropagation(t *testing.T) {
+	tests := []struct {
+		name                string
+		kind                string
+		annotations         map[string]string
+		templateAnnotations map[string]string
+		want                map[string]string
+		wantPatches         bool
+	}{
+		{
+			name:        "template without annotations",
+			kind:        "StatefulSet",
+			annotations: map[string]string{skipAnnotation: "all"},
+			want:        map[string]string{skipAnnotation: "all"},
+			wantPatches: true,
+		},
+		{
+			name:                "template with other annotations",
+			kind:                "Deployment",
+			annotations:         map[string]string{skipAnnotation: "true"},
+			templateAnnotations: map[string]string{"team": "a"},
+			want:                map[string]string{"team": "a", skipAnnotation: "true"},
+			wantPatches:         true,
+		},
+		{
+			// The template's own skip annotation wins
+			name:                "template skip annotation kept",
+			kind:                "Deployment",
+			annotations:         map[string]string{skipAnnotation: "true"},
+			templateAnnotations: map[string]string{skipAnnotation: "resources,hpa"},
+			want:                map[string]string{skipAnnotation: "resources,hpa"},
+		},
+		{
+			name:                "template skip annotation only",
+			kind:                "StatefulSet",
+			templateAnnotations: map[string]string{skipAnnotation: "true"},
+			want:                map[string]string{skipAnnotation: "true"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {})
+
+			deployment := testDeployment(tt.annotations)
+			deployment.Spec.Template.Annotations = tt.templateAnnotations
+			var result appsv1.Deployment
+			patches := admitInto(t, mutateDeployment, createRequest(t, tt.kind, deployment), &result)
+			if (len(patches) > 0) != tt.wantPatches {
+				t.Errorf("patches = %v, want patches: %t", patches, tt.wantPatches)
+			}
+			if got := result.Spec.Template.Annotations; !maps.Equal(got, tt.want) {
+				t.Errorf("template annotations = %v, want %v", got, tt.want)
+			}
+			// The template is left unreduced
+			cpu := result.Spec.Template.Spec.Containers[0].Resources.Requests[corev1.ResourceCPU]
+			if cpu.Cmp(resource.MustParse("250m")) != 0 {
+				t.Errorf("cpu request = %s, want 250m", cpu.String())
+			}
+		})
+	}
+}